@@ -20,16 +20,25 @@ package catshadow
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/client"
+	"github.com/katzenpost/client/config"
 	cConstants "github.com/katzenpost/client/constants"
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/log"
 	"github.com/katzenpost/core/worker"
@@ -55,10 +64,19 @@ type Client struct {
 	reunionChan chan rClient.ReunionUpdate
 	fatalErrCh  chan error
 
+	// shutdownOnce guards the shutdown, which closes shutdownCh
+	// after recording the error causing it in shutdownReason.
+	shutdownOnce   sync.Once
+	shutdownCh     chan struct{}
+	shutdownReason error
+
 	// messageID -> *SentMessageDescriptor
 	sendMap *sync.Map
+	// sendMapSize is the number of entries of the sendMap.
+	sendMapSize int64
 
-	stateWorker         *StateWriter
+	stateWorker         StateStore
+	stateSize           uint32
 	linkKey             *ecdh.PrivateKey
 	user                string
 	contacts            map[uint64]*Contact
@@ -67,11 +85,173 @@ type Client struct {
 	conversations       map[string]map[MessageID]*Message
 	conversationsMutex  *sync.Mutex
 
+	// deliveryTimeout is the duration after which undelivered
+	// outbound messages are marked as failed, zero disables it.
+	deliveryTimeout time.Duration
+
+	// clock is the source of the current time.
+	clock Clock
+
+	// readOnly is true if the Client only receives messages,
+	// it neither sends messages nor runs key exchanges.
+	readOnly bool
+
+	// payloadTransformer transforms the ciphertexts
+	// of messages, nil if they are not transformed.
+	payloadTransformer PayloadTransformer
+
+	// inboundLimit is the number of messages received per contact
+	// within the inboundWindow, zero if it is unlimited.
+	inboundLimit  int
+	inboundWindow time.Duration
+
+	// contactApproval approves the first messages of new
+	// conversations, nil if they are approved implicitly.
+	contactApproval ContactApprovalFunc
+
+	// workerRecovery recovers from panics of the worker, which is
+	// restarted if workerRestart is set and fails the Client otherwise.
+	workerRecovery bool
+	workerRestart  bool
+
+	// decryptionCandidates orders the contacts whose ratchets are
+	// tried on inbound messages, nil if they are tried in any order.
+	decryptionCandidates DecryptionCandidatesFunc
+
+	// decryptionFailure is called with the errors of each contact
+	// when no ratchet decrypts an inbound message, nil if the
+	// failures are only logged.
+	decryptionFailure DecryptionFailureHandler
+
+	// randReader is the source of the random contact,
+	// message and transfer IDs.
+	randReader io.Reader
+
+	// fatalErrorHandler is called upon fatal errors, the
+	// Client shuts down if it is nil or returns true.
+	fatalErrorHandler FatalErrorHandler
+
+	// maxMessagesPerConversation is the number of messages kept
+	// per conversation by the garbage collection, zero is unlimited.
+	maxMessagesPerConversation int
+
+	// offline is true while the transmission of messages is stopped.
+	offline bool
+
+	// compression is true if the messages sent to contacts
+	// which can decode them are compressed.
+	compression bool
+
+	// orderedDelivery is true if the messages to a contact are appended
+	// to its spool strictly in the order they were sent, ignoring their
+	// priority.
+	orderedDelivery bool
+
+	// maintenance is true if the recovery operations
+	// such as SetReadOffset are allowed.
+	maintenance bool
+
+	// paused is true while the network activity is stopped by Pause,
+	// unlike offline it is not persisted.
+	paused bool
+
+	// deferRemoteSpool is true if NewClientAndRemoteSpool leaves
+	// the creation of our remote spool to EnsureRemoteSpool.
+	deferRemoteSpool bool
+
+	// subscriptions are the per-contact event streams
+	// created by SubscribeContact, keyed by subscription.
+	subscriptions      map[*contactSubscription]struct{}
+	subscriptionsMutex *sync.Mutex
+
+	// inboxReads are the message IDs of our reads of the remote
+	// spool which are awaiting their reply, at most maxInboxReads
+	// of them are sent at a time unless it is zero.
+	inboxReads    map[[cConstants.MessageIDLength]byte]struct{}
+	maxInboxReads int
+
+	// sendsSinceInboxRead is the number of messages transmitted to
+	// contacts since our remote spool was last read, the spool is read
+	// once it reaches inboxReadInterleave unless that is zero.
+	sendsSinceInboxRead int
+	inboxReadInterleave int
+
+	// deferredPANDAExchanges are the IDs of the contacts whose PANDA key
+	// exchange awaits a PANDA configuration and the time since when.
+	// The Client fails if one waits for longer than pandaGracePeriod
+	// unless it is zero.
+	deferredPANDAExchanges map[uint64]time.Time
+	pandaGracePeriod       time.Duration
+
+	// eventBufferSize is the number of events buffered for the
+	// EventSink if positive, older or newer events are dropped
+	// depending on eventBufferDropOldest once it is full.
+	eventBufferSize       int
+	eventBufferDropOldest bool
+
+	// eventHistory holds the recent events for ReplayEvents, at most
+	// eventHistorySize events which are kept for eventHistoryRetention.
+	eventHistory          []recordedEvent
+	eventHistorySize      int
+	eventHistoryRetention time.Duration
+	eventHistoryMutex     *sync.Mutex
+
+	// deliveryLog receives the DeliveryRecords buffered in
+	// deliveryRecords if set by WithDeliveryLog.
+	deliveryLog       func(*DeliveryRecord)
+	deliveryLogBuffer int
+	deliveryRecords   *boundedChannel
+
+	// transfers are our file transfers to contacts, incomingFiles
+	// the incomplete file transfers from contacts.
+	transfers     map[TransferID]*fileTransfer
+	incomingFiles map[TransferID]*incomingFile
+
+	// labels indexes the contacts by their labels.
+	labels map[string]map[uint64]*Contact
+
+	// quarantined are the ciphertexts read from our remote
+	// spool which none of our contacts could decrypt.
+	quarantined [][]byte
+
+	// countMutedAsUnread is true if the messages of muted
+	// contacts count towards TotalUnread.
+	countMutedAsUnread bool
+
+	// inboxDrained is true when our last read of the
+	// remote spool found no message at our read offset.
+	inboxDrained bool
+
+	// lastInboxReply is the time of the last valid reply to a read of
+	// our remote spool while polling it, inboxStalled is set once no
+	// valid reply arrived within the inboxStallTimeout.
+	lastInboxReply    time.Time
+	inboxStallTimeout time.Duration
+	inboxStalled      bool
+
+	// pollMinInterval and pollMaxInterval bound the uniformly random
+	// interval between the reads of our remote spool, they are zero
+	// unless set with WithRandomizedPolling.
+	pollMinInterval time.Duration
+	pollMaxInterval time.Duration
+
 	client  *client.Client
-	session *client.Session
+	session Session
+
+	// mixnetSession is the session of the mixnet client for the
+	// PANDA, Reunion and memspool clients, nil if the Session was
+	// injected. sessionEvents are the events of the Session.
+	mixnetSession *client.Session
+	sessionEvents chan client.Event
 
 	log        *logging.Logger
 	logBackend *log.Backend
+
+	// logLevel is the level set by SetLogLevel or nil if unset,
+	// logModules are the names of the loggers we have created.
+	logLevel   *logging.Level
+	logModules map[string]struct{}
+	logMutex   *sync.Mutex
 }
 
 type MessageID [MessageIDLen]byte
@@ -81,14 +261,18 @@ type queuedSpoolCommand struct {
 	Receiver string
 	Command  []byte
 	ID       MessageID
+	Priority int
 }
 
 // NewClientAndRemoteSpool creates a new Client and creates a new remote spool
 // for collecting messages destined to this Client. The Client is associated with
 // this remote spool and this state is preserved in the encrypted statefile, of course.
 // This constructor of Client is used when creating a new Client as opposed to loading
-// the previously saved state for an existing Client.
-func NewClientAndRemoteSpool(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *StateWriter, user string, linkKey *ecdh.PrivateKey) (*Client, error) {
+// the previously saved state for an existing Client. A nil stateWorker creates
+// a memory only Client whose state is lost upon Shutdown. With the
+// WithDeferredRemoteSpool option the remote spool is not created here
+// but by a later call to EnsureRemoteSpool.
+func NewClientAndRemoteSpool(logBackend *log.Backend, mixnetClient *client.Client, stateWorker StateStore, user string, linkKey *ecdh.PrivateKey, opts ...Option) (*Client, error) {
 	state := &State{
 		Contacts:      make([]*Contact, 0),
 		Conversations: make(map[string]map[MessageID]*Message),
@@ -96,11 +280,14 @@ func NewClientAndRemoteSpool(logBackend *log.Backend, mixnetClient *client.Clien
 		Provider:      mixnetClient.Provider(),
 		LinkKey:       linkKey,
 	}
-	c, err := New(logBackend, mixnetClient, stateWorker, state)
+	c, err := New(logBackend, mixnetClient, stateWorker, state, opts...)
 	if err != nil {
 		return nil, err
 	}
 	c.save()
+	if c.deferRemoteSpool {
+		return c, nil
+	}
 	err = c.CreateRemoteSpool()
 	if err != nil {
 		return nil, err
@@ -111,11 +298,30 @@ func NewClientAndRemoteSpool(logBackend *log.Backend, mixnetClient *client.Clien
 
 // New creates a new Client instance given a mixnetClient, stateWorker and state.
 // This constructor is used to load the previously saved state of a Client.
-func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *StateWriter, state *State) (*Client, error) {
-	session, err := mixnetClient.NewSession(state.LinkKey)
-	if err != nil {
+//
+// The state is persisted by the given StateStore, usually a StateWriter.
+// If stateWorker is nil the Client runs in memory only mode: the statefile
+// is never written and all state is lost upon Shutdown.
+func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker StateStore, state *State, opts ...Option) (*Client, error) {
+	if w, ok := stateWorker.(*StateWriter); ok && w == nil {
+		stateWorker = nil
+	}
+	if err := validateState(state); err != nil {
 		return nil, err
 	}
+	conversations := state.Conversations
+	if conversations == nil {
+		// older or hand built statefiles may lack the conversations
+		conversations = make(map[string]map[MessageID]*Message)
+	}
+	transfers := state.FileTransfers
+	if transfers == nil {
+		transfers = make(map[TransferID]*fileTransfer)
+	}
+	incomingFiles := state.IncomingFiles
+	if incomingFiles == nil {
+		incomingFiles = make(map[TransferID]*incomingFile)
+	}
 	c := &Client{
 		eventCh:             channels.NewInfiniteChannel(),
 		EventSink:           make(chan interface{}),
@@ -123,38 +329,202 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 		reunionChan:         make(chan rClient.ReunionUpdate),
 		pandaChan:           make(chan panda.PandaUpdate),
 		fatalErrCh:          make(chan error),
+		shutdownCh:          make(chan struct{}),
 		sendMap:             new(sync.Map),
 		contacts:            make(map[uint64]*Contact),
 		contactNicknames:    make(map[string]*Contact),
 		spoolReadDescriptor: state.SpoolReadDescriptor,
 		linkKey:             state.LinkKey,
 		user:                state.User,
-		conversations:       state.Conversations,
+		offline:             state.Offline,
+		conversations:       conversations,
 		conversationsMutex:  new(sync.Mutex),
+		subscriptions:       make(map[*contactSubscription]struct{}),
+		subscriptionsMutex:  new(sync.Mutex),
+		eventHistoryMutex:   new(sync.Mutex),
+		inboxReads:          make(map[[cConstants.MessageIDLength]byte]struct{}),
+		maxInboxReads:       DefaultMaxInboxReads,
+		inboxReadInterleave: DefaultInboxReadInterleave,
 		stateWorker:         stateWorker,
 		client:              mixnetClient,
-		session:             session,
-		log:                 logBackend.GetLogger("catshadow"),
 		logBackend:          logBackend,
+		logModules:          make(map[string]struct{}),
+		logMutex:            new(sync.Mutex),
+		clock:               realClock{},
+		randReader:          rand.Reader,
+
+		deferredPANDAExchanges: make(map[uint64]time.Time),
+		pandaGracePeriod:       DefaultPANDAGracePeriod,
+		transfers:              transfers,
+		incomingFiles:          incomingFiles,
+		labels:                 make(map[string]map[uint64]*Contact),
+		inboxStallTimeout:      DefaultInboxStallTimeout,
+		inboundLimit:           DefaultInboundLimit,
+		inboundWindow:          DefaultInboundWindow,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.session == nil {
+		session, err := mixnetClient.NewSession(state.LinkKey)
+		if err != nil {
+			c.eventCh.Close()
+			return nil, err
+		}
+		c.session = session
+		c.mixnetSession = session
+		c.sessionEvents = session.EventSink
+	}
+	if c.eventBufferSize > 0 {
+		c.eventCh.Close()
+		c.eventCh = newBoundedChannel(c.eventBufferSize, c.eventBufferDropOldest)
+	}
+	if c.deliveryLog != nil {
+		if c.deliveryLogBuffer <= 0 {
+			c.deliveryLogBuffer = DefaultDeliveryLogBuffer
+		}
+		c.deliveryRecords = newBoundedChannel(c.deliveryLogBuffer, false)
+	}
+	c.log = c.getLogger("catshadow")
+	if err := c.loadContacts(state.Contacts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// validateState checks that the given State has the fields which the
+// Client relies upon, such that a malformed statefile fails to load with
+// a descriptive error rather than a panic deep in the session or ratchet.
+// Missing maps are tolerated, New replaces them with empty ones.
+func validateState(state *State) error {
+	if state == nil {
+		return errors.New("invalid state: state is nil")
+	}
+	if state.LinkKey == nil {
+		return errors.New("invalid state: link key is missing")
+	}
+	if state.User == "" {
+		return errors.New("invalid state: user is missing")
+	}
+	for i, contact := range state.Contacts {
+		if contact == nil {
+			return fmt.Errorf("invalid state: contact %d is nil", i)
+		}
+		if contact.outbound == nil {
+			return fmt.Errorf("invalid state: contact %s has no outbound queue", contact.Nickname)
+		}
+		if contact.IsPending {
+			if contact.keyExchange == nil && contact.pandaKeyExchange == nil {
+				return fmt.Errorf("invalid state: pending contact %s has no key exchange", contact.Nickname)
+			}
+			continue
+		}
+		// a contact without double ratchet is loaded as corrupt,
+		// such that it can be rekeyed or removed
+		if contact.spoolWriteDescriptor == nil {
+			return fmt.Errorf("invalid state: contact %s has no spool write descriptor", contact.Nickname)
+		}
+	}
+	for nickname, messages := range state.Conversations {
+		for mesgID, message := range messages {
+			if message == nil {
+				return fmt.Errorf("invalid state: message %x of the conversation with %s is nil", mesgID, nickname)
+			}
+		}
 	}
-	for _, contact := range state.Contacts {
+	return nil
+}
+
+// loadContacts adds the contacts of the statefile to the contacts map and
+// derives the nickname index from it. It fails if two contacts share an
+// ID. If two contacts share a nickname, the one with the higher ID is
+// renamed with a numeric suffix and a ContactRenamedEvent names both: the
+// conversation is keyed by nickname and stays with the first contact, as
+// the messages of the two can't be told apart. Contacts are checked in
+// the order of their IDs such that the repair is deterministic. Our own
+// user name is reserved for the notes to self, a contact of an older
+// statefile which has it is renamed likewise and the conversation stays
+// with the notes.
+func (c *Client) loadContacts(contacts []*Contact) error {
+	sorted := make([]*Contact, len(contacts))
+	copy(sorted, contacts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].id < sorted[j].id
+	})
+	for _, contact := range sorted {
+		if _, ok := c.contacts[contact.id]; ok {
+			return fmt.Errorf("statefile has two contacts with ID %d", contact.id)
+		}
 		contact.ratchetMutex = new(sync.Mutex)
 		c.contacts[contact.id] = contact
+	}
+	taken := map[string]bool{c.user: true}
+	for _, contact := range sorted {
+		taken[contact.Nickname] = true
+	}
+	for _, contact := range sorted {
+		if contact.Nickname == c.user {
+			renamed := uniqueNickname(contact.Nickname, taken)
+			taken[renamed] = true
+			c.log.Errorf("Contact %d has our user name %s, renaming it to %s", contact.id, contact.Nickname, renamed)
+			c.eventCh.In() <- &ContactRenamedEvent{
+				Nickname:  c.user,
+				Renamed:   renamed,
+				RenamedID: contact.id,
+			}
+			contact.Nickname = renamed
+		}
+		if other, ok := c.contactNicknames[contact.Nickname]; ok {
+			renamed := uniqueNickname(contact.Nickname, taken)
+			taken[renamed] = true
+			c.log.Errorf("Contacts %d and %d share the nickname %s, renaming contact %d to %s",
+				other.id, contact.id, contact.Nickname, contact.id, renamed)
+			c.eventCh.In() <- &ContactRenamedEvent{
+				Nickname:  other.Nickname,
+				ID:        other.id,
+				Renamed:   renamed,
+				RenamedID: contact.id,
+			}
+			contact.Nickname = renamed
+		}
 		c.contactNicknames[contact.Nickname] = contact
+		for _, label := range contact.Labels {
+			c.indexLabel(contact, label)
+		}
+	}
+	return nil
+}
+
+// uniqueNickname returns the nickname with the lowest numeric
+// suffix, starting at 2, which is not among the taken nicknames.
+func uniqueNickname(nickname string, taken map[string]bool) string {
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)", nickname, n)
+		if !taken[candidate] {
+			return candidate
+		}
 	}
-	return c, nil
 }
 
 // Start starts the client worker goroutine and the
 // read-inbox worker goroutine.
 func (c *Client) Start() {
 	c.garbageCollectConversations()
-	pandaCfg := c.session.GetPandaConfig()
+	summary := c.doSummary()
+	c.log.Infof("Loaded %d contacts, %d pending key exchanges, %d conversations with %d messages.",
+		summary.Contacts, summary.PendingContacts, summary.Conversations, summary.Messages)
 	reunionCfg := c.session.GetReunionConfig()
 
 	c.Go(c.eventSinkWorker)
+	if c.deliveryRecords != nil {
+		c.Go(c.deliveryLogWorker)
+	}
 	for _, contact := range c.contacts {
 		if contact.IsPending {
+			if c.readOnly {
+				// read-only clients leave key exchanges to the primary client
+				continue
+			}
 			if reunionCfg != nil && reunionCfg.Enable == true {
 				transports, err := c.getReunionTransports() // could put outside this loop
 				if err != nil {
@@ -169,7 +539,7 @@ func (c *Client) Start() {
 						if tr.Recipient == ex.recipient && tr.Provider == ex.provider {
 							m = true
 							lstr := fmt.Sprintf("reunion with %s at %s@%s", contact.Nickname, tr.Recipient, tr.Provider)
-							dblog := c.logBackend.GetLogger(lstr)
+							dblog := c.getLogger(lstr)
 							exchange, err := rClient.NewExchangeFromSnapshot(ex.serialized, dblog, tr, c.reunionChan)
 							if err != nil {
 								c.log.Warningf("Reunion failed: %v", err)
@@ -185,44 +555,83 @@ func (c *Client) Start() {
 						delete(contact.reunionKeyExchange, eid)
 					}
 				}
-			} else if pandaCfg != nil {
-				logPandaMeeting := c.logBackend.GetLogger(fmt.Sprintf("PANDA_meetingplace_%s", contact.Nickname))
-				meetingPlace := pclient.New(pandaCfg.BlobSize, c.session, logPandaMeeting, pandaCfg.Receiver, pandaCfg.Provider)
-				logPandaKx := c.logBackend.GetLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.Nickname))
-				kx, err := panda.UnmarshalKeyExchange(rand.Reader, logPandaKx, meetingPlace, contact.pandaKeyExchange, contact.ID(), c.pandaChan, contact.pandaShutdownChan)
-				if err != nil {
-					panic(err)
-				}
-				go kx.Run()
+			} else if contact.pandaKeyExchange != nil {
+				// a nil pandaKeyExchange is a failed exchange awaiting
+				// restart or a reserved contact awaiting its exchange
+				c.resumePANDAExchange(contact)
+			}
+		} else if contact.corrupt() {
+			c.log.Errorf("Contact %s has no double ratchet, it must be rekeyed or removed.", contact.Nickname)
+			c.eventCh.In() <- &ContactCorruptEvent{
+				Nickname: contact.Nickname,
 			}
 		} else {
+			c.eventCh.In() <- &ContactReadyEvent{
+				Nickname: contact.Nickname,
+			}
 			if _, err := contact.outbound.Peek(); err == nil {
 				// prod worker to start draining contact outbound queue
 				defer func() { c.opCh <- &opRetransmit{contact: contact} }()
 			}
 		}
 	}
-	c.Go(c.worker)
+	if c.workerRecovery {
+		c.Go(c.recoveringWorker)
+	} else {
+		c.Go(c.worker)
+	}
 	// Start the fatal error watcher.
 	go func() {
-		err, ok := <-c.fatalErrCh
-		if !ok {
+		for {
+			err, ok := <-c.fatalErrCh
+			if !ok {
+				return
+			}
+			if c.fatalErrorHandler != nil && !c.fatalErrorHandler(err) {
+				c.log.Warningf("Not shutting down on error: %v", err)
+				continue
+			}
+			c.log.Warningf("Shutting down due to error: %v", err)
+			c.shutdown(err)
 			return
 		}
-		c.log.Warningf("Shutting down due to error: %v", err)
-		c.Shutdown()
 	}()
 	// Shutdown if the client halts for some reason
 	go func() {
 		c.client.Wait()
-		c.Shutdown()
+		c.shutdown(ErrMixnetClientHalted)
 	}()
 
 }
 
+// getLogger returns a logger for the given module
+// which honors the level set by SetLogLevel.
+func (c *Client) getLogger(module string) *logging.Logger {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+	c.logModules[module] = struct{}{}
+	if c.logLevel != nil {
+		c.logBackend.SetLevel(*c.logLevel, module)
+	}
+	return c.logBackend.GetLogger(module)
+}
+
+// SetLogLevel changes the log level of the catshadow logger and the
+// key exchange loggers at runtime. Loggers created afterwards for new
+// key exchanges also use the given level.
+func (c *Client) SetLogLevel(level logging.Level) {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+	c.logLevel = &level
+	for module := range c.logModules {
+		c.logBackend.SetLevel(level, module)
+	}
+}
+
 func (c *Client) eventSinkWorker() {
 	defer func() {
 		c.log.Debug("Event sink worker terminating gracefully.")
+		c.closeSubscriptions()
 		close(c.EventSink)
 	}()
 	for {
@@ -232,754 +641,4233 @@ func (c *Client) eventSinkWorker() {
 			return
 		case event = <-c.eventCh.Out():
 		}
+		c.publishToSubscribers(event)
 		select {
 		case c.EventSink <- event:
+			// only the delivered events are replayed
+			c.recordEvent(event)
 		case <-c.HaltCh():
 			return
 		}
 	}
 }
 
-func (c *Client) garbageCollectConversations() {
-	c.conversationsMutex.Lock()
-	defer c.conversationsMutex.Unlock()
-	for _, messages := range c.conversations {
-		for mesgID, message := range messages {
-			if time.Now().After(message.Timestamp.Add(MessageExpirationDuration)) {
-				delete(messages, mesgID)
-			}
-		}
+type recordedEvent struct {
+	time  time.Time
+	event interface{}
+}
+
+// recordEvent adds the event to the history of recent events
+// if it is enabled by WithEventHistory.
+func (c *Client) recordEvent(event interface{}) {
+	if c.eventHistorySize <= 0 {
+		return
 	}
+	c.eventHistoryMutex.Lock()
+	defer c.eventHistoryMutex.Unlock()
+	if len(c.eventHistory) == c.eventHistorySize {
+		c.eventHistory[0] = recordedEvent{}
+		c.eventHistory = c.eventHistory[1:]
+	}
+	c.eventHistory = append(c.eventHistory, recordedEvent{
+		time:  c.clock.Now(),
+		event: event,
+	})
 }
 
-// CreateRemoteSpool creates a remote spool for collecting messages
-// destined to this Client. This method blocks until the reply from
-// the remote spool service is received or the round trip timeout is reached.
-func (c *Client) CreateRemoteSpool() error {
-	desc, err := c.session.GetService(common.SpoolServiceName)
-	if err != nil {
-		return err
+// ReplayEvents returns the recent events which were delivered to the
+// EventSink after the given time, oldest first, such that a consumer
+// attaching to a running Client can catch up. Only the events kept
+// according to WithEventHistory are returned, none without it.
+func (c *Client) ReplayEvents(since time.Time) []interface{} {
+	c.eventHistoryMutex.Lock()
+	defer c.eventHistoryMutex.Unlock()
+	if c.eventHistoryRetention > 0 {
+		horizon := c.clock.Now().Add(-c.eventHistoryRetention)
+		if horizon.After(since) {
+			since = horizon
+		}
 	}
-	if c.spoolReadDescriptor == nil {
-		// Be warned that the call to NewSpoolReadDescriptor blocks until the reply
-		// is received or the round trip timeout is reached.
-		c.spoolReadDescriptor, err = memspoolclient.NewSpoolReadDescriptor(desc.Name, desc.Provider, c.session)
-		if err != nil {
-			return err
+	events := []interface{}{}
+	for _, recorded := range c.eventHistory {
+		if recorded.time.After(since) {
+			events = append(events, recorded.event)
 		}
-		c.log.Debug("remote reader spool created successfully")
 	}
-	return nil
+	return events
 }
 
-// NewContact adds a new contact to the Client's state. This starts
-// the PANDA protocol instance for this contact where intermediate
-// states will be preserved in the encrypted statefile such that
-// progress on the PANDA key exchange can be continued at a later
-// time after program shutdown or restart.
-func (c *Client) NewContact(nickname string, sharedSecret []byte) {
-	c.opCh <- &opAddContact{
-		name:         nickname,
-		sharedSecret: sharedSecret,
+// DeliveryRecord records the delivery of an
+// outbound message to the remote spool of a contact.
+type DeliveryRecord struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// MessageID is the ID of the message.
+	MessageID MessageID
+	// SentAt is the time the message was first sent,
+	// or the time it was composed if that is unknown.
+	SentAt time.Time
+	// DeliveredAt is the time the delivery was acknowledged.
+	DeliveredAt time.Time
+}
+
+// logDelivery passes a DeliveryRecord to the delivery log
+// set by WithDeliveryLog without blocking the worker.
+func (c *Client) logDelivery(nickname string, mesgID MessageID, sentAt time.Time) {
+	if c.deliveryRecords == nil {
+		return
+	}
+	c.deliveryRecords.In() <- &DeliveryRecord{
+		Nickname:    nickname,
+		MessageID:   mesgID,
+		SentAt:      sentAt,
+		DeliveredAt: c.clock.Now(),
 	}
 }
 
-func (c *Client) randID() uint64 {
-	var idBytes [8]byte
+func (c *Client) deliveryLogWorker() {
 	for {
-		_, err := rand.Reader.Read(idBytes[:])
-		if err != nil {
-			panic(err)
-		}
-		n := binary.LittleEndian.Uint64(idBytes[:])
-		if n == 0 {
-			continue
-		}
-		if _, ok := c.contacts[n]; ok {
-			continue
+		select {
+		case <-c.HaltCh():
+			return
+		case record := <-c.deliveryRecords.Out():
+			c.deliveryLog(record.(*DeliveryRecord))
 		}
-		return n
 	}
-	// unreachable
 }
 
-// called by worker upon opAddContact
-func (c *Client) createContact(nickname string, sharedSecret []byte) error {
-	if _, ok := c.contactNicknames[nickname]; ok {
-		return fmt.Errorf("Contact with nickname %s, already exists.", nickname)
+// DroppedDeliveryRecords returns the number of DeliveryRecords which were
+// dropped because the buffer set by WithDeliveryLog was full.
+func (c *Client) DroppedDeliveryRecords() uint64 {
+	if c.deliveryRecords == nil {
+		return 0
 	}
-	contact, err := NewContact(nickname, c.randID(), c.spoolReadDescriptor, c.session)
-	if err != nil {
-		return err
+	return c.deliveryRecords.Dropped()
+}
+
+// DroppedEvents returns the number of events which were dropped because
+// the buffer set by WithEventBuffer was full.
+func (c *Client) DroppedEvents() uint64 {
+	if ch, ok := c.eventCh.(*boundedChannel); ok {
+		return ch.Dropped()
 	}
-	c.contacts[contact.ID()] = contact
-	c.contactNicknames[contact.Nickname] = contact
+	return 0
+}
 
-	// Use PANDA or Reunion
-	pandaCfg := c.session.GetPandaConfig()
-	reunionCfg := c.session.GetReunionConfig()
+type contactSubscription struct {
+	nickname string
+	// all is true if the subscription receives
+	// the events concerning any contact.
+	all bool
+	ch  *channels.InfiniteChannel
+}
 
-	switch {
-	case reunionCfg != nil && pandaCfg != nil:
-		// both reunion and panda have a configuration entry, and reunion is enabled
-		if reunionCfg.Enable == true {
-			return errors.New("One of Reunion OR Panda must be configured, not both")
-		}
-		fallthrough
-	case pandaCfg != nil:
-		err = c.doPANDAExchange(contact, sharedSecret)
-		if err != nil {
-			c.log.Notice("PANDA Failure for %v: %v", contact, err)
-			return err
-		}
-	case reunionCfg != nil:
-		contact.reunionKeyExchange = make(map[uint64]boundExchange)
-		contact.reunionResult = make(map[uint64]string)
-		err = c.doReunion(contact, sharedSecret)
-		if err != nil {
-			c.log.Notice("Reunion Failure for %v: %v", contact, err)
-			return err
+// SubscribeContact returns a stream of the events concerning the contact
+// with the given nickname, see EventNickname, and a function which ends
+// the subscription. The events are delivered to the EventSink as well,
+// they are buffered until read from the returned channel.
+func (c *Client) SubscribeContact(nickname string) (<-chan interface{}, func()) {
+	sub := &contactSubscription{
+		nickname: nickname,
+		ch:       channels.NewInfiniteChannel(),
+	}
+	c.subscriptionsMutex.Lock()
+	c.subscriptions[sub] = struct{}{}
+	c.subscriptionsMutex.Unlock()
+	unsubscribe := func() {
+		c.subscriptionsMutex.Lock()
+		defer c.subscriptionsMutex.Unlock()
+		if _, ok := c.subscriptions[sub]; ok {
+			delete(c.subscriptions, sub)
+			sub.ch.Close()
 		}
 	}
-	return err
+	return sub.ch.Out(), unsubscribe
 }
 
-func (c *Client) doPANDAExchange(contact *Contact, sharedSecret []byte) error {
-	// Use PANDA
-	pandaCfg := c.session.GetPandaConfig()
-	logPandaClient := c.logBackend.GetLogger(fmt.Sprintf("PANDA_meetingplace_%s", contact.Nickname))
-	meetingPlace := pclient.New(pandaCfg.BlobSize, c.session, logPandaClient, pandaCfg.Receiver, pandaCfg.Provider)
-	kxLog := c.logBackend.GetLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.Nickname))
-	kx, err := panda.NewKeyExchange(rand.Reader, kxLog, meetingPlace, sharedSecret, contact.keyExchange, contact.id, c.pandaChan, contact.pandaShutdownChan)
-	if err != nil {
-		return err
+func (c *Client) publishToSubscribers(event interface{}) {
+	nickname, ok := EventNickname(event)
+	if !ok {
+		return
+	}
+	c.subscriptionsMutex.Lock()
+	defer c.subscriptionsMutex.Unlock()
+	for sub := range c.subscriptions {
+		if sub.all || sub.nickname == nickname {
+			sub.ch.In() <- event
+		}
 	}
-	contact.pandaKeyExchange = kx.Marshal()
-	contact.keyExchange = nil
-	go kx.Run()
-	c.save()
-
-	c.log.Info("New PANDA key exchange in progress.")
-	return nil
 }
 
-func (c *Client) getReunionTransports() ([]*rTrans.Transport, error) {
-	// Get consensus
-	doc := c.session.CurrentDocument()
-	if doc == nil {
-		return nil, errors.New("No current document, wtf")
+func (c *Client) closeSubscriptions() {
+	c.subscriptionsMutex.Lock()
+	defer c.subscriptionsMutex.Unlock()
+	for sub := range c.subscriptions {
+		delete(c.subscriptions, sub)
+		sub.ch.Close()
 	}
-	transports := make([]*rTrans.Transport, 0)
+}
 
-	// Get reunion endpoints and epoch values
-	for _, p := range doc.Providers {
-		if r, ok := p.Kaetzchen["reunion"]; ok {
-			if ep, ok := r["endpoint"]; ok {
-				ep := ep.(string)
-				trans := &rTrans.Transport{Session: c.session, Recipient: ep, Provider: p.Name}
-				c.log.Debugf("Adding transport %v", trans)
-				transports = append(transports, trans)
-			} else {
-				return nil, errors.New("Provider kaetzchen descriptor missing endpoint")
+func (c *Client) garbageCollectConversations() {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	for _, messages := range c.conversations {
+		for mesgID, message := range messages {
+			if c.clock.Now().After(message.Timestamp.Add(MessageExpirationDuration)) {
+				delete(messages, mesgID)
 			}
 		}
+		if c.maxMessagesPerConversation > 0 {
+			c.evictMessages(messages)
+		}
 	}
-	if len(transports) > 0 {
-		return transports, nil
+	c.garbageCollectIncomingFiles()
+	for _, contact := range c.contacts {
+		for hash, received := range contact.seenMessages {
+			if c.clock.Now().After(received.Add(MessageExpirationDuration)) {
+				delete(contact.seenMessages, hash)
+			}
+		}
 	}
-	return nil, errors.New("Found no reunion transports")
 }
 
-func (c *Client) doReunion(contact *Contact, sharedSecret []byte) error {
-	c.log.Info("DoReunion called")
-	rtransports, err := c.getReunionTransports()
-	if err != nil {
-		return err
+// evictMessages removes the oldest messages of the conversation exceeding
+// the maximum conversation size, except for undelivered outbound messages.
+// It must be called with conversationsMutex held.
+func (c *Client) evictMessages(messages map[MessageID]*Message) {
+	excess := len(messages) - c.maxMessagesPerConversation
+	if excess <= 0 {
+		return
 	}
-	for _, tr := range rtransports {
-		epochs, err := tr.CurrentEpochs()
-		if err != nil {
-			return err
+	ids := make([]MessageID, 0, len(messages))
+	for mesgID := range messages {
+		ids = append(ids, mesgID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return messages[ids[i]].Timestamp.Before(messages[ids[j]].Timestamp)
+	})
+	for _, mesgID := range ids {
+		if excess == 0 {
+			break
 		}
-		srvs, err := tr.CurrentSharedRandoms()
-		if err != nil {
-			return err
-		}
-		// what should we do to reduce the number of exchanges initiated?
-		// if this is the first reunion, choose the latest published epoch and srv ?
-		// (after some time, try other epochs and srvs?)
-		for _, srv := range srvs[0:1] {
-			for _, epoch := range epochs {
-				lstr := fmt.Sprintf("reunion with %s at %s@%s:%d", contact.Nickname, tr.Recipient, tr.Provider, epoch)
-				dblog := c.logBackend.GetLogger(lstr)
-				ex, err := rClient.NewExchange(contact.keyExchange, dblog, tr, contact.ID(), sharedSecret, srv, epoch, c.reunionChan)
-				if err != nil {
-					return err
-				}
-				// create a mapping from exchange ID to transport and serialized updates
-				contact.reunionKeyExchange[ex.ExchangeID] = boundExchange{recipient: tr.Recipient, provider: tr.Provider}
-				go ex.Run()
-				c.log.Info("New reunion exchange %v in progress.", ex.ExchangeID)
-			}
+		message := messages[mesgID]
+		if message.Outbound && !message.Delivered {
+			continue
 		}
+		message.wipe()
+		delete(messages, mesgID)
+		excess--
 	}
-	return nil
 }
 
-// XXX do we even need this method?
-func (c *Client) GetContacts() map[string]*Contact {
-	getContactsOp := opGetContacts{
-		responseChan: make(chan map[string]*Contact),
+// PruneBefore removes the messages of all conversations whose timestamp is
+// before the given time and returns the number of removed messages.
+// Undelivered outbound messages are only removed if undelivered is true.
+func (c *Client) PruneBefore(before time.Time, undelivered bool) int {
+	op := &opPruneBefore{
+		before:       before,
+		undelivered:  undelivered,
+		responseChan: make(chan int),
 	}
-	c.opCh <- &getContactsOp
-	return <-getContactsOp.responseChan
+	c.opCh <- op
+	return <-op.responseChan
 }
 
-// RemoveContact removes a contact from the Client's state.
-func (c *Client) RemoveContact(nickname string) {
-	c.opCh <- &opRemoveContact{
-		name: nickname,
+func (c *Client) doPruneBefore(before time.Time, undelivered bool) int {
+	pruned := 0
+	c.conversationsMutex.Lock()
+	for _, messages := range c.conversations {
+		for mesgID, message := range messages {
+			if !message.Timestamp.Before(before) {
+				continue
+			}
+			if message.Outbound && !message.Delivered && !undelivered {
+				continue
+			}
+			message.wipe()
+			delete(messages, mesgID)
+			pruned++
+		}
 	}
+	c.conversationsMutex.Unlock()
+	if pruned > 0 {
+		c.save()
+	}
+	return pruned
 }
 
-func (c *Client) doContactRemoval(nickname string) {
+// SetDisappearingTimer sets the duration after which the messages of the
+// conversation with the given contact are deleted once they are delivered
+// or received, zero disables it. The timer only applies to messages which
+// are delivered or received after the change. The timer is sent to the
+// contact such that it applies it to its messages as well, this fails for
+// contacts predating disappearing messages.
+func (c *Client) SetDisappearingTimer(nickname string, ttl time.Duration) error {
+	op := &opSetDisappearingTimer{
+		name:         nickname,
+		ttl:          ttl,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doSetDisappearingTimer(nickname string, ttl time.Duration) error {
 	contact, ok := c.contactNicknames[nickname]
 	if !ok {
-		c.log.Errorf("contact removal failed, %s not found in contacts", nickname)
-		return
+		return ErrContactNotFound
+	}
+	if ttl < 0 {
+		return errors.New("negative disappearing message timer")
 	}
 	if contact.IsPending {
-		if contact.pandaShutdownChan != nil {
-			close(contact.pandaShutdownChan)
-		}
+		return fmt.Errorf("key exchange with %s is pending", nickname)
 	}
-	delete(c.contactNicknames, nickname)
-	delete(c.contacts, contact.id)
+	controlID, err := c.newMessageID()
+	if err != nil {
+		return err
+	}
+	f := &frame{
+		SetTimer:  true,
+		Timer:     ttl,
+		Timestamp: c.clock.Now(),
+	}
+	if err := c.enqueueFrame(contact, controlID, f, 0); err != nil {
+		return err
+	}
+	c.setDisappearingTimer(contact, ttl, false)
+	return nil
+}
+
+// setDisappearingTimer sets the disappearing message timer of the
+// given contact, remote is true if the contact set it.
+func (c *Client) setDisappearingTimer(contact *Contact, ttl time.Duration, remote bool) {
+	contact.disappearingTimer = ttl
 	c.save()
+	c.eventCh.In() <- &DisappearingTimerChangedEvent{
+		Nickname: contact.Nickname,
+		Timer:    ttl,
+		Remote:   remote,
+	}
 }
 
-func (c *Client) save() {
-	c.log.Debug("Saving statefile.")
-	serialized, err := c.marshal()
-	if err != nil {
-		panic(err)
+// expireMessages deletes the disappearing messages whose time has come.
+func (c *Client) expireMessages() {
+	now := c.clock.Now()
+	expired := 0
+	c.conversationsMutex.Lock()
+	for _, messages := range c.conversations {
+		for mesgID, message := range messages {
+			if !message.Expires.IsZero() && now.After(message.Expires) {
+				message.wipe()
+				delete(messages, mesgID)
+				expired++
+			}
+		}
 	}
-	err = c.stateWorker.writeState(serialized)
-	if err != nil {
-		panic(err)
+	c.conversationsMutex.Unlock()
+	if expired > 0 {
+		c.save()
 	}
 }
 
-func (c *Client) marshal() ([]byte, error) {
-	contacts := []*Contact{}
-	for _, contact := range c.contacts {
-		contacts = append(contacts, contact)
+// checkDeliveryTimeouts marks outbound messages which have not been
+// delivered within the delivery timeout as failed.
+func (c *Client) checkDeliveryTimeouts() {
+	if c.deliveryTimeout == 0 {
+		return
 	}
-	s := &State{
-		SpoolReadDescriptor: c.spoolReadDescriptor,
-		Contacts:            contacts,
-		LinkKey:             c.linkKey,
-		User:                c.user,
-		Provider:            c.client.Provider(),
-		Conversations:       c.GetAllConversations(),
+	timedOut := false
+	c.conversationsMutex.Lock()
+	for nickname, messages := range c.conversations {
+		for mesgID, message := range messages {
+			// messages which were never sent, e.g. queued while offline,
+			// can't time out, nor can those loaded from statefiles which
+			// predate the Sent flag
+			if !message.Outbound || !message.Sent || message.Queued || message.Delivered || message.Failed {
+				continue
+			}
+			sentAt := message.SentAt
+			if sentAt.IsZero() {
+				sentAt = message.Timestamp
+			}
+			if c.clock.Now().After(sentAt.Add(c.deliveryTimeout)) {
+				message.Failed = true
+				timedOut = true
+				c.log.Debugf("delivery of message %x to %s timed out", mesgID, nickname)
+				c.eventCh.In() <- &MessageDeliveryTimeoutEvent{
+					Nickname:  nickname,
+					MessageID: mesgID,
+				}
+			}
+		}
 	}
+	c.conversationsMutex.Unlock()
+	if timedOut {
+		c.save()
+	}
+}
+
+// updateMessage calls fn with the message of the given conversation while
+// holding the conversations mutex. It returns false if there is no such message.
+func (c *Client) updateMessage(nickname string, id MessageID, fn func(*Message)) bool {
 	c.conversationsMutex.Lock()
 	defer c.conversationsMutex.Unlock()
-	return cbor.Marshal(s)
+	message, ok := c.conversations[nickname][id]
+	if !ok {
+		return false
+	}
+	fn(message)
+	return true
 }
 
-func (c *Client) stopContactTimers() {
-	for _, contact := range c.contacts {
-		if contact.rtx != nil {
-			contact.rtx.Stop()
+// CreateRemoteSpool creates a remote spool for collecting messages
+// destined to this Client. This method blocks until the reply from
+// the remote spool service is received or the round trip timeout is reached.
+func (c *Client) CreateRemoteSpool() error {
+	if c.spoolReadDescriptor == nil {
+		desc, err := c.newRemoteSpool()
+		if err != nil {
+			return err
 		}
+		c.spoolReadDescriptor = desc
+		c.log.Debug("remote reader spool created successfully")
 	}
+	return nil
 }
 
-func (c *Client) haltKeyExchanges() {
-	for _, contact := range c.contacts {
-		if contact.IsPending {
-			c.log.Debugf("Halting pending key exchange for '%s' contact.", contact.Nickname)
-			if contact.pandaShutdownChan != nil {
-				close(contact.pandaShutdownChan)
-			}
+// EnsureRemoteSpool creates our remote spool unless it already exists,
+// as is the case for Clients constructed with WithDeferredRemoteSpool.
+// It must be called after Start and blocks until the reply from the remote
+// spool service is received or the round trip timeout is reached, emitting
+// a RemoteSpoolCreatingEvent before and a RemoteSpoolCreatedEvent after
+// the attempt. A failed attempt may be retried by calling it again.
+func (c *Client) EnsureRemoteSpool() error {
+	if c.ReadSpoolDescriptor() != nil {
+		return nil
+	}
+	c.eventCh.In() <- &RemoteSpoolCreatingEvent{}
+	desc, err := c.newRemoteSpool()
+	if err == nil {
+		op := &opSetReadSpoolDescriptor{
+			descriptor:   desc,
+			responseChan: make(chan error),
 		}
+		c.opCh <- op
+		err = <-op.responseChan
+	}
+	c.eventCh.In() <- &RemoteSpoolCreatedEvent{
+		Err: err,
 	}
+	return err
 }
 
-// Shutdown shuts down the client.
-func (c *Client) Shutdown() {
-	c.log.Info("Shutting down now.")
+// newRemoteSpool creates a remote spool with the spool service.
+func (c *Client) newRemoteSpool() (*memspoolclient.SpoolReadDescriptor, error) {
+	desc, err := c.session.GetService(common.SpoolServiceName)
+	for attempt := 1; err != nil && attempt < GetServiceAttempts; attempt++ {
+		// the PKI document may lack the service temporarily
+		c.log.Warningf("Spool service not found, retrying: %s", err)
+		time.Sleep(GetServiceRetryInterval)
+		desc, err = c.session.GetService(common.SpoolServiceName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Be warned that the call to NewSpoolReadDescriptor blocks until the reply
+	// is received or the round trip timeout is reached.
+	if c.mixnetSession == nil {
+		return nil, errors.New("creating a remote spool requires a mixnet session")
+	}
+	return memspoolclient.NewSpoolReadDescriptor(desc.Name, desc.Provider, c.mixnetSession)
+}
+
+// called by worker upon opSetReadSpoolDescriptor
+func (c *Client) doSetReadSpoolDescriptor(desc *memspoolclient.SpoolReadDescriptor) error {
+	if c.spoolReadDescriptor != nil {
+		// a concurrent EnsureRemoteSpool won the race
+		return nil
+	}
+	c.spoolReadDescriptor = desc
+	c.log.Debug("remote reader spool created successfully")
 	c.save()
-	c.Halt()
-	c.client.Shutdown()
-	c.stateWorker.Halt()
+	return nil
 }
 
-func (c *Client) processReunionUpdate(update *rClient.ReunionUpdate) {
-	c.log.Debug("got a reunion update for exchange %v", update.ExchangeID)
-	contact, ok := c.contacts[update.ContactID]
-	if !ok {
-		c.log.Error("failure to perform Reunion update: invalid contact ID")
-		return
+// RecreateRemoteSpool creates a new remote spool and replaces ours by it
+// even if ours exists, e.g. when its provider lost it or its descriptor
+// is corrupt. It must be called after Start and blocks until the reply
+// from the remote spool service is received, the round trip timeout is
+// reached or ctx is done, the new spool is abandoned in the latter case.
+// Be warned that this is a last resort: the messages of the previous
+// spool which were not read yet are lost. The new spool is announced to
+// the contacts whose client applies spool updates, the other contacts
+// keep appending their messages to the previous spool until the key
+// exchange with them is redone and a ContactRekeyNeededEvent is emitted
+// for each of them. A RemoteSpoolRecreatedEvent is emitted once the
+// spool is replaced.
+func (c *Client) RecreateRemoteSpool(ctx context.Context) error {
+	type result struct {
+		desc *memspoolclient.SpoolReadDescriptor
+		err  error
 	}
-	if !contact.IsPending {
-		// we performed multiple exchanges, but this one has probably arrived too late
-		c.log.Debugf("received reunion update for exchange %v after pairing occurred", update.ExchangeID)
-		// remove the map entries
-		if _, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
-			delete(contact.reunionKeyExchange, update.ExchangeID)
-		}
-		if _, ok := contact.reunionResult[update.ExchangeID]; ok {
-			delete(contact.reunionResult, update.ExchangeID)
-		}
-		return
+	resultCh := make(chan result, 1)
+	go func() {
+		desc, err := c.newRemoteSpool()
+		resultCh <- result{desc, err}
+	}()
+	var r result
+	select {
+	case r = <-resultCh:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	switch {
-	case update.Error != nil:
-		contact.reunionResult[update.ExchangeID] = update.Error.Error()
-		c.log.Infof("Reunion key exchange %v with %s failed: %s", update.ExchangeID, contact.Nickname, update.Error)
-		if _, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
-			delete(contact.reunionKeyExchange, update.ExchangeID) // remove map entry
-		}
-		c.eventCh.In() <- &KeyExchangeCompletedEvent{
-			Nickname: contact.Nickname,
-			Err:      update.Error,
-		}
-		return
+	if r.err != nil {
+		return r.err
+	}
+	op := &opReplaceReadSpoolDescriptor{
+		descriptor:   r.desc,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
 
-	case update.Serialized != nil:
-		if ex, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
-			ex.serialized = update.Serialized
-			c.log.Infof("Reunion key exchange %v with %s update received", update.ExchangeID, contact.Nickname)
-		} else {
-			c.log.Infof("Reunion key exchange %v with %s update received after another valid exchange", update.ExchangeID, contact.Nickname)
-		}
-	case update.Result != nil:
-		c.log.Debugf("Reunion exchange %v completed", update.ExchangeID)
-		exchange, err := parseContactExchangeBytes(update.Result)
-		if _, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
-			delete(contact.reunionKeyExchange, update.ExchangeID) // remove map entry
-		}
-		if err != nil {
-			err = fmt.Errorf("Reunion failure to parse contact exchange %v bytes: %s", update.ExchangeID, err)
-			c.log.Error(err.Error())
-			contact.reunionResult[update.ExchangeID] = err.Error()
-			c.save()
-			c.eventCh.In() <- &KeyExchangeCompletedEvent{
-				Nickname: contact.Nickname,
-				Err:      err,
+// called by worker upon opReplaceReadSpoolDescriptor
+func (c *Client) doReplaceReadSpoolDescriptor(desc *memspoolclient.SpoolReadDescriptor) error {
+	if desc == nil {
+		return ErrNoRemoteSpool
+	}
+	if previous := c.spoolReadDescriptor; previous != nil {
+		c.log.Warningf("Replacing our remote spool %x, its unread messages are lost", previous.ID)
+	}
+	// the replies to the reads of the previous spool are ignored
+	for mesgID := range c.inboxReads {
+		c.deleteSent(mesgID)
+		delete(c.inboxReads, mesgID)
+	}
+	desc.ReadOffset = 0
+	c.spoolReadDescriptor = desc
+	c.inboxDrained = false
+	c.announceSpool()
+	c.save()
+	c.eventCh.In() <- &RemoteSpoolRecreatedEvent{
+		Provider: desc.Provider,
+	}
+	return nil
+}
+
+// announceSpool queues a spool update announcing our remote spool to the
+// established contacts which apply it. The other contacts keep writing
+// to our previous spool, a ContactRekeyNeededEvent is emitted for each
+// of them.
+func (c *Client) announceSpool() {
+	update, err := cbor.Marshal(c.spoolReadDescriptor.GetWriteDescriptor())
+	if err != nil {
+		panic(err)
+	}
+	for _, contact := range c.contacts {
+		if !contact.IsPending && contact.spoolUpdate {
+			updateID, err := c.newMessageID()
+			if err == nil {
+				err = c.enqueueFrame(contact, updateID, &frame{SpoolUpdate: true, Message: update}, 0)
 			}
-			return
-		}
-		contact.spoolWriteDescriptor = exchange.SpoolWriteDescriptor
-		contact.ratchetMutex.Lock()
-		err = contact.ratchet.ProcessKeyExchange(exchange.SignedKeyExchange)
-		contact.ratchetMutex.Unlock()
-		if err != nil {
-			err = fmt.Errorf("Reunion double ratchet key exchange %v failure: %s", update.ExchangeID, err)
-			c.log.Error(err.Error())
-			contact.reunionResult[update.ExchangeID] = err.Error()
-			c.save()
-			c.eventCh.In() <- &KeyExchangeCompletedEvent{
-				Nickname: contact.Nickname,
-				Err:      err,
+			if err == nil {
+				c.log.Debugf("Announcing our remote spool to %s", contact.Nickname)
+				continue
 			}
-			return
+			c.log.Errorf("failed to announce our remote spool to %s: %s", contact.Nickname, err)
 		}
-		// XXX: should purge the reunionResults now...
-		contact.keyExchange = nil
-		contact.IsPending = false
-		c.log.Info("Reunion double ratchet key exchange completed by exchange %v!", update.ExchangeID)
-		c.eventCh.In() <- &KeyExchangeCompletedEvent{
+		c.eventCh.In() <- &ContactRekeyNeededEvent{
 			Nickname: contact.Nickname,
 		}
 	}
-	c.save()
 }
 
-func (c *Client) processPANDAUpdate(update *panda.PandaUpdate) {
-	contact, ok := c.contacts[update.ID]
-	if !ok {
-		c.log.Error("failure to perform PANDA update: invalid contact ID")
-		return
+// NewContact adds a new contact to the Client's state. This starts
+// the PANDA protocol instance for this contact where intermediate
+// states will be preserved in the encrypted statefile such that
+// progress on the PANDA key exchange can be continued at a later
+// time after program shutdown or restart.
+func (c *Client) NewContact(nickname string, sharedSecret []byte, opts ...ContactOption) {
+	c.opCh <- &opAddContact{
+		name:         nickname,
+		sharedSecret: sharedSecret,
+		options:      opts,
 	}
+}
 
-	switch {
-	case update.Err != nil:
-		// restart the handshake with the current state if the error is due to SURB-ACK timeout
-		if update.Err == client.ErrReplyTimeout {
-			pandaCfg := c.session.GetPandaConfig()
-			if pandaCfg == nil {
-				panic("panda failed, must have a panda service configured")
-			}
+// AddContactSync adds a new contact like NewContact and blocks until
+// the key exchange with the contact has completed, returning the error
+// of the exchange if it failed. If ctx is done first, the pending
+// contact is removed, which cancels the key exchange.
+func (c *Client) AddContactSync(ctx context.Context, nickname string, sharedSecret []byte, opts ...ContactOption) error {
+	// subscribe before adding the contact, such
+	// that the completion of its exchange is not missed
+	events, unsubscribe := c.SubscribeContact(nickname)
+	defer unsubscribe()
 
-			c.log.Error("PANDA handshake for client %s timed-out; restarting exchange", contact.Nickname)
-			logPandaMeeting := c.logBackend.GetLogger(fmt.Sprintf("PANDA_meetingplace_%s", contact.Nickname))
-			meetingPlace := pclient.New(pandaCfg.BlobSize, c.session, logPandaMeeting, pandaCfg.Receiver, pandaCfg.Provider)
-			logPandaKx := c.logBackend.GetLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.Nickname))
-			kx, err := panda.UnmarshalKeyExchange(rand.Reader, logPandaKx, meetingPlace, contact.pandaKeyExchange, contact.ID(), c.pandaChan, contact.pandaShutdownChan)
-			if err != nil {
-				panic(err)
+	op := &opAddContact{
+		name:         nickname,
+		sharedSecret: sharedSecret,
+		options:      opts,
+		responseChan: make(chan error, 1),
+	}
+	c.opCh <- op
+	if err := <-op.responseChan; err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			c.opCh <- &opCancelPendingContact{
+				name: nickname,
+			}
+			return ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				return errors.New("client is shutting down")
+			}
+			switch event := e.(type) {
+			case *KeyExchangeCompletedEvent:
+				return event.Err
+			case *ContactRemovedEvent:
+				return fmt.Errorf("contact %s was removed", nickname)
 			}
-			go kx.Run()
-		}
-		contact.pandaResult = update.Err.Error()
-		contact.pandaShutdownChan = nil
-		c.log.Infof("Key exchange with %s failed: %s", contact.Nickname, update.Err)
-		c.eventCh.In() <- &KeyExchangeCompletedEvent{
-			Nickname: contact.Nickname,
-			Err:      update.Err,
 		}
-	case update.Serialised != nil:
-		if bytes.Equal(contact.pandaKeyExchange, update.Serialised) {
-			c.log.Infof("Strange, our PANDA key exchange echoed our exchange bytes: %s", contact.Nickname)
+	}
+}
+
+// called by worker upon opCancelPendingContact
+func (c *Client) doCancelPendingContact(nickname string) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok || !contact.IsPending {
+		// the exchange completed meanwhile
+		return
+	}
+	c.doContactRemoval(nickname)
+}
+
+func (c *Client) randID() (uint64, error) {
+	var idBytes [8]byte
+	for {
+		if _, err := io.ReadFull(c.randReader, idBytes[:]); err != nil {
+			return 0, err
+		}
+		n := binary.LittleEndian.Uint64(idBytes[:])
+		if n == 0 {
+			continue
+		}
+		if _, ok := c.contacts[n]; ok {
+			continue
+		}
+		return n, nil
+	}
+	// unreachable
+}
+
+// newMessageID returns a random MessageID.
+func (c *Client) newMessageID() (MessageID, error) {
+	mesgID := MessageID{}
+	_, err := io.ReadFull(c.randReader, mesgID[:])
+	return mesgID, err
+}
+
+// called by worker upon opAddContact
+func (c *Client) createContact(nickname string, sharedSecret []byte, opts ...ContactOption) error {
+	contact, err := c.addContactEntry(nickname, opts...)
+	if err != nil {
+		return err
+	}
+	if err := c.startKeyExchange(contact, sharedSecret); err != nil {
+		return err
+	}
+	c.eventCh.In() <- &ContactCreatedEvent{
+		Nickname:  contact.Nickname,
+		IsPending: contact.IsPending,
+	}
+	return nil
+}
+
+// addContactEntry creates a pending contact with the given nickname
+// and adds it to the contacts without starting the key exchange.
+func (c *Client) addContactEntry(nickname string, opts ...ContactOption) (*Contact, error) {
+	if _, ok := c.contactNicknames[nickname]; ok {
+		return nil, fmt.Errorf("Contact with nickname %s, already exists.", nickname)
+	}
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if nickname == c.user {
+		// our own nickname is reserved for the notes to self and
+		// identifies the reads of our remote spool in the sendMap
+		return nil, fmt.Errorf("Contact nickname %s is reserved.", nickname)
+	}
+	if c.spoolReadDescriptor == nil {
+		return nil, ErrNoRemoteSpool
+	}
+	id, err := c.randID()
+	if err != nil {
+		return nil, err
+	}
+	contact, err := NewContact(nickname, id, c.spoolReadDescriptor, c.mixnetSession)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(contact)
+	}
+	c.contacts[contact.ID()] = contact
+	c.contactNicknames[contact.Nickname] = contact
+	return contact, nil
+}
+
+// startKeyExchange starts the PANDA or Reunion key exchange
+// with the given pending contact using the shared secret.
+func (c *Client) startKeyExchange(contact *Contact, sharedSecret []byte) error {
+	// Use PANDA or Reunion
+	pandaCfg := c.getPandaConfig(contact)
+	reunionCfg := c.session.GetReunionConfig()
+
+	switch {
+	case reunionCfg != nil && pandaCfg != nil:
+		// both reunion and panda have a configuration entry, and reunion is enabled
+		if reunionCfg.Enable == true {
+			return errors.New("One of Reunion OR Panda must be configured, not both")
+		}
+		fallthrough
+	case pandaCfg != nil:
+		err := c.doPANDAExchange(contact, sharedSecret)
+		if err != nil {
+			c.log.Notice("PANDA Failure for %v: %v", contact, err)
+			return err
+		}
+	case reunionCfg != nil:
+		contact.reunionKeyExchange = make(map[uint64]boundExchange)
+		contact.reunionResult = make(map[uint64]string)
+		err := c.doReunion(contact, sharedSecret)
+		if err != nil {
+			c.log.Notice("Reunion Failure for %v: %v", contact, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ReserveContact creates a pending contact with the given nickname
+// without starting the key exchange, which is started by
+// BeginKeyExchange once the shared secret is known. The nickname
+// can't be used by other contacts meanwhile.
+func (c *Client) ReserveContact(nickname string, opts ...ContactOption) error {
+	op := &opReserveContact{
+		name:         nickname,
+		options:      opts,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doReserveContact(nickname string, opts ...ContactOption) error {
+	contact, err := c.addContactEntry(nickname, opts...)
+	if err != nil {
+		return err
+	}
+	contact.reserved = true
+	c.save()
+	c.eventCh.In() <- &ContactCreatedEvent{
+		Nickname:  contact.Nickname,
+		IsPending: contact.IsPending,
+	}
+	return nil
+}
+
+// BeginKeyExchange starts the key exchange with the contact
+// reserved by ReserveContact using the given shared secret.
+func (c *Client) BeginKeyExchange(nickname string, sharedSecret []byte) error {
+	op := &opBeginKeyExchange{
+		name:         nickname,
+		sharedSecret: sharedSecret,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doBeginKeyExchange(nickname string, sharedSecret []byte) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if !contact.reserved {
+		return fmt.Errorf("key exchange with %s was already begun", nickname)
+	}
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if err := c.startKeyExchange(contact, sharedSecret); err != nil {
+		return err
+	}
+	contact.reserved = false
+	c.save()
+	return nil
+}
+
+// getPandaConfig returns the PANDA configuration of the given contact,
+// falling back to the configuration of the session.
+func (c *Client) getPandaConfig(contact *Contact) *config.Panda {
+	if contact.pandaConfig != nil {
+		return contact.pandaConfig
+	}
+	return c.session.GetPandaConfig()
+}
+
+// PandaConfigInfo returns the PANDA meeting place configured for the
+// session, which is used by the key exchanges of contacts added without
+// a PANDA configuration of their own, e.g. to confirm that two peers use
+// the same meeting place before pairing. The returned bool is false if
+// the session has no PANDA configuration.
+func (c *Client) PandaConfigInfo() (provider, receiver string, blobSize int, ok bool) {
+	pandaCfg := c.session.GetPandaConfig()
+	if pandaCfg == nil {
+		return "", "", 0, false
+	}
+	return pandaCfg.Provider, pandaCfg.Receiver, pandaCfg.BlobSize, true
+}
+
+// newMeetingPlace returns a PANDA meeting place client for the given contact.
+func (c *Client) newMeetingPlace(contact *Contact, pandaCfg *config.Panda) *pclient.Panda {
+	logPandaMeeting := c.getLogger(fmt.Sprintf("PANDA_meetingplace_%s", contact.Nickname))
+	return pclient.New(pandaCfg.BlobSize, c.mixnetSession, logPandaMeeting, pandaCfg.Receiver, pandaCfg.Provider)
+}
+
+// resumePANDAExchange runs the PANDA key exchange of the given contact from
+// its saved state. If no PANDA service is configured the exchange is
+// deferred until retryDeferredPANDAExchanges finds a configuration.
+func (c *Client) resumePANDAExchange(contact *Contact) {
+	if c.readOnly {
+		return
+	}
+	pandaCfg := c.getPandaConfig(contact)
+	if pandaCfg == nil {
+		if _, ok := c.deferredPANDAExchanges[contact.ID()]; !ok {
+			c.log.Warningf("No PANDA service configured, deferring key exchange with %s", contact.Nickname)
+			c.deferredPANDAExchanges[contact.ID()] = c.clock.Now()
+		}
+		return
+	}
+	delete(c.deferredPANDAExchanges, contact.ID())
+	meetingPlace := c.newMeetingPlace(contact, pandaCfg)
+	logPandaKx := c.getLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.Nickname))
+	kx, err := panda.UnmarshalKeyExchange(rand.Reader, logPandaKx, meetingPlace, contact.pandaKeyExchange, contact.ID(), c.pandaChan, contact.pandaShutdownChan)
+	if err != nil {
+		panic(err)
+	}
+	go kx.Run()
+}
+
+// retryDeferredPANDAExchanges resumes the deferred PANDA key exchanges once
+// a PANDA service is configured. Exchanges deferred for longer than the
+// grace period are reported to the fatal error handler.
+func (c *Client) retryDeferredPANDAExchanges() {
+	for id, since := range c.deferredPANDAExchanges {
+		contact, ok := c.contacts[id]
+		if !ok || !contact.IsPending || contact.pandaKeyExchange == nil {
+			delete(c.deferredPANDAExchanges, id)
+			continue
+		}
+		c.resumePANDAExchange(contact)
+		if _, ok := c.deferredPANDAExchanges[id]; !ok {
+			continue
+		}
+		if c.pandaGracePeriod > 0 && c.clock.Now().Sub(since) > c.pandaGracePeriod {
+			delete(c.deferredPANDAExchanges, id)
+			c.fatalErrCh <- fmt.Errorf("no PANDA service configured for the key exchange with %s", contact.Nickname)
+		}
+	}
+}
+
+func (c *Client) doPANDAExchange(contact *Contact, sharedSecret []byte) error {
+	// Use PANDA
+	meetingPlace := c.newMeetingPlace(contact, c.getPandaConfig(contact))
+	kxLog := c.getLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.Nickname))
+	kx, err := panda.NewKeyExchange(rand.Reader, kxLog, meetingPlace, sharedSecret, contact.keyExchange, contact.id, c.pandaChan, contact.pandaShutdownChan)
+	if err != nil {
+		return err
+	}
+	contact.pandaKeyExchange = kx.Marshal()
+	contact.keyExchange = nil
+	go kx.Run()
+	c.save()
+
+	c.log.Info("New PANDA key exchange in progress.")
+	return nil
+}
+
+func (c *Client) getReunionTransports() ([]*rTrans.Transport, error) {
+	// Get consensus
+	doc := c.session.CurrentDocument()
+	if doc == nil {
+		return nil, errors.New("No current document, wtf")
+	}
+	transports := make([]*rTrans.Transport, 0)
+
+	// Get reunion endpoints and epoch values
+	for _, p := range doc.Providers {
+		if r, ok := p.Kaetzchen["reunion"]; ok {
+			if ep, ok := r["endpoint"]; ok {
+				ep := ep.(string)
+				trans := &rTrans.Transport{Session: c.mixnetSession, Recipient: ep, Provider: p.Name}
+				c.log.Debugf("Adding transport %v", trans)
+				transports = append(transports, trans)
+			} else {
+				return nil, errors.New("Provider kaetzchen descriptor missing endpoint")
+			}
+		}
+	}
+	if len(transports) > 0 {
+		return transports, nil
+	}
+	return nil, errors.New("Found no reunion transports")
+}
+
+func (c *Client) doReunion(contact *Contact, sharedSecret []byte) error {
+	c.log.Info("DoReunion called")
+	rtransports, err := c.getReunionTransports()
+	if err != nil {
+		return err
+	}
+	for _, tr := range rtransports {
+		epochs, err := tr.CurrentEpochs()
+		if err != nil {
+			return err
+		}
+		srvs, err := tr.CurrentSharedRandoms()
+		if err != nil {
+			return err
+		}
+		// what should we do to reduce the number of exchanges initiated?
+		// if this is the first reunion, choose the latest published epoch and srv ?
+		// (after some time, try other epochs and srvs?)
+		for _, srv := range srvs[0:1] {
+			for _, epoch := range epochs {
+				lstr := fmt.Sprintf("reunion with %s at %s@%s:%d", contact.Nickname, tr.Recipient, tr.Provider, epoch)
+				dblog := c.getLogger(lstr)
+				ex, err := rClient.NewExchange(contact.keyExchange, dblog, tr, contact.ID(), sharedSecret, srv, epoch, c.reunionChan)
+				if err != nil {
+					return err
+				}
+				// create a mapping from exchange ID to transport and serialized updates
+				contact.reunionKeyExchange[ex.ExchangeID] = boundExchange{recipient: tr.Recipient, provider: tr.Provider}
+				go ex.Run()
+				c.log.Info("New reunion exchange %v in progress.", ex.ExchangeID)
+			}
+		}
+	}
+	return nil
+}
+
+// RestartKeyExchange restarts the PANDA key exchange with the given
+// pending contact after a failed exchange, reusing the contact entry.
+func (c *Client) RestartKeyExchange(nickname string, sharedSecret []byte) error {
+	op := &opRestartKeyExchange{
+		name:         nickname,
+		sharedSecret: sharedSecret,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doRestartKeyExchange(nickname string, sharedSecret []byte) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if !contact.IsPending {
+		return fmt.Errorf("key exchange with %s already completed", nickname)
+	}
+	if contact.reserved {
+		return fmt.Errorf("key exchange with %s was not begun", nickname)
+	}
+	if contact.pandaKeyExchange != nil {
+		return fmt.Errorf("key exchange with %s is still in progress", nickname)
+	}
+	if c.getPandaConfig(contact) == nil {
+		return errors.New("no PANDA service configured")
+	}
+	if err := contact.newKeyExchange(c.spoolReadDescriptor); err != nil {
+		return err
+	}
+	contact.pandaResult = ""
+	contact.pandaShutdownChan = make(chan struct{})
+	return c.doPANDAExchange(contact, sharedSecret)
+}
+
+// RekeyContact replaces the double ratchet shared with the given contact,
+// e.g. after a suspected compromise of a device, by running a fresh PANDA
+// key exchange with the given shared secret. The contact entry and the
+// conversation are kept. Once the exchange has been started the old
+// ratchet is discarded and the contact is pending until the exchange
+// completes, the queued messages encrypted with the old ratchet are
+// marked as not sent. If the exchange can't be started the contact keeps
+// its old ratchet.
+func (c *Client) RekeyContact(nickname string, sharedSecret []byte) error {
+	op := &opRekeyContact{
+		name:         nickname,
+		sharedSecret: sharedSecret,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doRekeyContact(nickname string, sharedSecret []byte) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	if c.getPandaConfig(contact) == nil {
+		return errors.New("no PANDA service configured")
+	}
+	if c.spoolReadDescriptor == nil {
+		return ErrNoRemoteSpool
+	}
+	r, exchange, err := createKeyExchange(c.spoolReadDescriptor)
+	if err != nil {
+		return err
+	}
+
+	// keep the old state until the exchange is running
+	contact.ratchetMutex.Lock()
+	oldRatchet := contact.ratchet
+	contact.ratchet = r
+	contact.ratchetMutex.Unlock()
+	oldPandaResult := contact.pandaResult
+	oldPandaShutdownChan := contact.pandaShutdownChan
+	contact.keyExchange = exchange
+	contact.IsPending = true
+	contact.pandaResult = ""
+	contact.pandaShutdownChan = make(chan struct{})
+	c.log.Infof("Rekeying %s.", nickname)
+	if err := c.doPANDAExchange(contact, sharedSecret); err != nil {
+		c.log.Errorf("Failed to rekey %s, keeping the old ratchet: %s", nickname, err)
+		contact.ratchetMutex.Lock()
+		contact.ratchet = oldRatchet
+		contact.ratchetMutex.Unlock()
+		contact.keyExchange = nil
+		contact.IsPending = false
+		contact.pandaResult = oldPandaResult
+		contact.pandaShutdownChan = oldPandaShutdownChan
+		return err
+	}
+
+	if contact.rtx != nil {
+		contact.rtx.Stop()
+	}
+	var discarded []MessageID
+	for {
+		cmd, err := contact.outbound.Pop()
+		if err == ErrQueueEmpty {
+			break
+		}
+		discarded = append(discarded, cmd.ID)
+	}
+	for _, id := range discarded {
+		c.messageNotSent(nickname, id)
+	}
+	c.save()
+	return nil
+}
+
+// WaitAllKeyExchanges blocks until the key exchanges of all pending
+// contacts have completed or failed, or until ctx is done. It returns
+// immediately if no contact is pending. The failures are combined into
+// the returned error, failed exchanges which await their restart count
+// as failures as well. Contacts reserved with ReserveContact are waited
+// for once BeginKeyExchange starts their exchange.
+func (c *Client) WaitAllKeyExchanges(ctx context.Context) error {
+	// subscribe before taking the pending set, such
+	// that no completion of a pending exchange is missed
+	sub := &contactSubscription{
+		all: true,
+		ch:  channels.NewInfiniteChannel(),
+	}
+	c.subscriptionsMutex.Lock()
+	c.subscriptions[sub] = struct{}{}
+	c.subscriptionsMutex.Unlock()
+	defer func() {
+		c.subscriptionsMutex.Lock()
+		defer c.subscriptionsMutex.Unlock()
+		if _, ok := c.subscriptions[sub]; ok {
+			delete(c.subscriptions, sub)
+			sub.ch.Close()
+		}
+	}()
+
+	op := &opPendingKeyExchanges{
+		responseChan: make(chan map[string]error),
+	}
+	c.opCh <- op
+	pending := <-op.responseChan
+	failures := make(map[string]error)
+	for nickname, err := range pending {
+		if err != nil {
+			failures[nickname] = err
+			delete(pending, nickname)
+		}
+	}
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-sub.ch.Out():
+			if !ok {
+				return errors.New("client is shutting down")
+			}
+			switch event := e.(type) {
+			case *KeyExchangeCompletedEvent:
+				if _, ok := pending[event.Nickname]; !ok {
+					continue
+				}
+				delete(pending, event.Nickname)
+				if event.Err != nil {
+					failures[event.Nickname] = event.Err
+				}
+			case *ContactRemovedEvent:
+				delete(pending, event.Nickname)
+			}
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	nicknames := make([]string, 0, len(failures))
+	for nickname := range failures {
+		nicknames = append(nicknames, nickname)
+	}
+	sort.Strings(nicknames)
+	reasons := make([]string, len(nicknames))
+	for i, nickname := range nicknames {
+		reasons[i] = fmt.Sprintf("%s: %s", nickname, failures[nickname])
+	}
+	return fmt.Errorf("key exchanges failed: %s", strings.Join(reasons, "; "))
+}
+
+type conversationMessage struct {
+	nickname string
+	id       MessageID
+}
+
+// DrainOutbound blocks until every outbound message which was sent
+// but not delivered to the remote spool of its contact yet is either
+// delivered or has failed, or until ctx is done. It returns an error
+// with the number of those messages which were not delivered. It is
+// meant to be called before Shutdown, such that no message which is
+// about to be delivered is left to the next Start.
+func (c *Client) DrainOutbound(ctx context.Context) error {
+	// subscribe before taking the undelivered messages,
+	// such that no delivery of one of them is missed
+	sub := &contactSubscription{
+		all: true,
+		ch:  channels.NewInfiniteChannel(),
+	}
+	c.subscriptionsMutex.Lock()
+	c.subscriptions[sub] = struct{}{}
+	c.subscriptionsMutex.Unlock()
+	defer func() {
+		c.subscriptionsMutex.Lock()
+		defer c.subscriptionsMutex.Unlock()
+		if _, ok := c.subscriptions[sub]; ok {
+			delete(c.subscriptions, sub)
+			sub.ch.Close()
+		}
+	}()
+
+	pending := make(map[conversationMessage]bool)
+	c.conversationsMutex.Lock()
+	for nickname, messages := range c.conversations {
+		for id, message := range messages {
+			if message.Outbound && message.Sent && !message.Delivered && !message.Failed {
+				pending[conversationMessage{nickname, id}] = true
+			}
+		}
+	}
+	c.conversationsMutex.Unlock()
+	failed := 0
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d messages were not delivered: %s", len(pending)+failed, ctx.Err())
+		case e, ok := <-sub.ch.Out():
+			if !ok {
+				return errors.New("client is shutting down")
+			}
+			var key conversationMessage
+			delivered := false
+			switch event := e.(type) {
+			case *MessageDeliveredEvent:
+				key = conversationMessage{event.Nickname, event.MessageID}
+				delivered = true
+			case *MessageNotSentEvent:
+				key = conversationMessage{event.Nickname, event.MessageID}
+			case *MessageDeliveryTimeoutEvent:
+				key = conversationMessage{event.Nickname, event.MessageID}
+			case *SpoolWriteFailedEvent:
+				key = conversationMessage{event.Nickname, event.MessageID}
+			case *ContactRemovedEvent:
+				for message := range pending {
+					if message.nickname == event.Nickname {
+						delete(pending, message)
+						failed++
+					}
+				}
+				continue
+			default:
+				continue
+			}
+			if !pending[key] {
+				continue
+			}
+			delete(pending, key)
+			if !delivered {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d messages were not delivered", failed)
+	}
+	return nil
+}
+
+// doPendingKeyExchanges returns the nicknames of the pending contacts,
+// mapped to the error of their failed key exchange or to nil if the
+// exchange is in progress or not begun yet.
+func (c *Client) doPendingKeyExchanges() map[string]error {
+	pending := make(map[string]error)
+	for _, contact := range c.contacts {
+		if !contact.IsPending {
+			continue
+		}
+		if contact.pandaResult != "" {
+			pending[contact.Nickname] = errors.New(contact.pandaResult)
+			continue
+		}
+		pending[contact.Nickname] = nil
+	}
+	return pending
+}
+
+// KeyExchangePhase returns the Phase of the key
+// exchange with the contact with the given nickname.
+func (c *Client) KeyExchangePhase(nickname string) (Phase, error) {
+	op := &opKeyExchangePhase{
+		name:         nickname,
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return 0, r
+	case Phase:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doKeyExchangePhase(nickname string) interface{} {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	return contact.phase()
+}
+
+// LastKeyExchangeResult returns the error message of the last failed PANDA
+// key exchange with the given contact, it is empty if the key exchange is
+// in progress or has completed successfully.
+func (c *Client) LastKeyExchangeResult(nickname string) (string, error) {
+	op := &opLastKeyExchangeResult{
+		name:         nickname,
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return "", r
+	case string:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doLastKeyExchangeResult(nickname string) interface{} {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	return contact.pandaResult
+}
+
+// MuteContact mutes the contact with the given nickname. Messages received
+// from a muted contact are stored as usual but their MessageReceivedEvent
+// has Muted set such that no notification is shown.
+func (c *Client) MuteContact(nickname string) error {
+	return c.setMuted(nickname, true)
+}
+
+// UnmuteContact unmutes the contact with the given nickname.
+func (c *Client) UnmuteContact(nickname string) error {
+	return c.setMuted(nickname, false)
+}
+
+func (c *Client) setMuted(nickname string, muted bool) error {
+	op := &opMuteContact{
+		name:         nickname,
+		muted:        muted,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doMuteContact(nickname string, muted bool) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	contact.muted = muted
+	c.save()
+	return nil
+}
+
+// AddContactLabel adds the given label to the contact with the given
+// nickname. Labels are local to the client and group contacts for
+// ContactsByLabel. Adding a label the contact already has is a no-op.
+func (c *Client) AddContactLabel(nickname, label string) error {
+	return c.setContactLabel(nickname, label, true)
+}
+
+// RemoveContactLabel removes the given label from
+// the contact with the given nickname.
+func (c *Client) RemoveContactLabel(nickname, label string) error {
+	return c.setContactLabel(nickname, label, false)
+}
+
+func (c *Client) setContactLabel(nickname, label string, add bool) error {
+	op := &opSetContactLabel{
+		name:         nickname,
+		label:        label,
+		add:          add,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doSetContactLabel(nickname, label string, add bool) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if label == "" {
+		return errors.New("label is empty")
+	}
+	for i, l := range contact.Labels {
+		if l != label {
+			continue
+		}
+		if add {
+			return nil
+		}
+		contact.Labels = append(contact.Labels[:i:i], contact.Labels[i+1:]...)
+		c.unindexLabel(contact, label)
+		c.save()
+		return nil
+	}
+	if !add {
+		return nil
+	}
+	contact.Labels = append(contact.Labels, label)
+	c.indexLabel(contact, label)
+	c.save()
+	return nil
+}
+
+func (c *Client) indexLabel(contact *Contact, label string) {
+	if _, ok := c.labels[label]; !ok {
+		c.labels[label] = make(map[uint64]*Contact)
+	}
+	c.labels[label][contact.id] = contact
+}
+
+func (c *Client) unindexLabel(contact *Contact, label string) {
+	delete(c.labels[label], contact.id)
+	if len(c.labels[label]) == 0 {
+		delete(c.labels, label)
+	}
+}
+
+// ContactsByLabel returns the contacts with the
+// given label ordered by their nicknames.
+func (c *Client) ContactsByLabel(label string) []ContactInfo {
+	op := &opContactsByLabel{
+		label:        label,
+		responseChan: make(chan []ContactInfo),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doContactsByLabel(label string) []ContactInfo {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	infos := []ContactInfo{}
+	for _, contact := range c.labels[label] {
+		infos = append(infos, ContactInfo{
+			Nickname:      contact.Nickname,
+			IsPending:     contact.IsPending,
+			State:         c.contactState(contact),
+			Labels:        append([]string{}, contact.Labels...),
+			LastInboundAt: contact.lastInboundAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Nickname < infos[j].Nickname
+	})
+	return infos
+}
+
+// MarkConversationRead marks the received messages of
+// the conversation with the given contact as read.
+func (c *Client) MarkConversationRead(nickname string) error {
+	op := &opMarkConversationRead{
+		name:         nickname,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doMarkConversationRead(nickname string) error {
+	if _, ok := c.contactNicknames[nickname]; !ok {
+		return ErrContactNotFound
+	}
+	c.conversationsMutex.Lock()
+	changed := false
+	for _, message := range c.conversations[nickname] {
+		if !message.Outbound && !message.Read {
+			message.Read = true
+			changed = true
+		}
+	}
+	c.conversationsMutex.Unlock()
+	if changed {
+		c.save()
+	}
+	return nil
+}
+
+// unreadCount returns the number of unread messages in the conversation
+// with the given contact, the caller must hold the conversationsMutex.
+func (c *Client) unreadCount(nickname string) int {
+	n := 0
+	for _, message := range c.conversations[nickname] {
+		if !message.Outbound && !message.Read {
+			n++
+		}
+	}
+	return n
+}
+
+// TotalUnread returns the number of unread messages in all conversations,
+// e.g. for a badge. The conversations of muted contacts only count if the
+// Client is created WithMutedUnread.
+func (c *Client) TotalUnread() int {
+	op := &opTotalUnread{
+		responseChan: make(chan int),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doTotalUnread() int {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	total := 0
+	for nickname, contact := range c.contactNicknames {
+		if contact.muted && !c.countMutedAsUnread {
+			continue
+		}
+		total += c.unreadCount(nickname)
+	}
+	return total
+}
+
+// RatchetInfo returns diagnostic information about the
+// double ratchet shared with the given contact.
+func (c *Client) RatchetInfo(nickname string) (RatchetInfo, error) {
+	op := &opRatchetInfo{
+		name:         nickname,
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return RatchetInfo{}, r
+	case RatchetInfo:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doRatchetInfo(nickname string) interface{} {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	contact.ratchetMutex.Lock()
+	defer contact.ratchetMutex.Unlock()
+	return RatchetInfo{
+		Sent:                 contact.sendCount,
+		Received:             contact.recvCount,
+		LastReceivedSequence: contact.recvSequence,
+		UnACKed:              contact.outbound.Len(),
+		FrameHeader:          contact.frameHeader,
+	}
+}
+
+// ReadSpoolDescriptor returns a copy of the descriptor of our remote
+// spool, or nil if the remote spool has not yet been created.
+func (c *Client) ReadSpoolDescriptor() *memspoolclient.SpoolReadDescriptor {
+	op := &opReadSpoolDescriptor{
+		responseChan: make(chan *memspoolclient.SpoolReadDescriptor),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doReadSpoolDescriptor() *memspoolclient.SpoolReadDescriptor {
+	if c.spoolReadDescriptor == nil {
+		return nil
+	}
+	desc := *c.spoolReadDescriptor
+	if c.spoolReadDescriptor.PrivateKey != nil {
+		desc.PrivateKey = new(eddsa.PrivateKey)
+		if err := desc.PrivateKey.FromBytes(c.spoolReadDescriptor.PrivateKey.Bytes()); err != nil {
+			panic(err)
+		}
+	}
+	return &desc
+}
+
+// ContactWriteDescriptor returns a copy of the descriptor of the remote
+// spool which we write to in order to send the given contact a message.
+func (c *Client) ContactWriteDescriptor(nickname string) (*memspoolclient.SpoolWriteDescriptor, error) {
+	op := &opContactWriteDescriptor{
+		name:         nickname,
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return nil, r
+	case *memspoolclient.SpoolWriteDescriptor:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doContactWriteDescriptor(nickname string) interface{} {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending || contact.spoolWriteDescriptor == nil {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	desc := *contact.spoolWriteDescriptor
+	return &desc
+}
+
+// XXX do we even need this method?
+func (c *Client) GetContacts() map[string]*Contact {
+	getContactsOp := opGetContacts{
+		responseChan: make(chan map[string]*Contact),
+	}
+	c.opCh <- &getContactsOp
+	return <-getContactsOp.responseChan
+}
+
+// HasContact returns true if there is a contact with the given nickname.
+func (c *Client) HasContact(nickname string) bool {
+	op := &opHasContact{
+		name:         nickname,
+		responseChan: make(chan bool),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+// HasContactID returns true if there is a contact with the given ID.
+func (c *Client) HasContactID(id uint64) bool {
+	op := &opHasContact{
+		id:           id,
+		responseChan: make(chan bool),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+// called by worker upon opHasContact, the contact is looked
+// up by its ID if it is non-zero and by its nickname otherwise
+func (c *Client) doHasContact(nickname string, id uint64) bool {
+	if id != 0 {
+		_, ok := c.contacts[id]
+		return ok
+	}
+	_, ok := c.contactNicknames[nickname]
+	return ok
+}
+
+// RemoveContact removes a contact from the Client's state.
+func (c *Client) RemoveContact(nickname string) {
+	c.opCh <- &opRemoveContact{
+		name: nickname,
+	}
+}
+
+func (c *Client) doContactRemoval(nickname string) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		c.log.Errorf("contact removal failed, %s not found in contacts", nickname)
+		return
+	}
+	if contact.IsPending {
+		if contact.pandaShutdownChan != nil {
+			close(contact.pandaShutdownChan)
+		}
+	}
+	delete(c.contactNicknames, nickname)
+	delete(c.contacts, contact.id)
+	for _, label := range contact.Labels {
+		c.unindexLabel(contact, label)
+	}
+	c.save()
+	c.eventCh.In() <- &ContactRemovedEvent{
+		Nickname: nickname,
+	}
+}
+
+func (c *Client) save() {
+	if err := c.writeState(); err != nil {
+		panic(err)
+	}
+}
+
+// Flush writes the current state to the statefile and returns once it
+// is synced to disk. It must be called after Start and does nothing in
+// memory only mode.
+func (c *Client) Flush() error {
+	op := &opFlush{
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) writeState() error {
+	if c.stateWorker == nil {
+		// memory only mode, nothing is persisted
+		return nil
+	}
+	c.log.Debug("Saving statefile.")
+	serialized, err := c.marshal()
+	if err != nil {
+		return err
+	}
+	err = c.stateWorker.WriteState(serialized)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&c.stateSize, uint32(len(serialized)))
+	return nil
+}
+
+// Compact is a maintenance operation which removes the expired messages
+// and the conversations left empty of removed contacts, and rewrites the
+// statefile with the live state only, e.g. after a bulk prune. A
+// StateCompactedEvent reports the size of the state before and after.
+// It is safe to call while the Client is running.
+func (c *Client) Compact() error {
+	op := &opCompact{
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doCompact() error {
+	before := c.StateSize()
+	c.garbageCollectConversations()
+	now := c.clock.Now()
+	c.conversationsMutex.Lock()
+	for nickname, messages := range c.conversations {
+		for mesgID, message := range messages {
+			if !message.Expires.IsZero() && now.After(message.Expires) {
+				message.wipe()
+				delete(messages, mesgID)
+			}
+		}
+		if _, ok := c.contactNicknames[nickname]; !ok && len(messages) == 0 {
+			delete(c.conversations, nickname)
+		}
+	}
+	c.conversationsMutex.Unlock()
+	if err := c.writeState(); err != nil {
+		return err
+	}
+	after := c.StateSize()
+	c.log.Infof("Compacted the state from %d to %d bytes.", before, after)
+	c.eventCh.In() <- &StateCompactedEvent{
+		Before: before,
+		After:  after,
+	}
+	return nil
+}
+
+// StateSize returns the size in bytes of the serialized state which was
+// last written to the statefile or zero if none was written yet.
+// It can be used to monitor the growth of the statefile.
+func (c *Client) StateSize() int {
+	return int(atomic.LoadUint32(&c.stateSize))
+}
+
+// StorageUsage is the breakdown of the size of the state of a Client.
+type StorageUsage struct {
+	// Total is the size in bytes of the serialized state,
+	// the statefile adds the overhead of its encryption.
+	Total int
+	// Conversations is the storage used by the
+	// conversation with each contact by nickname.
+	Conversations map[string]ConversationUsage
+}
+
+// ConversationUsage is the storage used by a conversation.
+type ConversationUsage struct {
+	// Messages is the number of stored messages.
+	Messages int
+	// Bytes is the approximate size in bytes of the stored
+	// messages, i.e. the length of their contents including
+	// the previous contents of edited messages.
+	Bytes int
+}
+
+// StorageBreakdown returns the size of the serialized state of the
+// Client and the storage used by each conversation, e.g. to find the
+// conversations to prune once the statefile grows too large.
+func (c *Client) StorageBreakdown() (StorageUsage, error) {
+	op := &opStorageBreakdown{
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return StorageUsage{}, r
+	case StorageUsage:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doStorageBreakdown() interface{} {
+	serialized, err := c.marshal()
+	if err != nil {
+		return err
+	}
+	usage := StorageUsage{
+		Total:         len(serialized),
+		Conversations: make(map[string]ConversationUsage),
+	}
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	for nickname, messages := range c.conversations {
+		conversation := ConversationUsage{
+			Messages: len(messages),
+		}
+		for _, message := range messages {
+			conversation.Bytes += len(message.Plaintext)
+			for _, previous := range message.EditHistory {
+				conversation.Bytes += len(previous)
+			}
+		}
+		usage.Conversations[nickname] = conversation
+	}
+	return usage
+}
+
+func (c *Client) marshal() ([]byte, error) {
+	contacts := []*Contact{}
+	for _, contact := range c.contacts {
+		contacts = append(contacts, contact)
+	}
+	s := &State{
+		SpoolReadDescriptor: c.spoolReadDescriptor,
+		Contacts:            contacts,
+		LinkKey:             c.linkKey,
+		User:                c.user,
+		Offline:             c.offline,
+		FileTransfers:       c.transfers,
+		IncomingFiles:       c.incomingFiles,
+		// a snapshot, such that new messages don't race the encoding
+		Conversations: c.GetAllConversations(),
+	}
+	if c.client != nil {
+		s.Provider = c.client.Provider()
+	}
+	serialized, err := cbor.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return checksumState(serialized), nil
+}
+
+func (c *Client) stopContactTimers() {
+	for _, contact := range c.contacts {
+		if contact.rtx != nil {
+			contact.rtx.Stop()
+		}
+	}
+}
+
+func (c *Client) haltKeyExchanges() {
+	for _, contact := range c.contacts {
+		if contact.IsPending {
+			c.log.Debugf("Halting pending key exchange for '%s' contact.", contact.Nickname)
+			if contact.pandaShutdownChan != nil {
+				close(contact.pandaShutdownChan)
+			}
+		}
+	}
+}
+
+// Shutdown shuts down the client.
+func (c *Client) Shutdown() {
+	c.shutdown(nil)
+}
+
+// shutdown shuts down the client due to the given error, nil if
+// requested by the user. Only the first call has an effect.
+func (c *Client) shutdown(reason error) {
+	c.shutdownOnce.Do(func() {
+		c.log.Info("Shutting down now.")
+		c.shutdownReason = reason
+		c.save()
+		c.Halt()
+		if c.client != nil {
+			c.client.Shutdown()
+		}
+		if c.stateWorker != nil {
+			c.stateWorker.Halt()
+		}
+		close(c.shutdownCh)
+	})
+}
+
+// WaitShutdown blocks until the client is shut down and returns
+// the error which caused the shutdown, or nil if it was requested
+// by calling Shutdown.
+func (c *Client) WaitShutdown() error {
+	<-c.shutdownCh
+	return c.shutdownReason
+}
+
+func (c *Client) processReunionUpdate(update *rClient.ReunionUpdate) {
+	c.log.Debug("got a reunion update for exchange %v", update.ExchangeID)
+	contact, ok := c.contacts[update.ContactID]
+	if !ok {
+		c.log.Error("failure to perform Reunion update: invalid contact ID")
+		return
+	}
+	if !contact.IsPending {
+		// we performed multiple exchanges, but this one has probably arrived too late
+		c.log.Debugf("received reunion update for exchange %v after pairing occurred", update.ExchangeID)
+		// remove the map entries
+		if _, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
+			delete(contact.reunionKeyExchange, update.ExchangeID)
+		}
+		if _, ok := contact.reunionResult[update.ExchangeID]; ok {
+			delete(contact.reunionResult, update.ExchangeID)
+		}
+		return
+	}
+	switch {
+	case update.Error != nil:
+		contact.reunionResult[update.ExchangeID] = update.Error.Error()
+		c.log.Infof("Reunion key exchange %v with %s failed: %s", update.ExchangeID, contact.Nickname, update.Error)
+		if _, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
+			delete(contact.reunionKeyExchange, update.ExchangeID) // remove map entry
+		}
+		c.eventCh.In() <- &KeyExchangeCompletedEvent{
+			Nickname: contact.Nickname,
+			Err:      update.Error,
+		}
+		return
+
+	case update.Serialized != nil:
+		if ex, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
+			ex.serialized = update.Serialized
+			c.log.Infof("Reunion key exchange %v with %s update received", update.ExchangeID, contact.Nickname)
+		} else {
+			c.log.Infof("Reunion key exchange %v with %s update received after another valid exchange", update.ExchangeID, contact.Nickname)
+		}
+	case update.Result != nil:
+		c.log.Debugf("Reunion exchange %v completed", update.ExchangeID)
+		exchange, err := parseContactExchangeBytes(update.Result)
+		if _, ok := contact.reunionKeyExchange[update.ExchangeID]; ok {
+			delete(contact.reunionKeyExchange, update.ExchangeID) // remove map entry
+		}
+		if err != nil {
+			err = fmt.Errorf("Reunion failure to parse contact exchange %v bytes: %s", update.ExchangeID, err)
+			c.log.Error(err.Error())
+			contact.reunionResult[update.ExchangeID] = err.Error()
+			c.save()
+			c.eventCh.In() <- &KeyExchangeCompletedEvent{
+				Nickname: contact.Nickname,
+				Err:      err,
+			}
+			return
+		}
+		contact.ratchetMutex.Lock()
+		err = contact.ratchet.ProcessKeyExchange(exchange.SignedKeyExchange)
+		contact.ratchetMutex.Unlock()
+		if err != nil {
+			err = fmt.Errorf("Reunion double ratchet key exchange %v failure: %s", update.ExchangeID, err)
+			c.log.Error(err.Error())
+			contact.reunionResult[update.ExchangeID] = err.Error()
+			c.save()
+			c.eventCh.In() <- &KeyExchangeCompletedEvent{
+				Nickname: contact.Nickname,
+				Err:      err,
+			}
+			return
+		}
+		c.setSpoolWriteDescriptor(contact, exchange.SpoolWriteDescriptor)
+		contact.frameHeader = exchange.Features&featureFrameHeader != 0
+		contact.compression = exchange.Features&featureCompression != 0
+		contact.disappearing = exchange.Features&featureDisappearing != 0
+		contact.fileTransfer = exchange.Features&featureFileTransfer != 0
+		contact.deliveryAck = exchange.Features&featureDeliveryAck != 0
+		contact.remoteDelete = exchange.Features&featureRemoteDelete != 0
+		contact.channels = exchange.Features&featureChannels != 0
+		contact.spoolUpdate = exchange.Features&featureSpoolUpdate != 0
+		// XXX: should purge the reunionResults now...
+		contact.keyExchange = nil
+		contact.IsPending = false
+		c.log.Info("Reunion double ratchet key exchange completed by exchange %v!", update.ExchangeID)
+		c.eventCh.In() <- &KeyExchangeCompletedEvent{
+			Nickname: contact.Nickname,
+		}
+		c.retryQuarantine(contact)
+	}
+	c.save()
+}
+
+func (c *Client) processPANDAUpdate(update *panda.PandaUpdate) {
+	contact, ok := c.contacts[update.ID]
+	if !ok {
+		c.log.Error("failure to perform PANDA update: invalid contact ID")
+		return
+	}
+
+	switch {
+	case update.Err != nil:
+		// restart the handshake with the current state if the error is due to SURB-ACK timeout
+		if update.Err == client.ErrReplyTimeout {
+			c.log.Error("PANDA handshake for client %s timed-out; restarting exchange", contact.Nickname)
+			c.resumePANDAExchange(contact)
+			c.eventCh.In() <- &KeyExchangeRetryEvent{
+				Nickname: contact.Nickname,
+				Err:      update.Err,
+			}
+			return
+		}
+		// the exchange has given up, it can be restarted
+		contact.pandaKeyExchange = nil
+		contact.pandaResult = update.Err.Error()
+		contact.pandaShutdownChan = nil
+		c.log.Infof("Key exchange with %s failed: %s", contact.Nickname, update.Err)
+		c.save()
+		c.eventCh.In() <- &KeyExchangeCompletedEvent{
+			Nickname: contact.Nickname,
+			Err:      update.Err,
+		}
+	case update.Serialised != nil:
+		if bytes.Equal(contact.pandaKeyExchange, update.Serialised) {
+			c.log.Infof("Strange, our PANDA key exchange echoed our exchange bytes: %s", contact.Nickname)
 			c.eventCh.In() <- &KeyExchangeCompletedEvent{
 				Nickname: contact.Nickname,
 				Err:      errors.New("strange, our PANDA key exchange echoed our exchange bytes"),
 			}
 			return
 		}
-		contact.pandaKeyExchange = update.Serialised
-	case update.Result != nil:
-		c.log.Debug("PANDA exchange completed")
-		contact.pandaKeyExchange = nil
-		exchange, err := parseContactExchangeBytes(update.Result)
-		if err != nil {
-			err = fmt.Errorf("failure to parse contact exchange bytes: %s", err)
-			c.log.Error(err.Error())
-			contact.pandaResult = err.Error()
-			contact.IsPending = false
-			c.save()
-			c.eventCh.In() <- &KeyExchangeCompletedEvent{
-				Nickname: contact.Nickname,
-				Err:      err,
+		contact.pandaKeyExchange = update.Serialised
+	case update.Result != nil:
+		c.log.Debug("PANDA exchange completed")
+		contact.pandaKeyExchange = nil
+		exchange, err := parseContactExchangeBytes(update.Result)
+		if err != nil {
+			err = fmt.Errorf("failure to parse contact exchange bytes: %s", err)
+			c.log.Error(err.Error())
+			// the contact remains pending such that
+			// the key exchange can be restarted
+			contact.pandaResult = err.Error()
+			c.save()
+			c.eventCh.In() <- &KeyExchangeCompletedEvent{
+				Nickname: contact.Nickname,
+				Err:      err,
+			}
+			return
+		}
+		contact.ratchetMutex.Lock()
+		err = contact.ratchet.ProcessKeyExchange(exchange.SignedKeyExchange)
+		contact.ratchetMutex.Unlock()
+		if err != nil {
+			err = fmt.Errorf("Double ratchet key exchange failure: %s", err)
+			c.log.Error(err.Error())
+			// the contact remains pending such that
+			// the key exchange can be restarted
+			contact.pandaResult = err.Error()
+			c.save()
+			c.eventCh.In() <- &KeyExchangeCompletedEvent{
+				Nickname: contact.Nickname,
+				Err:      err,
+			}
+			return
+		}
+		c.setSpoolWriteDescriptor(contact, exchange.SpoolWriteDescriptor)
+		contact.frameHeader = exchange.Features&featureFrameHeader != 0
+		contact.compression = exchange.Features&featureCompression != 0
+		contact.disappearing = exchange.Features&featureDisappearing != 0
+		contact.fileTransfer = exchange.Features&featureFileTransfer != 0
+		contact.deliveryAck = exchange.Features&featureDeliveryAck != 0
+		contact.remoteDelete = exchange.Features&featureRemoteDelete != 0
+		contact.channels = exchange.Features&featureChannels != 0
+		contact.spoolUpdate = exchange.Features&featureSpoolUpdate != 0
+		contact.IsPending = false
+		contact.pandaResult = ""
+		c.log.Info("Double ratchet key exchange completed!")
+		c.eventCh.In() <- &KeyExchangeCompletedEvent{
+			Nickname: contact.Nickname,
+		}
+		c.retryQuarantine(contact)
+	}
+	c.save()
+}
+
+// setSpoolWriteDescriptor replaces the spool write descriptor of the
+// given contact and notifies the client of the change.
+func (c *Client) setSpoolWriteDescriptor(contact *Contact, desc *memspoolclient.SpoolWriteDescriptor) {
+	contact.spoolWriteDescriptor = desc
+	c.log.Debugf("spool write descriptor updated for %s", contact.Nickname)
+	c.eventCh.In() <- &ContactSpoolUpdatedEvent{
+		Nickname: contact.Nickname,
+	}
+}
+
+// SendMessage sends a message to the Client contact with the given nickname.
+// The returned MessageID identifies the message in the conversation and in
+// the events of the message, it also traces the message in the log: each
+// stage of the transmission logs a "trace" line with the ID and the mixnet
+// message IDs of the transmission attempts.
+func (c *Client) SendMessage(nickname string, message []byte) MessageID {
+	return c.SendMessagePriority(nickname, message, 0)
+}
+
+// MaxMessageSize returns the length of the longest message which can be
+// sent with SendMessage, longer messages fail with ErrMessageTooLarge
+// unless compression shrinks them enough. Edits carry the sequence number
+// of the edited message and are limited to 8 bytes less.
+func (c *Client) MaxMessageSize() int {
+	return maxMessageLength()
+}
+
+// SendMessagePriority sends a message to the Client contact with the given
+// nickname. Messages with a higher priority are transmitted before queued
+// messages with a lower priority, the default priority is zero. The
+// priority is ignored if the Client was created WithOrderedDelivery.
+func (c *Client) SendMessagePriority(nickname string, message []byte, priority int) MessageID {
+	convoMesgID, err := c.newMessageID()
+	if err != nil {
+		c.fatalErrCh <- err
+	}
+
+	c.opCh <- &opSendMessage{
+		id:       convoMesgID,
+		name:     nickname,
+		payload:  message,
+		priority: priority,
+	}
+
+	return convoMesgID
+}
+
+// SendMessageOnChannel sends a message to the contact with the given
+// nickname on the given channel and returns its MessageID. Channels let
+// applications multiplex several purposes, e.g. chat and presence, over
+// one contact: the channel is encrypted along with the message and
+// delivered with the MessageReceivedEvent. Channel 0 is the channel of
+// SendMessage, other channels are only supported by contacts running
+// a client which decodes them, the message fails to send otherwise.
+func (c *Client) SendMessageOnChannel(nickname string, channel uint8, message []byte) MessageID {
+	convoMesgID, err := c.newMessageID()
+	if err != nil {
+		c.fatalErrCh <- err
+	}
+
+	c.opCh <- &opSendMessage{
+		id:      convoMesgID,
+		name:    nickname,
+		channel: channel,
+		payload: message,
+	}
+
+	return convoMesgID
+}
+
+// AppendHistoricalMessage stores a message in the conversation with the
+// given contact using the given timestamp. It is meant for importing
+// history from other tools: the message bypasses the double ratchet and is
+// never transmitted. ErrMessageExpired is returned if the timestamp is so
+// old that the message would be garbage collected right away.
+func (c *Client) AppendHistoricalMessage(nickname string, plaintext []byte, outbound bool, ts time.Time) (MessageID, error) {
+	convoMesgID, err := c.newMessageID()
+	if err != nil {
+		return convoMesgID, err
+	}
+	op := &opAppendHistoricalMessage{
+		id:   convoMesgID,
+		name: nickname,
+		message: &Message{
+			Plaintext: append([]byte{}, plaintext...),
+			Timestamp: ts,
+			Outbound:  outbound,
+			// historical messages were delivered and read by the original client
+			Delivered: outbound,
+			Read:      !outbound,
+		},
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return convoMesgID, <-op.responseChan
+}
+
+func (c *Client) doAppendHistoricalMessage(convoMesgID MessageID, nickname string, message *Message) error {
+	if c.clock.Now().After(message.Timestamp.Add(MessageExpirationDuration)) {
+		return ErrMessageExpired
+	}
+	c.conversationsMutex.Lock()
+	_, ok := c.conversations[nickname]
+	if !ok {
+		c.conversations[nickname] = make(map[MessageID]*Message)
+	}
+	c.conversations[nickname][convoMesgID] = message
+	c.conversationsMutex.Unlock()
+	c.save()
+	return nil
+}
+
+// SaveNote stores a note to self in the conversation keyed by our own
+// user name. Notes are never transmitted and expire like messages.
+func (c *Client) SaveNote(note []byte) MessageID {
+	convoMesgID, err := c.newMessageID()
+	if err != nil {
+		c.fatalErrCh <- err
+	}
+	c.opCh <- &opSaveNote{
+		id:      convoMesgID,
+		payload: note,
+	}
+	return convoMesgID
+}
+
+func (c *Client) doSaveNote(convoMesgID MessageID, note []byte) {
+	c.conversationsMutex.Lock()
+	_, ok := c.conversations[c.user]
+	if !ok {
+		c.conversations[c.user] = make(map[MessageID]*Message)
+	}
+	c.conversations[c.user][convoMesgID] = &Message{
+		Plaintext: append([]byte{}, note...),
+		Timestamp: c.clock.Now(),
+		Outbound:  true,
+		Delivered: true,
+	}
+	c.conversationsMutex.Unlock()
+	c.save()
+}
+
+// SendMessageByID sends a message to the Client contact with the given
+// contact ID. Unlike the nickname, the ID of a contact never changes.
+// It returns ErrContactNotFound if there is no contact with the ID.
+func (c *Client) SendMessageByID(id uint64, message []byte) (MessageID, error) {
+	convoMesgID, err := c.newMessageID()
+	if err != nil {
+		return convoMesgID, err
+	}
+	op := &opSendMessageByID{
+		id:           convoMesgID,
+		contactID:    id,
+		payload:      message,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return convoMesgID, <-op.responseChan
+}
+
+// SendMessageDurable sends a message to the contact with the given
+// nickname like SendMessage, but returns only once the message and its
+// outbound queue are written to the statefile and synced to disk, such
+// that a crash right after it returns can't lose the message. Each call
+// encrypts and writes the whole statefile and waits for the disk, which
+// takes far longer than SendMessage for a large state: it is meant for
+// the few messages which must not be lost. An error is returned if the
+// message was not queued for the contact, it is then marked as failed,
+// or if the statefile was not written.
+func (c *Client) SendMessageDurable(nickname string, message []byte) (MessageID, error) {
+	convoMesgID, err := c.newMessageID()
+	if err != nil {
+		return convoMesgID, err
+	}
+	op := &opSendMessageDurable{
+		id:           convoMesgID,
+		name:         nickname,
+		payload:      message,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return convoMesgID, <-op.responseChan
+}
+
+func (c *Client) doSendMessageDurable(convoMesgID MessageID, nickname string, message []byte) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.queueMessage(convoMesgID, nickname, 0, message, 0) {
+		return fmt.Errorf("failed to queue message for %s", nickname)
+	}
+	return c.writeState()
+}
+
+func (c *Client) doSendMessageByID(convoMesgID MessageID, id uint64, message []byte) error {
+	contact, ok := c.contacts[id]
+	if !ok {
+		return ErrContactNotFound
+	}
+	c.doSendMessage(convoMesgID, contact.Nickname, 0, message, 0)
+	return nil
+}
+
+func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, channel uint8, message []byte, priority int) {
+	if c.readOnly {
+		// the conversation is left as it is
+		c.log.Errorf("cannot send message to %s: %s", nickname, ErrReadOnly)
+		c.eventCh.In() <- &MessageNotSentEvent{
+			Nickname:  nickname,
+			MessageID: convoMesgID,
+		}
+		return
+	}
+	if c.queueMessage(convoMesgID, nickname, channel, message, priority) {
+		c.save()
+	}
+}
+
+// queueMessage stores the outbound message in the conversation and queues
+// it for the contact, the caller saves the state. It returns false if the
+// message was not sent, it is then marked as failed and saved.
+func (c *Client) queueMessage(convoMesgID MessageID, nickname string, channel uint8, message []byte, priority int) bool {
+	outMessage := Message{
+		Plaintext: append([]byte{}, message...),
+		Timestamp: c.clock.Now(),
+		Outbound:  true,
+		Queued:    c.offline || c.paused,
+		Priority:  priority,
+		Channel:   channel,
+	}
+	c.conversationsMutex.Lock()
+	_, ok := c.conversations[nickname]
+	if !ok {
+		c.conversations[nickname] = make(map[MessageID]*Message)
+	}
+	c.conversations[nickname][convoMesgID] = &outMessage
+	c.conversationsMutex.Unlock()
+	c.trace(convoMesgID, "message to %s stored", nickname)
+
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		c.log.Errorf("contact %s not found", nickname)
+		c.messageNotSent(nickname, convoMesgID)
+		return false
+	}
+	if contact.IsPending {
+		c.log.Errorf("cannot send message, contact %s is pending a key exchange", nickname)
+		c.messageNotSent(nickname, convoMesgID)
+		return false
+	}
+	if c.spoolReadDescriptor == nil {
+		c.log.Errorf("cannot send message to %s: %s", nickname, ErrNoRemoteSpool)
+		c.messageNotSent(nickname, convoMesgID)
+		return false
+	}
+
+	f := &frame{
+		Channel:   channel,
+		Timestamp: outMessage.Timestamp,
+		Message:   message,
+	}
+	if err := c.enqueueFrame(contact, convoMesgID, f, priority); err != nil {
+		c.log.Errorf("failed to send message to %s: %s", nickname, err)
+		c.messageNotSent(nickname, convoMesgID)
+		return false
+	}
+	c.conversationsMutex.Lock()
+	outMessage.Sequence = f.Sequence
+	c.conversationsMutex.Unlock()
+	c.trace(convoMesgID, "message to %s queued with sequence %d", nickname, f.Sequence)
+	return true
+}
+
+// Broadcast sends the message to each of the contacts with the given
+// nicknames in a single operation of the Client. The message is encrypted
+// for each contact separately and stored in each conversation. It returns
+// the IDs of the messages by nickname and the reasons for the contacts
+// which were skipped, e.g. contacts whose key exchange is pending.
+func (c *Client) Broadcast(nicknames []string, message []byte) (map[string]MessageID, map[string]error) {
+	op := &opBroadcast{
+		names:        nicknames,
+		payload:      message,
+		responseChan: make(chan *broadcastResult),
+	}
+	c.opCh <- op
+	r := <-op.responseChan
+	return r.ids, r.skipped
+}
+
+type broadcastResult struct {
+	ids     map[string]MessageID
+	skipped map[string]error
+}
+
+func (c *Client) doBroadcast(nicknames []string, message []byte) *broadcastResult {
+	r := &broadcastResult{
+		ids:     make(map[string]MessageID),
+		skipped: make(map[string]error),
+	}
+	for _, nickname := range nicknames {
+		if _, ok := r.ids[nickname]; ok {
+			continue
+		}
+		contact, ok := c.contactNicknames[nickname]
+		switch {
+		case c.readOnly:
+			r.skipped[nickname] = ErrReadOnly
+			continue
+		case !ok:
+			r.skipped[nickname] = ErrContactNotFound
+			continue
+		case contact.IsPending:
+			r.skipped[nickname] = fmt.Errorf("key exchange with %s is pending", nickname)
+			continue
+		case c.spoolReadDescriptor == nil:
+			r.skipped[nickname] = ErrNoRemoteSpool
+			continue
+		}
+		convoMesgID, err := c.newMessageID()
+		if err != nil {
+			r.skipped[nickname] = err
+			continue
+		}
+		if !c.queueMessage(convoMesgID, nickname, 0, message, 0) {
+			r.skipped[nickname] = fmt.Errorf("failed to queue message for %s", nickname)
+			continue
+		}
+		r.ids[nickname] = convoMesgID
+	}
+	if len(r.ids) > 0 {
+		c.save()
+	}
+	return r
+}
+
+// trace logs a stage of the transmission of the outbound
+// message with the given ID in the conversation.
+func (c *Client) trace(convoMesgID MessageID, format string, args ...interface{}) {
+	c.log.Debugf("trace %x: %s", convoMesgID, fmt.Sprintf(format, args...))
+}
+
+// messageNotSent marks the outbound message as failed
+// and emits a MessageNotSentEvent.
+func (c *Client) messageNotSent(nickname string, convoMesgID MessageID) {
+	c.trace(convoMesgID, "message to %s not sent", nickname)
+	c.updateMessage(nickname, convoMesgID, func(message *Message) {
+		message.Failed = true
+	})
+	c.save()
+	c.eventCh.In() <- &MessageNotSentEvent{
+		Nickname:  nickname,
+		MessageID: convoMesgID,
+	}
+}
+
+// enqueueFrame assigns the next sequence number to the frame, encrypts
+// it for the contact and queues it with the given priority for appending
+// to the remote spool of the contact under the given message ID. Header
+// fields are only sent to contacts which can decode them.
+func (c *Client) enqueueFrame(contact *Contact, convoMesgID MessageID, f *frame, priority int) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if contact.corrupt() {
+		return ErrContactCorrupt
+	}
+	if contact.outbound.Len() >= MaxQueueSize {
+		return ErrQueueFull
+	}
+	if c.orderedDelivery {
+		priority = 0
+	}
+	if f.SetTimer && !contact.disappearing {
+		return fmt.Errorf("%s does not support disappearing messages", contact.Nickname)
+	}
+	if f.ChunkCount != 0 && !contact.fileTransfer {
+		return fmt.Errorf("%s does not support file transfers", contact.Nickname)
+	}
+	if f.SpoolUpdate && !contact.spoolUpdate {
+		return fmt.Errorf("%s does not support spool updates", contact.Nickname)
+	}
+	if f.Channel != 0 && !contact.channels {
+		return fmt.Errorf("%s does not support channels", contact.Nickname)
+	}
+	if contact.frameHeader {
+		f.Sequence = contact.sendSequence + 1
+		f.Compressed = c.compression && contact.compression
+	} else {
+		if f.Edit != 0 {
+			return fmt.Errorf("%s does not support message edits", contact.Nickname)
+		}
+		f.Sequence = 0
+		f.Timestamp = time.Time{}
+		f.Compressed = false
+	}
+	payload, err := f.marshal()
+	if err != nil {
+		return err
+	}
+	contact.ratchetMutex.Lock()
+	ciphertext := contact.ratchet.Encrypt(nil, payload)
+	contact.sendCount++
+	contact.ratchetMutex.Unlock()
+	if c.payloadTransformer != nil {
+		if ciphertext, err = c.payloadTransformer.Transform(ciphertext); err != nil {
+			return err
+		}
+	}
+
+	appendCmd, err := common.AppendToSpool(contact.spoolWriteDescriptor.ID, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	// enqueue the message for sending
+	item := &queuedSpoolCommand{Receiver: contact.spoolWriteDescriptor.Receiver,
+		Provider: contact.spoolWriteDescriptor.Provider,
+		Command:  appendCmd, ID: convoMesgID, Priority: priority}
+	_, err = contact.outbound.Peek()
+	idle := err == ErrQueueEmpty
+	if err := contact.outbound.Push(item); err != nil {
+		return err
+	}
+	if f.Sequence != 0 {
+		contact.sendSequence = f.Sequence
+	}
+	if idle {
+		// no messages already queued, so call sendMessage immediately
+		c.sendMessage(contact)
+	}
+	return nil
+}
+
+// EditMessage replaces the content of an outbound message with the
+// given message, both locally and for the contact. Only messages which
+// carry a sequence number, i.e. sent by this client, can be edited.
+// It returns the ID under which the sent, delivered and failure events
+// of the edit are emitted.
+func (c *Client) EditMessage(nickname string, target MessageID, message []byte) (MessageID, error) {
+	editID, err := c.newMessageID()
+	if err != nil {
+		return editID, err
+	}
+	op := &opEditMessage{
+		id:           editID,
+		target:       target,
+		name:         nickname,
+		payload:      message,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return editID, <-op.responseChan
+}
+
+func (c *Client) doEditMessage(editID, convoMesgID MessageID, nickname string, message []byte) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	c.conversationsMutex.Lock()
+	target, ok := c.conversations[nickname][convoMesgID]
+	if !ok {
+		c.conversationsMutex.Unlock()
+		return ErrMessageNotFound
+	}
+	if !target.Outbound || target.Sequence == 0 {
+		c.conversationsMutex.Unlock()
+		return errors.New("only messages sent by us can be edited")
+	}
+	edit := target.Sequence
+	c.conversationsMutex.Unlock()
+
+	f := &frame{
+		Edit:    edit,
+		Message: message,
+	}
+	if err := c.enqueueFrame(contact, editID, f, 0); err != nil {
+		return err
+	}
+	c.updateMessage(nickname, convoMesgID, func(m *Message) {
+		m.edit(message)
+	})
+	c.save()
+	return nil
+}
+
+// applyEdit replaces the content of the message received from the
+// contact with the given sequence number, edits of unknown or expired
+// messages are ignored.
+func (c *Client) applyEdit(contact *Contact, sequence uint64, message []byte) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	for convoMesgID, m := range c.conversations[contact.Nickname] {
+		if m.Outbound || m.Sequence != sequence {
+			continue
+		}
+		m.edit(message)
+		c.eventCh.In() <- &MessageEditedEvent{
+			Nickname:  contact.Nickname,
+			MessageID: convoMesgID,
+			Message:   message,
+		}
+		return
+	}
+	c.log.Debugf("Ignoring edit of unknown message %d from %s", sequence, contact.Nickname)
+}
+
+// DeleteMessageForEveryone deletes the message with the given ID which
+// we sent to the given contact both from our conversation and from the
+// conversation of the contact. The contact deletes the message once it
+// receives our request, the request is ignored if the contact already
+// deleted the message.
+func (c *Client) DeleteMessageForEveryone(nickname string, id MessageID) error {
+	deleteID, err := c.newMessageID()
+	if err != nil {
+		return err
+	}
+	op := &opDeleteMessageForEveryone{
+		id:           deleteID,
+		target:       id,
+		name:         nickname,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doDeleteMessageForEveryone(deleteID, convoMesgID MessageID, nickname string) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	if !contact.remoteDelete {
+		return fmt.Errorf("%s does not support deleting messages", nickname)
+	}
+	c.conversationsMutex.Lock()
+	target, ok := c.conversations[nickname][convoMesgID]
+	if !ok {
+		c.conversationsMutex.Unlock()
+		return ErrMessageNotFound
+	}
+	if !target.Outbound || target.Sequence == 0 {
+		c.conversationsMutex.Unlock()
+		return errors.New("only messages sent by us can be deleted for everyone")
+	}
+	sequence, priority := target.Sequence, target.Priority
+	c.conversationsMutex.Unlock()
+
+	// the priority of the target queues the delete behind
+	// the target if the target is still queued
+	if err := c.enqueueFrame(contact, deleteID, &frame{Delete: sequence}, priority); err != nil {
+		return err
+	}
+	c.conversationsMutex.Lock()
+	delete(c.conversations[nickname], convoMesgID)
+	c.conversationsMutex.Unlock()
+	c.save()
+	return nil
+}
+
+// applyDelete deletes the message received from the contact with
+// the given sequence number, deletes of unknown or already deleted
+// messages are ignored.
+func (c *Client) applyDelete(contact *Contact, sequence uint64) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	for convoMesgID, m := range c.conversations[contact.Nickname] {
+		if m.Outbound || m.Sequence != sequence {
+			continue
+		}
+		delete(c.conversations[contact.Nickname], convoMesgID)
+		c.eventCh.In() <- &MessageRemotelyDeletedEvent{
+			Nickname:  contact.Nickname,
+			MessageID: convoMesgID,
+		}
+		return
+	}
+	c.log.Debugf("Ignoring delete of unknown message %d from %s", sequence, contact.Nickname)
+}
+
+func (c *Client) sendMessage(contact *Contact) {
+	// Transmit the oldest message on tip of queue; it will be Pop'd upon ACK
+	cmd, err := contact.outbound.Peek()
+	if err == ErrQueueEmpty {
+		c.log.Debugf("No messages to send for contact: %s", contact.Nickname)
+		return
+	}
+	if c.readOnly {
+		c.log.Debugf("Read-only, keeping messages for %s queued", contact.Nickname)
+		return
+	}
+	if c.offline {
+		c.log.Debugf("Offline, keeping messages for %s queued", contact.Nickname)
+		return
+	}
+	if c.paused {
+		c.log.Debugf("Paused, keeping messages for %s queued", contact.Nickname)
+		return
+	}
+
+	// XXX: unfortunately this command does not tell us when to expect the message delivery to have occurred even though minclient knows it...
+	mesgID, err := c.session.SendUnreliableMessage(cmd.Receiver, cmd.Provider, cmd.Command)
+	if err != nil {
+		c.log.Errorf("failed to send ciphertext to remote spool: %s", err)
+		return
+	}
+	c.trace(cmd.ID, "enqueued for sending to %s as mixnet message %x", contact.Nickname, *mesgID)
+	c.storeSent(*mesgID, &SentMessageDescriptor{
+		Nickname:  contact.Nickname,
+		MessageID: cmd.ID,
+	})
+	c.sendsSinceInboxRead++
+	if c.inboxReadInterleave > 0 && c.sendsSinceInboxRead >= c.inboxReadInterleave {
+		// a backlog of outbound messages, e.g. after a reconnect,
+		// must not delay the reading of our remote spool
+		c.sendReadInbox()
+	}
+	attempt := 0
+	c.updateMessage(contact.Nickname, cmd.ID, func(message *Message) {
+		message.Queued = false
+		message.Attempts++
+		attempt = message.Attempts
+	})
+	if attempt > 1 {
+		c.eventCh.In() <- &MessageRetransmitEvent{
+			Nickname:  contact.Nickname,
+			MessageID: cmd.ID,
+			Attempt:   attempt,
+		}
+	}
+}
+
+// Offline stops the transmission of messages and the reading of our remote
+// spool. Messages sent while offline are stored and queued for their
+// contacts, they are transmitted once Online is called. The offline mode
+// is persisted and remains in effect after a restart. Key exchanges which
+// are in progress are not stopped.
+func (c *Client) Offline() {
+	c.opCh <- &opSetOffline{offline: true}
+}
+
+// Online resumes the transmission of messages and
+// flushes the messages queued while offline.
+func (c *Client) Online() {
+	c.opCh <- &opSetOffline{offline: false}
+}
+
+func (c *Client) doSetOffline(offline bool) {
+	c.offline = offline
+	c.save()
+	if offline {
+		c.log.Info("Going offline.")
+		return
+	}
+	c.log.Info("Going online.")
+	c.flushQueues()
+}
+
+// Pause stops the network activity of the Client, e.g. while a mobile
+// application is in the background, without shutting it down. The
+// operations of the Client keep being applied to its state while paused,
+// messages sent are stored and queued for their contacts and are
+// transmitted once Resume is called. Unlike Offline the pause is not
+// persisted, a paused Client which is shut down keeps its queued
+// messages in the statefile and transmits them after the next Start.
+// Key exchanges which are in progress are not paused.
+func (c *Client) Pause() {
+	c.opCh <- &opSetPaused{paused: true}
+}
+
+// Resume resumes the network activity stopped by Pause and
+// flushes the messages queued while paused.
+func (c *Client) Resume() {
+	c.opCh <- &opSetPaused{paused: false}
+}
+
+func (c *Client) doSetPaused(paused bool) {
+	c.paused = paused
+	if paused {
+		c.log.Info("Pausing.")
+		return
+	}
+	c.log.Info("Resuming.")
+	c.flushQueues()
+}
+
+// flushQueues transmits the queued messages of the
+// contacts whose key exchange has completed.
+func (c *Client) flushQueues() {
+	for _, contact := range c.contacts {
+		if !contact.IsPending {
+			c.sendMessage(contact)
+		}
+	}
+}
+
+// OutboundBacklog returns the number of undelivered outbound
+// messages per contact for the contacts which have any.
+func (c *Client) OutboundBacklog() map[string]int {
+	op := &opOutboundBacklog{
+		responseChan: make(chan map[string]int),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doOutboundBacklog() map[string]int {
+	backlog := make(map[string]int)
+	for _, contact := range c.contacts {
+		if n := contact.outbound.Len(); n > 0 {
+			backlog[contact.Nickname] = n
+		}
+	}
+	return backlog
+}
+
+// RetransmitAll transmits the undelivered messages of every contact
+// whose key exchange has completed, e.g. after a reconnect. It returns
+// the number of undelivered messages per contact.
+func (c *Client) RetransmitAll() (map[string]int, error) {
+	op := &opRetransmitAll{
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return nil, r
+	case map[string]int:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doRetransmitAll() interface{} {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if c.offline {
+		return errors.New("cannot retransmit while offline")
+	}
+	if c.paused {
+		return errors.New("cannot retransmit while paused")
+	}
+	summary := make(map[string]int)
+	for _, contact := range c.contacts {
+		if contact.IsPending {
+			continue
+		}
+		if contact.rtx != nil {
+			contact.rtx.Stop()
+		}
+		c.sendMessage(contact)
+		if n := contact.outbound.Len(); n > 0 {
+			summary[contact.Nickname] = n
+		}
+	}
+	return summary
+}
+
+// ResendMessage retransmits the outbound message with the given ID to
+// the contact right away, e.g. after its delivery failed. Messages are
+// acknowledged in the order of the queue of the contact, so only the
+// message at the tip of the queue can be resent, the messages behind it
+// are sent once it is delivered. It fails if the message is delivered or
+// if it is no longer queued, e.g. because the remote spool rejected it.
+func (c *Client) ResendMessage(nickname string, id MessageID) error {
+	op := &opResendMessage{
+		name:         nickname,
+		id:           id,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doResendMessage(nickname string, id MessageID) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	c.conversationsMutex.Lock()
+	message, ok := c.conversations[nickname][id]
+	var outbound, delivered bool
+	if ok {
+		outbound, delivered = message.Outbound, message.Delivered
+	}
+	c.conversationsMutex.Unlock()
+	switch {
+	case !ok || !outbound:
+		return ErrMessageNotFound
+	case delivered:
+		return errors.New("message is already delivered")
+	case c.readOnly:
+		return ErrReadOnly
+	case c.offline:
+		return errors.New("cannot resend while offline")
+	case c.paused:
+		return errors.New("cannot resend while paused")
+	}
+	switch i := contact.outbound.Index(id); {
+	case i < 0:
+		return errors.New("message is no longer queued")
+	case i > 0:
+		return fmt.Errorf("message is queued behind %d messages", i)
+	}
+	if contact.rtx != nil {
+		contact.rtx.Stop()
+	}
+	c.trace(id, "resending message to %s", nickname)
+	c.sendMessage(contact)
+	return nil
+}
+
+// CheckSpool verifies that our remote spool is reachable by reading
+// the message at our current read offset. It blocks until the spool
+// service replies, the round trip timeout is reached or ctx is done.
+func (c *Client) CheckSpool(ctx context.Context) error {
+	return c.checkSpool(ctx, "")
+}
+
+// CheckContactSpool verifies that the remote spool of the given contact is
+// reachable. Since we can't read from the spool of a contact and writing to
+// it would deliver a message, it issues a read which the spool service
+// rejects and only verifies that the spool service replies.
+func (c *Client) CheckContactSpool(ctx context.Context, nickname string) error {
+	return c.checkSpool(ctx, nickname)
+}
+
+func (c *Client) checkSpool(ctx context.Context, nickname string) error {
+	op := &opSpoolCheckCommand{
+		name:         nickname,
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	var cmd *queuedSpoolCommand
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return r
+	case *queuedSpoolCommand:
+		cmd = r
+	default:
+		panic("BUG, unexpected response type")
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		reply, err := c.session.BlockingSendUnreliableMessage(cmd.Receiver, cmd.Provider, cmd.Command)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		spoolResponse, err := common.SpoolResponseFromBytes(reply)
+		if err == nil && nickname == "" && !spoolResponse.IsOK() {
+			// our own spool must accept the read
+			err = fmt.Errorf("remote spool error: %s", spoolResponse.Status)
+		}
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// doSpoolCheckCommand returns the spool command used to check the remote
+// spool of the given contact, or our own spool if nickname is empty.
+func (c *Client) doSpoolCheckCommand(nickname string) interface{} {
+	if c.offline {
+		return errors.New("cannot check spool while offline")
+	}
+	if c.paused {
+		return errors.New("cannot check spool while paused")
+	}
+	if nickname == "" {
+		if c.spoolReadDescriptor == nil {
+			return ErrNoRemoteSpool
+		}
+		cmd, err := common.ReadFromSpool(c.spoolReadDescriptor.ID, c.spoolReadDescriptor.ReadOffset, c.spoolReadDescriptor.PrivateKey)
+		if err != nil {
+			return err
+		}
+		return &queuedSpoolCommand{
+			Receiver: c.spoolReadDescriptor.Receiver,
+			Provider: c.spoolReadDescriptor.Provider,
+			Command:  cmd,
+		}
+	}
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	privKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return err
+	}
+	cmd, err := common.ReadFromSpool(contact.spoolWriteDescriptor.ID, 0, privKey)
+	if err != nil {
+		return err
+	}
+	return &queuedSpoolCommand{
+		Receiver: contact.spoolWriteDescriptor.Receiver,
+		Provider: contact.spoolWriteDescriptor.Provider,
+		Command:  cmd,
+	}
+}
+
+func (c *Client) sendReadInbox() {
+	if c.spoolReadDescriptor == nil {
+		// the creation of the remote spool was deferred
+		c.log.Debug("Remote spool not created yet, not reading it")
+		return
+	}
+	if c.offline {
+		c.log.Debug("Offline, not reading remote spool")
+		return
+	}
+	if c.paused {
+		c.log.Debug("Paused, not reading remote spool")
+		return
+	}
+	if c.maxInboxReads > 0 && len(c.inboxReads) >= c.maxInboxReads {
+		c.log.Debug("Awaiting replies to %d reads of the remote spool, not reading it", len(c.inboxReads))
+		return
+	}
+	sequence := c.spoolReadDescriptor.ReadOffset
+	cmd, err := common.ReadFromSpool(c.spoolReadDescriptor.ID, sequence, c.spoolReadDescriptor.PrivateKey)
+	if err != nil {
+		c.fatalErrCh <- errors.New("failed to compose spool read command")
+		return
+	}
+	mesgID, err := c.session.SendUnreliableMessage(c.spoolReadDescriptor.Receiver, c.spoolReadDescriptor.Provider, cmd)
+	if err != nil {
+		c.log.Error("failed to send inbox retrieval message")
+		return
+	}
+	c.log.Debug("Message enqueued for reading remote spool %x:%d, message-ID: %x", c.spoolReadDescriptor.ID, sequence, mesgID)
+	var a MessageID
+	binary.BigEndian.PutUint32(a[:4], sequence)
+	c.storeSent(*mesgID, &SentMessageDescriptor{Nickname: c.user, MessageID: a})
+	c.inboxReads[*mesgID] = struct{}{}
+	c.sendsSinceInboxRead = 0
+}
+
+func (c *Client) garbageCollectSendMap(gcEvent *client.MessageIDGarbageCollected) {
+	c.log.Debug("Garbage Collecting Message ID %x", gcEvent.MessageID[:])
+	c.deleteSent(gcEvent.MessageID)
+	// the reply to a read of our remote spool will not arrive anymore
+	delete(c.inboxReads, gcEvent.MessageID)
+}
+
+// storeSent adds the descriptor of the message sent
+// with the given mixnet message ID to the sendMap.
+func (c *Client) storeSent(mesgID [cConstants.MessageIDLength]byte, desc *SentMessageDescriptor) {
+	desc.Timestamp = c.clock.Now()
+	if _, loaded := c.sendMap.LoadOrStore(mesgID, desc); loaded {
+		c.sendMap.Store(mesgID, desc)
+		return
+	}
+	atomic.AddInt64(&c.sendMapSize, 1)
+}
+
+// deleteSent removes the message sent with the
+// given mixnet message ID from the sendMap.
+func (c *Client) deleteSent(mesgID [cConstants.MessageIDLength]byte) {
+	if _, ok := c.sendMap.Load(mesgID); !ok {
+		return
+	}
+	c.sendMap.Delete(mesgID)
+	atomic.AddInt64(&c.sendMapSize, -1)
+}
+
+// SendMapSize returns the number of sent messages which await their
+// reply or their garbage collection by the mixnet client, for debugging.
+func (c *Client) SendMapSize() int {
+	return int(atomic.LoadInt64(&c.sendMapSize))
+}
+
+// sweepSendMap removes the entries of the sendMap older than SendMapTTL
+// whose garbage collection event from the mixnet client went missing.
+// The replies to messages are expected long before the TTL.
+func (c *Client) sweepSendMap() {
+	cutoff := c.clock.Now().Add(-SendMapTTL)
+	c.sendMap.Range(func(key, value interface{}) bool {
+		mesgID := key.([cConstants.MessageIDLength]byte)
+		if desc, ok := value.(*SentMessageDescriptor); ok && desc.Timestamp.Before(cutoff) {
+			c.log.Debugf("Sweeping stale sendMap entry %x", mesgID)
+			c.deleteSent(mesgID)
+			delete(c.inboxReads, mesgID)
+		}
+		return true
+	})
+}
+
+func (c *Client) handleSent(sentEvent *client.MessageSentEvent) {
+	orig, ok := c.sendMap.Load(*sentEvent.MessageID)
+	if ok {
+		switch tp := orig.(type) {
+		case *SentMessageDescriptor:
+			if tp.Nickname == c.user { // ack for readInbox
+				if sentEvent.Err != nil {
+					c.log.Debugf("readInbox command %x failed with %s", *sentEvent.MessageID, sentEvent.Err)
+					delete(c.inboxReads, *sentEvent.MessageID)
+				} else {
+					c.log.Debugf("readInbox command %x sent", *sentEvent.MessageID)
+				}
+				return
+			}
+
+			// since the retransmission occurs per contact
+			// set a timer on the contact
+			if contact, ok := c.contactNicknames[tp.Nickname]; !ok {
+				panic("contact not found")
+			} else {
+				if sentEvent.Err != nil {
+					c.trace(tp.MessageID, "mixnet message %x to %s failed: %s", *sentEvent.MessageID, tp.Nickname, sentEvent.Err)
+					// XXX: need to do something to resume transmission...
+					if contact.rtx != nil {
+						contact.rtx.Stop()
+					}
+					c.eventCh.In() <- &MessageNotSentEvent{
+						Nickname:  tp.Nickname,
+						MessageID: tp.MessageID,
+					}
+					c.opCh <- &opRetransmit{contact: contact}
+					return
+				}
+
+				c.log.Debugf("Sending new msg and resetting timer")
+				if contact.rtx != nil {
+					contact.rtx.Stop()
+				}
+				contact.rtx = time.AfterFunc(sentEvent.ReplyETA*2+c.pollJitter(), func() {
+					c.opCh <- &opRetransmit{contact: contact}
+				})
+			}
+
+			if _, t := c.transferOf(tp.Nickname, tp.MessageID); t != nil {
+				// chunks report their progress upon delivery
+				return
+			}
+			c.updateMessage(tp.Nickname, tp.MessageID, func(message *Message) {
+				message.Sent = true
+				if message.SentAt.IsZero() {
+					message.SentAt = c.clock.Now()
+				}
+			})
+			c.trace(tp.MessageID, "mixnet message %x to %s sent", *sentEvent.MessageID, tp.Nickname)
+			c.eventCh.In() <- &MessageSentEvent{
+				Nickname:  tp.Nickname,
+				MessageID: tp.MessageID,
+			}
+		default:
+			c.fatalErrCh <- errors.New("BUG, sendMap entry has incorrect type")
+		}
+	}
+}
+
+// handleSpoolWriteFailure marks the message as failed when the remote
+// spool of the contact rejected it. The rejected message is removed from
+// the queue such that the following messages are sent.
+func (c *Client) handleSpoolWriteFailure(desc *SentMessageDescriptor, status string) {
+	c.trace(desc.MessageID, "spool write for %s failed: %s", desc.Nickname, status)
+	contact, ok := c.contactNicknames[desc.Nickname]
+	if !ok {
+		// the contact was removed, cancelled or renamed since, the
+		// caller removes the entry of the sendMap
+		c.log.Errorf("spool write failed for unknown contact %s: %s", desc.Nickname, status)
+		return
+	}
+	if contact.rtx != nil {
+		contact.rtx.Stop()
+	}
+	if cmd, err := contact.outbound.Peek(); err == nil && cmd.ID == desc.MessageID {
+		contact.outbound.Pop()
+		defer c.sendMessage(contact)
+	}
+	if c.chunkFailed(desc.Nickname, desc.MessageID, fmt.Errorf("spool write failed: %s", status)) {
+		return
+	}
+	c.updateMessage(desc.Nickname, desc.MessageID, func(message *Message) {
+		message.Failed = true
+	})
+	c.save()
+	c.eventCh.In() <- &SpoolWriteFailedEvent{
+		Nickname:  desc.Nickname,
+		MessageID: desc.MessageID,
+		Status:    status,
+	}
+}
+
+// popDelivered pops the delivered message with the given ID off the
+// outbound queue of the contact. It returns false if the message is not
+// the tip of the queue, i.e. if its delivery was acknowledged before,
+// as happens for retransmissions and duplicated spool responses.
+func (c *Client) popDelivered(contact *Contact, mesgID MessageID) bool {
+	cmd, err := contact.outbound.Peek()
+	if err != nil || cmd.ID != mesgID {
+		return false
+	}
+	contact.outbound.Pop()
+	return true
+}
+
+func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
+	if ev, ok := c.sendMap.Load(*replyEvent.MessageID); ok {
+		defer c.deleteSent(*replyEvent.MessageID)
+		switch tp := ev.(type) {
+		case *SentMessageDescriptor:
+			if tp.Nickname == c.user {
+				delete(c.inboxReads, *replyEvent.MessageID)
+			}
+			spoolResponse, err := common.SpoolResponseFromBytes(replyEvent.Payload)
+			if err != nil {
+				c.fatalErrCh <- fmt.Errorf("BUG, invalid spool response, error is %s", err)
+				return
+			}
+			if tp.Nickname == c.user && spoolResponse.IsOK() {
+				c.inboxReplied()
+			}
+			if tp.Nickname == c.user && isEmptySpoolResponse(&spoolResponse) {
+				// the remote spool has no message at our read offset
+				c.log.Debugf("Spool response ID %d without message", spoolResponse.MessageID)
+				c.setInboxDrained()
+				return
+			}
+			if !spoolResponse.IsOK() {
+				c.log.Errorf("Spool response ID %d status error: %s for SpoolID %x",
+					spoolResponse.MessageID, spoolResponse.Status, spoolResponse.SpoolID)
+				if tp.Nickname != c.user {
+					c.handleSpoolWriteFailure(tp, spoolResponse.Status)
+				}
+				return
+			}
+			if tp.Nickname != c.user {
+				// Is a Message Delivery acknowledgement for a spool write
+				c.trace(tp.MessageID, "mixnet message %x delivered to %s", *replyEvent.MessageID, tp.Nickname)
+				popped := false
+				// cancel retransmission timer
+				if contact, ok := c.contactNicknames[tp.Nickname]; ok {
+					// cancel the retransmission timer
+					if contact.rtx != nil {
+						contact.rtx.Stop()
+					}
+					if c.chunkDelivered(tp.Nickname, tp.MessageID) {
+						// queue the next chunks while the delivered chunk is
+						// still the tip of the queue such that enqueueFrame
+						// leaves the transmission to sendMessage below
+						c.queueTransfers(contact)
+						if c.popDelivered(contact, tp.MessageID) {
+							defer c.sendMessage(contact)
+						}
+						return
+					}
+					c.queueTransfers(contact)
+					popped = c.popDelivered(contact, tp.MessageID)
+					if !popped {
+						// a retransmission or a duplicated spool response
+						c.log.Debugf("Duplicate ACK received for %s with MessageID %x",
+							contact.Nickname, *replyEvent.MessageID)
+					} else {
+						// try to send the next message, if one exists
+						defer c.sendMessage(contact)
+					}
+				} else {
+					// the contact was removed while the write was in flight
+					c.log.Debugf("Delivery of message %x to removed contact %s", tp.MessageID, tp.Nickname)
+					return
+				}
+				ttl := c.contactNicknames[tp.Nickname].disappearingTimer
+				var sentAt time.Time
+				wasDelivered := false
+				found := c.updateMessage(tp.Nickname, tp.MessageID, func(message *Message) {
+					sentAt = message.SentAt
+					if sentAt.IsZero() {
+						sentAt = message.Timestamp
+					}
+					wasDelivered = message.Delivered
+					if !message.Delivered {
+						message.DeliveredAt = c.clock.Now()
+					}
+					message.Delivered = true
+					message.Failed = false
+					if ttl > 0 && message.Expires.IsZero() {
+						message.Expires = c.clock.Now().Add(ttl)
+					}
+				})
+				if wasDelivered || !found && !popped {
+					// the delivery was reported already
+					return
+				}
+				if found {
+					c.logDelivery(tp.Nickname, tp.MessageID, sentAt)
+				}
+				c.eventCh.In() <- &MessageDeliveredEvent{
+					Nickname:  tp.Nickname,
+					MessageID: tp.MessageID,
+				}
+				return
+			}
+
+			// is a valid response to the tip of our spool, so increment the pointer
+			off := binary.BigEndian.Uint32(tp.MessageID[:4])
+
+			c.log.Debugf("Got a valid spool response: %d, status: %s, len %d in response to: %d", spoolResponse.MessageID, spoolResponse.Status, len(spoolResponse.Message), off)
+			switch {
+			case spoolResponse.MessageID < c.spoolReadDescriptor.ReadOffset:
+				return // dup
+			case spoolResponse.MessageID == c.spoolReadDescriptor.ReadOffset:
+				c.spoolReadDescriptor.IncrementOffset()
+				c.inboxDrained = false
+				c.eventCh.In() <- &SpoolOffsetAdvancedEvent{
+					Previous: spoolResponse.MessageID,
+					Offset:   c.spoolReadDescriptor.ReadOffset,
+				}
+				c.log.Debugf("Calling decryptMessage(%x, xx)", *replyEvent.MessageID)
+				if !c.decryptMessage(replyEvent.MessageID, spoolResponse.Message) {
+					c.log.Debugf("failure to decrypt tip of spool - MessageID: %x", *replyEvent.MessageID)
+				} else {
+					c.save()
+				}
+			default:
+				panic("received spool response for MessageID not requested yet")
+			}
+			return
+		default:
+			c.fatalErrCh <- errors.New("BUG, sendMap entry has incorrect type")
+			return
+		}
+	}
+}
+
+// isEmptySpoolResponse returns true if the spool response is
+// a successful read which found no message at the read offset.
+func isEmptySpoolResponse(spoolResponse *common.SpoolResponse) bool {
+	return spoolResponse.IsOK() && len(spoolResponse.Message) == 0
+}
+
+// setInboxDrained emits an InboxDrainedEvent once each time
+// all pending messages have been read from our remote spool.
+func (c *Client) setInboxDrained() {
+	if c.inboxDrained {
+		return
+	}
+	c.inboxDrained = true
+	c.eventCh.In() <- &InboxDrainedEvent{}
+}
+
+// inboxReplied records a valid reply to a read of our remote spool.
+func (c *Client) inboxReplied() {
+	c.lastInboxReply = c.clock.Now()
+	if c.inboxStalled {
+		c.log.Info("Reads of the remote spool are answered again.")
+		c.inboxStalled = false
+	}
+}
+
+// checkInboxStall watches the replies to the reads of our remote spool.
+// If none of the reads is answered validly within the inboxStallTimeout
+// while we poll the spool, e.g. because the provider of the spool keeps
+// returning errors, the read offset can't advance and no message is
+// received. An InboxStalledEvent is emitted once and the outstanding
+// reads are abandoned, it returns true if the spool is to be read again
+// right away.
+func (c *Client) checkInboxStall(connected bool) bool {
+	now := c.clock.Now()
+	polling := connected && !c.offline && !c.paused && c.spoolReadDescriptor != nil
+	if !polling || c.inboxStallTimeout == 0 || c.lastInboxReply.IsZero() {
+		// only the time spent polling counts
+		c.lastInboxReply = now
+		return false
+	}
+	if c.inboxStalled || now.Sub(c.lastInboxReply) < c.inboxStallTimeout {
+		return false
+	}
+	c.inboxStalled = true
+	c.log.Errorf("No valid reply to the reads of the remote spool since %s", c.lastInboxReply)
+	c.eventCh.In() <- &InboxStalledEvent{
+		Since:  c.lastInboxReply,
+		Offset: c.spoolReadDescriptor.ReadOffset,
+	}
+	for mesgID := range c.inboxReads {
+		delete(c.inboxReads, mesgID)
+	}
+	return true
+}
+
+// GetConversation returns a copy of the conversation with the given
+// contact which doesn't share any memory with the Client.
+func (c *Client) GetConversation(nickname string) map[MessageID]*Message {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	messages, ok := c.conversations[nickname]
+	if !ok {
+		return nil
+	}
+	conversation := make(map[MessageID]*Message, len(messages))
+	for mesgID, message := range messages {
+		conversation[mesgID] = message.clone()
+	}
+	return conversation
+}
+
+// GetMessage returns a copy of the message with the given ID from the
+// conversation with the given contact. The returned bool is false if
+// either the conversation or the message does not exist.
+func (c *Client) GetMessage(nickname string, id MessageID) (*Message, bool) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	message, ok := c.conversations[nickname][id]
+	if !ok {
+		return nil, false
+	}
+	return message.clone(), true
+}
+
+// Summary is an overview of the state of a Client.
+type Summary struct {
+	// Contacts is the number of contacts.
+	Contacts int
+	// PendingContacts is the number of contacts
+	// whose key exchange has not completed.
+	PendingContacts int
+	// Conversations is the number of conversations.
+	Conversations int
+	// Messages is the number of stored messages of all conversations.
+	Messages int
+	// ReadOffset is the read offset of our remote spool,
+	// zero if the remote spool was not created yet.
+	ReadOffset uint32
+}
+
+// Summary returns an overview of the state of the Client,
+// e.g. to confirm that a statefile was loaded as expected.
+func (c *Client) Summary() Summary {
+	op := &opSummary{
+		responseChan: make(chan Summary),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doSummary() Summary {
+	summary := Summary{
+		Contacts: len(c.contacts),
+	}
+	for _, contact := range c.contacts {
+		if contact.IsPending {
+			summary.PendingContacts++
+		}
+	}
+	if c.spoolReadDescriptor != nil {
+		summary.ReadOffset = c.spoolReadDescriptor.ReadOffset
+	}
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	summary.Conversations = len(c.conversations)
+	for _, messages := range c.conversations {
+		summary.Messages += len(messages)
+	}
+	return summary
+}
+
+// ReadOffset returns the read offset of our remote spool,
+// zero if the remote spool was not created yet.
+func (c *Client) ReadOffset() uint32 {
+	return c.Summary().ReadOffset
+}
+
+// SetReadOffset sets the read offset of our remote spool for the
+// recovery from a desynchronization, it requires the Client to be
+// created WithMaintenance. Rewinding the offset makes the Client read
+// and decrypt the messages again, which fails for the messages whose
+// ratchet keys were already used. Skipping ahead loses the skipped
+// messages for good.
+func (c *Client) SetReadOffset(offset uint32) error {
+	op := &opSetReadOffset{
+		offset:       offset,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doSetReadOffset(offset uint32) error {
+	if !c.maintenance {
+		return ErrNotMaintenance
+	}
+	if c.spoolReadDescriptor == nil {
+		return ErrNoRemoteSpool
+	}
+	previous := c.spoolReadDescriptor.ReadOffset
+	c.log.Warningf("Setting the read offset of our remote spool from %d to %d", previous, offset)
+	// the replies to the reads at the previous offset are ignored
+	for mesgID := range c.inboxReads {
+		c.deleteSent(mesgID)
+		delete(c.inboxReads, mesgID)
+	}
+	c.spoolReadDescriptor.ReadOffset = offset
+	c.inboxDrained = false
+	c.save()
+	return nil
+}
+
+// ContactState is the state of a contact and its conversation as
+// rendered by a chat list.
+type ContactState int
+
+const (
+	// ContactPending is the state of a contact
+	// whose key exchange has not been completed.
+	ContactPending ContactState = iota
+	// ContactEstablishedEmpty is the state of a contact whose key
+	// exchange has completed and whose conversation has no message yet.
+	ContactEstablishedEmpty
+	// ContactActive is the state of a contact whose
+	// conversation has at least one message.
+	ContactActive
+)
+
+// String returns the name of the ContactState.
+func (s ContactState) String() string {
+	switch s {
+	case ContactPending:
+		return "pending"
+	case ContactEstablishedEmpty:
+		return "established-empty"
+	case ContactActive:
+		return "active"
+	default:
+		return fmt.Sprintf("ContactState(%d)", int(s))
+	}
+}
+
+// contactState returns the ContactState of the contact,
+// it must be called with conversationsMutex held.
+func (c *Client) contactState(contact *Contact) ContactState {
+	switch {
+	case contact.IsPending:
+		return ContactPending
+	case len(c.conversations[contact.Nickname]) == 0:
+		return ContactEstablishedEmpty
+	default:
+		return ContactActive
+	}
+}
+
+// ContactPreview is a contact with a preview of the
+// last message of its conversation for a chat list.
+type ContactPreview struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// IsPending is true if the key exchange has not been completed.
+	IsPending bool
+	// State tells a contact which has just been established
+	// from a contact with an ongoing conversation.
+	State ContactState
+	// Muted is true if the contact is muted.
+	Muted bool
+	// Timestamp is the time of the last message,
+	// zero if the conversation has no message.
+	Timestamp time.Time
+	// Preview is the beginning of the last message, at most
+	// PreviewLength bytes without splitting a character.
+	Preview string
+	// Outbound is true if the last message was sent to the contact.
+	Outbound bool
+	// Unread is the number of unread messages.
+	Unread int
+	// LastInboundAt is the time at which the contact sent the most
+	// recent message we received, zero if we received none.
+	LastInboundAt time.Time
+}
+
+// ContactsWithPreview returns the contacts with a preview of the last
+// message of their conversation, the most recent conversation first and
+// the contacts without messages last ordered by nickname.
+func (c *Client) ContactsWithPreview() []ContactPreview {
+	op := &opContactsWithPreview{
+		responseChan: make(chan []ContactPreview),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doContactsWithPreview() []ContactPreview {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	previews := make([]ContactPreview, 0, len(c.contactNicknames))
+	for nickname, contact := range c.contactNicknames {
+		preview := ContactPreview{
+			Nickname:      nickname,
+			IsPending:     contact.IsPending,
+			State:         c.contactState(contact),
+			Muted:         contact.muted,
+			Unread:        c.unreadCount(nickname),
+			LastInboundAt: contact.lastInboundAt,
+		}
+		if messages := c.conversations[nickname]; len(messages) > 0 {
+			ids := sortedMessageIDs(messages)
+			last := messages[ids[len(ids)-1]]
+			preview.Timestamp = last.Timestamp
+			preview.Preview = truncatePreview(last.Plaintext)
+			preview.Outbound = last.Outbound
+		}
+		previews = append(previews, preview)
+	}
+	sort.Slice(previews, func(i, j int) bool {
+		a, b := previews[i], previews[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		return a.Nickname < b.Nickname
+	})
+	return previews
+}
+
+// truncatePreview returns the beginning of the given message
+// with at most PreviewLength bytes of complete characters.
+func truncatePreview(message []byte) string {
+	if len(message) <= PreviewLength {
+		return string(message)
+	}
+	n := PreviewLength
+	for n > 0 && !utf8.RuneStart(message[n]) {
+		n--
+	}
+	return string(message[:n])
+}
+
+// MessageStatus is the delivery status of a message without its content.
+type MessageStatus struct {
+	MessageID   MessageID
+	Timestamp   time.Time
+	Outbound    bool
+	Sent        bool
+	Delivered   bool
+	Failed      bool
+	Attempts    int
+	SentAt      time.Time
+	DeliveredAt time.Time
+}
+
+// ConversationStatuses returns the delivery status of the messages of
+// the conversation with the given contact sorted by timestamp.
+func (c *Client) ConversationStatuses(nickname string) []MessageStatus {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	messages := c.conversations[nickname]
+	statuses := make([]MessageStatus, 0, len(messages))
+	for _, mesgID := range sortedMessageIDs(messages) {
+		message := messages[mesgID]
+		statuses = append(statuses, MessageStatus{
+			MessageID:   mesgID,
+			Timestamp:   message.Timestamp,
+			Outbound:    message.Outbound,
+			Sent:        message.Sent,
+			Delivered:   message.Delivered,
+			Failed:      message.Failed,
+			Attempts:    message.Attempts,
+			SentAt:      message.SentAt,
+			DeliveredAt: message.DeliveredAt,
+		})
+	}
+	return statuses
+}
+
+// DeliveryStatus is the delivery status of an outbound message derived
+// from its flags. The statuses are bits such that they can be combined
+// to query messages with any of them.
+type DeliveryStatus int
+
+const (
+	// StatusPending is the status of messages awaiting their transmission.
+	StatusPending DeliveryStatus = 1 << iota
+	// StatusQueued is the status of messages composed while offline.
+	StatusQueued
+	// StatusSent is the status of messages sent to the remote spool.
+	StatusSent
+	// StatusDelivered is the status of messages written to the remote spool.
+	StatusDelivered
+	// StatusFailed is the status of messages which were not delivered.
+	StatusFailed
+	// StatusReceived is the status of messages which the
+	// contact acknowledged as received.
+	StatusReceived
+
+	// StatusUndelivered matches the messages which are neither
+	// delivered nor failed.
+	StatusUndelivered = StatusPending | StatusQueued | StatusSent
+)
+
+// deliveryStatus returns the DeliveryStatus of the given
+// outbound message, failures take precedence over sending.
+func deliveryStatus(message *Message) DeliveryStatus {
+	switch {
+	case message.Received:
+		return StatusReceived
+	case message.Delivered:
+		return StatusDelivered
+	case message.Failed:
+		return StatusFailed
+	case message.Sent:
+		return StatusSent
+	case message.Queued:
+		return StatusQueued
+	default:
+		return StatusPending
+	}
+}
+
+// MessagesByStatus returns copies of the outbound messages of the
+// conversation with the given contact which have any of the given
+// statuses, e.g. StatusFailed, sorted by timestamp.
+func (c *Client) MessagesByStatus(nickname string, status DeliveryStatus) []*Message {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	messages := c.conversations[nickname]
+	matches := []*Message{}
+	for _, mesgID := range sortedMessageIDs(messages) {
+		message := messages[mesgID]
+		if message.Outbound && deliveryStatus(message)&status != 0 {
+			matches = append(matches, message.clone())
+		}
+	}
+	return matches
+}
+
+// SearchResult identifies a message of a conversation.
+type SearchResult struct {
+	// Nickname is the nickname of the contact of the conversation.
+	Nickname string
+	// MessageID is the key of the message in the conversation.
+	MessageID MessageID
+	// Timestamp is the time of the message.
+	Timestamp time.Time
+	// Expires is the time after which the message is deleted.
+	Expires time.Time
+}
+
+// ExpiringBefore returns the messages which expire before the given
+// time, either because they are older than MessageExpirationDuration
+// by then or because they are disappearing messages, such that a user
+// can be warned and save them, e.g. with ExportConversation. The
+// messages are not deleted, the results are ordered by expiry.
+func (c *Client) ExpiringBefore(t time.Time) []SearchResult {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	results := []SearchResult{}
+	for nickname, messages := range c.conversations {
+		for mesgID, message := range messages {
+			if expires := message.expiresAt(); expires.Before(t) {
+				results = append(results, SearchResult{
+					Nickname:  nickname,
+					MessageID: mesgID,
+					Timestamp: message.Timestamp,
+					Expires:   expires,
+				})
 			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if !a.Expires.Equal(b.Expires) {
+			return a.Expires.Before(b.Expires)
+		}
+		if a.Nickname != b.Nickname {
+			return a.Nickname < b.Nickname
+		}
+		return bytes.Compare(a.MessageID[:], b.MessageID[:]) < 0
+	})
+	return results
+}
+
+// GetAllConversations returns a copy of all conversations which
+// doesn't share any memory with the conversations of the Client.
+func (c *Client) GetAllConversations() map[string]map[MessageID]*Message {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	conversations := make(map[string]map[MessageID]*Message, len(c.conversations))
+	for nickname, messages := range c.conversations {
+		conversation := make(map[MessageID]*Message, len(messages))
+		for mesgID, message := range messages {
+			conversation[mesgID] = message.clone()
+		}
+		conversations[nickname] = conversation
+	}
+	return conversations
+}
+
+// ForEachConversation calls fn with the messages of each conversation
+// sorted by timestamp, the conversations ordered by nickname, until fn
+// returns false. Unlike GetAllConversations it doesn't copy the messages:
+// fn must neither modify nor retain them. fn is called while the
+// conversations are locked, it must not block or call the Client.
+func (c *Client) ForEachConversation(fn func(nickname string, messages []*Message) bool) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	nicknames := make([]string, 0, len(c.conversations))
+	for nickname := range c.conversations {
+		nicknames = append(nicknames, nickname)
+	}
+	sort.Strings(nicknames)
+	for _, nickname := range nicknames {
+		conversation := c.conversations[nickname]
+		messages := make([]*Message, 0, len(conversation))
+		for _, mesgID := range sortedMessageIDs(conversation) {
+			messages = append(messages, conversation[mesgID])
+		}
+		if !fn(nickname, messages) {
 			return
 		}
-		contact.ratchetMutex.Lock()
-		err = contact.ratchet.ProcessKeyExchange(exchange.SignedKeyExchange)
-		contact.ratchetMutex.Unlock()
-		if err != nil {
-			err = fmt.Errorf("Double ratchet key exchange failure: %s", err)
-			c.log.Error(err.Error())
-			contact.pandaResult = err.Error()
-			contact.IsPending = false
-			c.save()
-			c.eventCh.In() <- &KeyExchangeCompletedEvent{
-				Nickname: contact.Nickname,
-				Err:      err,
-			}
+	}
+}
+
+// senderTimestamp returns the time at which the contact sent a message
+// received now. The time claimed by the contact is bounded, such that a
+// skewed clock of the contact can't keep the message from expiring or
+// make it expire right away.
+func (c *Client) senderTimestamp(sent time.Time) time.Time {
+	now := c.clock.Now()
+	switch {
+	case sent.IsZero():
+		// the contact doesn't send timestamps
+		return now
+	case sent.After(now):
+		return now
+	case sent.Before(now.Add(-MaxMessageDelay)):
+		return now.Add(-MaxMessageDelay)
+	}
+	return sent
+}
+
+// checkSequence records the sequence number of a message received from
+// the given contact and emits a MessageGapEvent if messages were skipped.
+func (c *Client) checkSequence(contact *Contact, sequence uint64) {
+	if sequence == 0 {
+		// the contact doesn't send sequence numbers
+		return
+	}
+	if contact.missingSequences[sequence] {
+		// a message sent with a higher priority overtook this one
+		delete(contact.missingSequences, sequence)
+		c.eventCh.In() <- &MessageGapFilledEvent{
+			Nickname: contact.Nickname,
+			Sequence: sequence,
+		}
+		return
+	}
+	if sequence > contact.recvSequence+1 {
+		missing := sequence - contact.recvSequence - 1
+		c.log.Warningf("%d messages from %s are missing", missing, contact.Nickname)
+		first := contact.recvSequence + 1
+		if missing > MaxQueueSize {
+			first = sequence - MaxQueueSize
+		}
+		for s := first; s < sequence; s++ {
+			contact.missingSequences[s] = true
+		}
+		c.eventCh.In() <- &MessageGapEvent{
+			Nickname: contact.Nickname,
+			Missing:  missing,
+		}
+	}
+	if sequence > contact.recvSequence {
+		contact.recvSequence = sequence
+	}
+	// messages are reordered by at most the length of the outbound queue
+	// of the contact, the older ones are lost
+	for s := range contact.missingSequences {
+		if contact.recvSequence-s > MaxQueueSize {
+			delete(contact.missingSequences, s)
+		}
+	}
+}
+
+func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, ciphertext []byte) (decrypted bool) {
+	hash := sha256.Sum256(ciphertext)
+	for _, contact := range c.contacts {
+		if _, ok := contact.seenMessages[hash]; ok {
+			c.log.Debugf("dropping duplicate message ID %x from %s", *messageID, contact.Nickname)
 			return
 		}
-		contact.spoolWriteDescriptor = exchange.SpoolWriteDescriptor
-		contact.IsPending = false
-		c.log.Info("Double ratchet key exchange completed!")
-		c.eventCh.In() <- &KeyExchangeCompletedEvent{
+	}
+	errs := make(map[string]error)
+	for _, contact := range c.trialContacts(ciphertext) {
+		err := c.decryptFrom(contact, hash, ciphertext)
+		if err == nil {
+			return true
+		}
+		errs[contact.Nickname] = err
+	}
+	if c.decryptionFailure != nil && !c.decryptionFailure(*messageID, ciphertext, errs) {
+		c.log.Debugf("trial ratchet decryption failure for message ID %x, dropping it", *messageID)
+		return
+	}
+	c.log.Debugf("trial ratchet decryption failure for message ID %x with %d contacts, quarantining it%s", *messageID, len(errs), formatDecryptionErrors(errs))
+	c.quarantine(ciphertext)
+	return
+}
+
+// formatDecryptionErrors formats the errors of the contacts
+// tried on an inbound message by nickname, one per line.
+func formatDecryptionErrors(errs map[string]error) string {
+	nicknames := make([]string, 0, len(errs))
+	for nickname := range errs {
+		nicknames = append(nicknames, nickname)
+	}
+	sort.Strings(nicknames)
+	var b strings.Builder
+	for _, nickname := range nicknames {
+		fmt.Fprintf(&b, "\n  %s: %s", nickname, errs[nickname])
+	}
+	return b.String()
+}
+
+// trialContacts returns the established contacts in the order in which
+// their ratchets are tried on the ciphertext, see WithDecryptionCandidates.
+func (c *Client) trialContacts(ciphertext []byte) []*Contact {
+	contacts := make([]*Contact, 0, len(c.contacts))
+	for _, contact := range c.contacts {
+		if !contact.IsPending && !contact.corrupt() {
+			contacts = append(contacts, contact)
+		}
+	}
+	if c.decryptionCandidates == nil {
+		return contacts
+	}
+	candidates := c.decryptionCandidates(ciphertext, append([]*Contact{}, contacts...))
+	ordered := make([]*Contact, 0, len(contacts))
+	tried := make(map[uint64]bool)
+	for _, contact := range candidates {
+		// ignore the contacts which were not passed to the hook
+		if contact == nil || c.contacts[contact.id] != contact || contact.IsPending || contact.corrupt() || tried[contact.id] {
+			continue
+		}
+		tried[contact.id] = true
+		ordered = append(ordered, contact)
+	}
+	for _, contact := range contacts {
+		if !tried[contact.id] {
+			ordered = append(ordered, contact)
+		}
+	}
+	return ordered
+}
+
+// RecentlyActiveFirst is a DecryptionCandidatesFunc which orders
+// the contacts by the time of their last message, most recent first.
+func RecentlyActiveFirst(ciphertext []byte, contacts []*Contact) []*Contact {
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return contacts[i].lastInboundAt.After(contacts[j].lastInboundAt)
+	})
+	return contacts
+}
+
+// decryptFrom decrypts the ciphertext with the double ratchet of the given
+// contact and adds the message to the conversation with the contact. It
+// returns an error if the ciphertext is not a message of the contact.
+func (c *Client) decryptFrom(contact *Contact, hash [sha256.Size]byte, ciphertext []byte) error {
+	if c.payloadTransformer != nil {
+		var err error
+		if ciphertext, err = c.payloadTransformer.Inverse(ciphertext); err != nil {
+			return fmt.Errorf("payload transformer: %s", err)
+		}
+	}
+	contact.ratchetMutex.Lock()
+	plaintext, err := contact.ratchet.Decrypt(ciphertext)
+	contact.ratchetMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := parseFrame(plaintext)
+	if err != nil {
+		c.log.Errorf("Message from %s has an invalid frame: %s", contact.Nickname, err)
+		return err
+	}
+	// the inbound limit applies to frames of any kind and precedes their
+	// effects, a dropped message is neither recorded as seen nor acked
+	if c.isFlooding(contact) {
+		c.log.Debugf("Dropping message from %s exceeding the inbound limit", contact.Nickname)
+		return nil
+	}
+	contact.seenMessages[hash] = c.clock.Now()
+	contact.recvCount++
+	c.checkSequence(contact, f.Sequence)
+	if f.SetTimer {
+		c.setDisappearingTimer(contact, f.Timer, true)
+		if len(f.Message) == 0 {
+			return nil
+		}
+	}
+	if f.ChunkCount != 0 {
+		c.receiveChunk(contact, f)
+		return nil
+	}
+	if f.SpoolUpdate {
+		c.applySpoolUpdate(contact, f.Message)
+		return nil
+	}
+	if f.Ack != 0 {
+		c.handleAck(contact, f.Ack)
+		return nil
+	}
+	if f.Edit != 0 {
+		c.applyEdit(contact, f.Edit, f.Message)
+		return nil
+	}
+	if f.Delete != 0 {
+		c.applyDelete(contact, f.Delete)
+		return nil
+	}
+	message := &Message{
+		Plaintext:     f.Message,
+		Sequence:      f.Sequence,
+		Timestamp:     c.senderTimestamp(f.Timestamp),
+		Outbound:      false,
+		Authenticated: true,
+		Channel:       f.Channel,
+	}
+	if contact.disappearingTimer > 0 {
+		message.Expires = c.clock.Now().Add(contact.disappearingTimer)
+	}
+	if message.Timestamp.After(contact.lastInboundAt) {
+		contact.lastInboundAt = message.Timestamp
+	}
+	if c.needsApproval(contact) {
+		c.holdMessage(contact, message)
+		return nil
+	}
+	c.storeReceived(contact, message)
+	return nil
+}
+
+// isFlooding counts a message received from the contact and returns true
+// if the contact sent more than inboundLimit messages within the current
+// inboundWindow, a ContactFloodingEvent is emitted once per window.
+func (c *Client) isFlooding(contact *Contact) bool {
+	if c.inboundLimit <= 0 {
+		return false
+	}
+	now := c.clock.Now()
+	if now.Sub(contact.inboundWindowStart) >= c.inboundWindow {
+		contact.inboundWindowStart = now
+		contact.inboundCount = 0
+	}
+	contact.inboundCount++
+	if contact.inboundCount <= c.inboundLimit {
+		return false
+	}
+	if contact.inboundCount == c.inboundLimit+1 {
+		c.log.Warningf("%s sent more than %d messages within %s", contact.Nickname, c.inboundLimit, c.inboundWindow)
+		c.eventCh.In() <- &ContactFloodingEvent{
 			Nickname: contact.Nickname,
+			Until:    contact.inboundWindowStart.Add(c.inboundWindow),
 		}
 	}
-	c.save()
+	return true
 }
 
-// SendMessage sends a message to the Client contact with the given nickname.
-func (c *Client) SendMessage(nickname string, message []byte) MessageID {
-	convoMesgID := MessageID{}
-	_, err := rand.Reader.Read(convoMesgID[:])
+// storeReceived adds the message received from the contact to the
+// conversation and emits the MessageReceivedEvent. The message is only
+// acknowledged to the contact here, once it is stored, such that held
+// messages which are rejected are never reported as received.
+func (c *Client) storeReceived(contact *Contact, message *Message) {
+	convoMesgID, err := c.newMessageID()
 	if err != nil {
 		c.fatalErrCh <- err
+		return
 	}
-
-	c.opCh <- &opSendMessage{
-		id:      convoMesgID,
-		name:    nickname,
-		payload: message,
+	if message.Sequence != 0 && contact.deliveryAck {
+		c.sendAck(contact, message.Sequence)
+	}
+	c.log.Debugf("Message decrypted for %s: %x", contact.Nickname, convoMesgID)
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	_, ok := c.conversations[contact.Nickname]
+	if !ok {
+		c.conversations[contact.Nickname] = make(map[MessageID]*Message)
 	}
+	c.conversations[contact.Nickname][convoMesgID] = message
 
-	return convoMesgID
+	c.eventCh.In() <- &MessageReceivedEvent{
+		Nickname:  contact.Nickname,
+		MessageID: convoMesgID,
+		Message:   append([]byte{}, message.Plaintext...),
+		Timestamp: message.Timestamp,
+		Muted:     contact.muted,
+		Channel:   message.Channel,
+		// the conversation is created upon the first message
+		IsFirstMessage: !ok,
+	}
 }
 
-func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message []byte) {
-	outMessage := Message{
-		Plaintext: message,
-		Timestamp: time.Now(),
-		Outbound:  true,
+// needsApproval returns true if the messages received from the contact
+// are held until the user approves the contact, i.e. if messages are
+// already held or if the ContactApprovalFunc rejects the first message
+// of a new conversation.
+func (c *Client) needsApproval(contact *Contact) bool {
+	if contact.awaitingApproval {
+		return true
 	}
-	c.conversationsMutex.Lock()
-	_, ok := c.conversations[nickname]
-	if !ok {
-		c.conversations[nickname] = make(map[MessageID]*Message)
+	if c.contactApproval == nil {
+		return false
 	}
-	c.conversations[nickname][convoMesgID] = &outMessage
+	c.conversationsMutex.Lock()
+	_, ok := c.conversations[contact.Nickname]
 	c.conversationsMutex.Unlock()
+	return !ok && !c.contactApproval(contact.Nickname)
+}
 
-	contact, ok := c.contactNicknames[nickname]
-	if !ok {
-		c.log.Errorf("contact %s not found", nickname)
-		return
+// holdMessage keeps the message received from the contact until the
+// user approves or rejects the contact, at most MaxHeldMessages are
+// kept per contact, the oldest first dropped.
+func (c *Client) holdMessage(contact *Contact, message *Message) {
+	if !contact.awaitingApproval {
+		contact.awaitingApproval = true
+		c.eventCh.In() <- &ContactApprovalRequestedEvent{
+			Nickname: contact.Nickname,
+		}
 	}
-	if contact.IsPending {
-		c.log.Errorf("cannot send message, contact %s is pending a key exchange", nickname)
-		return
+	if len(contact.heldMessages) >= MaxHeldMessages {
+		contact.heldMessages[0] = nil
+		contact.heldMessages = contact.heldMessages[1:]
 	}
+	contact.heldMessages = append(contact.heldMessages, message)
+	c.log.Debugf("Holding message from %s until the contact is approved", contact.Nickname)
+}
 
-	payload := [DoubleRatchetPayloadLength]byte{}
-	binary.BigEndian.PutUint32(payload[:4], uint32(len(message)))
-	copy(payload[4:], message)
-	contact.ratchetMutex.Lock()
-	ciphertext := contact.ratchet.Encrypt(nil, payload[:])
-	contact.ratchetMutex.Unlock()
-
-	appendCmd, err := common.AppendToSpool(contact.spoolWriteDescriptor.ID, ciphertext)
-	if err != nil {
-		c.log.Errorf("failed to compute spool append command: %s", err)
-		return
+// ApproveContact adds the messages of the given contact which await the
+// approval of the contact to the conversation and emits their
+// MessageReceivedEvents. Later messages of the contact are not held.
+func (c *Client) ApproveContact(nickname string) error {
+	op := &opApproveContact{
+		name:         nickname,
+		approved:     true,
+		responseChan: make(chan error),
 	}
+	c.opCh <- op
+	return <-op.responseChan
+}
 
-	// enqueue the message for sending
-	item := &queuedSpoolCommand{Receiver: contact.spoolWriteDescriptor.Receiver,
-		Provider: contact.spoolWriteDescriptor.Provider,
-		Command:  appendCmd, ID: convoMesgID}
-	if _, err := contact.outbound.Peek(); err == ErrQueueEmpty {
-		// no messages already queued, so call sendMessage immediately
-		defer c.sendMessage(contact)
-	}
-	if err := contact.outbound.Push(item); err != nil {
-		c.log.Debugf("Failed to enqueue message!")
-		return
+// RejectContact discards the messages of the given contact which await
+// the approval of the contact. The ContactApprovalFunc is consulted again
+// upon the next message of the contact.
+func (c *Client) RejectContact(nickname string) error {
+	op := &opApproveContact{
+		name:         nickname,
+		approved:     false,
+		responseChan: make(chan error),
 	}
-	c.save()
+	c.opCh <- op
+	return <-op.responseChan
 }
 
-func (c *Client) sendMessage(contact *Contact) {
-	// Transmit the oldest message on tip of queue; it will be Pop'd upon ACK
-	cmd, err := contact.outbound.Peek()
-	if err == ErrQueueEmpty {
-		c.log.Debugf("No messages to send for contact: %s", contact.Nickname)
-		return
+func (c *Client) doApproveContact(nickname string, approved bool) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
 	}
-
-	// XXX: unfortunately this command does not tell us when to expect the message delivery to have occurred even though minclient knows it...
-	mesgID, err := c.session.SendUnreliableMessage(cmd.Receiver, cmd.Provider, cmd.Command)
-	if err != nil {
-		c.log.Errorf("failed to send ciphertext to remote spool: %s", err)
-		return
+	if !contact.awaitingApproval {
+		return fmt.Errorf("%s does not await approval", nickname)
 	}
-	c.log.Debug("Message enqueued for sending to %s, message-ID: %x", contact.Nickname, *mesgID)
-	c.sendMap.Store(*mesgID, &SentMessageDescriptor{
-		Nickname:  contact.Nickname,
-		MessageID: cmd.ID,
-	})
+	held := contact.heldMessages
+	contact.awaitingApproval = false
+	contact.heldMessages = nil
+	if approved {
+		for _, message := range held {
+			c.storeReceived(contact, message)
+		}
+	}
+	c.save()
+	return nil
 }
 
-func (c *Client) sendReadInbox() {
-	// apparently never checks to see if the spool has been made first...
-	if c.spoolReadDescriptor == nil {
-		c.log.Errorf("Should not sendReadInbox before the remote spool was made...")
-		return
-	}
-	sequence := c.spoolReadDescriptor.ReadOffset
-	cmd, err := common.ReadFromSpool(c.spoolReadDescriptor.ID, sequence, c.spoolReadDescriptor.PrivateKey)
+// applySpoolUpdate replaces the spool write descriptor of the contact by
+// the one the contact announced after moving its remote spool. Messages
+// which are already queued are still appended to the previous spool.
+func (c *Client) applySpoolUpdate(contact *Contact, message []byte) {
+	desc, err := parseSpoolUpdate(message)
 	if err != nil {
-		c.fatalErrCh <- errors.New("failed to compose spool read command")
+		c.log.Errorf("Ignoring invalid spool update from %s: %s", contact.Nickname, err)
 		return
 	}
-	mesgID, err := c.session.SendUnreliableMessage(c.spoolReadDescriptor.Receiver, c.spoolReadDescriptor.Provider, cmd)
-	if err != nil {
-		c.log.Error("failed to send inbox retrieval message")
+	if current := contact.spoolWriteDescriptor; current != nil && *current == *desc {
 		return
 	}
-	c.log.Debug("Message enqueued for reading remote spool %x:%d, message-ID: %x", c.spoolReadDescriptor.ID, sequence, mesgID)
-	var a MessageID
-	binary.BigEndian.PutUint32(a[:4], sequence)
-	c.sendMap.Store(*mesgID, &SentMessageDescriptor{Nickname: c.user, MessageID: a})
-}
-
-func (c *Client) garbageCollectSendMap(gcEvent *client.MessageIDGarbageCollected) {
-	c.log.Debug("Garbage Collecting Message ID %x", gcEvent.MessageID[:])
-	c.sendMap.Delete(gcEvent.MessageID)
+	c.log.Infof("%s moved its remote spool to %s@%s", contact.Nickname, desc.Receiver, desc.Provider)
+	c.setSpoolWriteDescriptor(contact, desc)
+	c.save()
 }
 
-func (c *Client) handleSent(sentEvent *client.MessageSentEvent) {
-	orig, ok := c.sendMap.Load(*sentEvent.MessageID)
-	if ok {
-		switch tp := orig.(type) {
-		case *SentMessageDescriptor:
-			if tp.Nickname == c.user { // ack for readInbox
-				if sentEvent.Err != nil {
-					c.log.Debugf("readInbox command %x failed with %s", *sentEvent.MessageID, sentEvent.Err)
-				} else {
-					c.log.Debugf("readInbox command %x sent", *sentEvent.MessageID)
-				}
-				return
-			}
-
-			// since the retransmission occurs per contact
-			// set a timer on the contact
-			if contact, ok := c.contactNicknames[tp.Nickname]; !ok {
-				panic("contact not found")
-			} else {
-				if sentEvent.Err != nil {
-					c.log.Debugf("message send for %s failed with err: %s", tp.Nickname, sentEvent.Err)
-					// XXX: need to do something to resume transmission...
-					if contact.rtx != nil {
-						contact.rtx.Stop()
-					}
-					c.eventCh.In() <- &MessageNotSentEvent{
-						Nickname:  tp.Nickname,
-						MessageID: tp.MessageID,
-					}
-					c.opCh <- &opRetransmit{contact: contact}
-					return
-				}
-
-				c.log.Debugf("Sending new msg and resetting timer")
-				if contact.rtx != nil {
-					contact.rtx.Stop()
-				}
-				contact.rtx = time.AfterFunc(sentEvent.ReplyETA*2, func() {
-					c.opCh <- &opRetransmit{contact: contact}
-				})
-			}
+// maxSpoolNameLength bounds the length of the receiver and the
+// provider of a spool write descriptor announced by a contact.
+const maxSpoolNameLength = 255
 
-			c.log.Debugf("MessageSentEvent for %x", *sentEvent.MessageID)
-			c.eventCh.In() <- &MessageSentEvent{
-				Nickname:  tp.Nickname,
-				MessageID: tp.MessageID,
-			}
-		default:
-			c.fatalErrCh <- errors.New("BUG, sendMap entry has incorrect type")
-		}
+// parseSpoolUpdate decodes and validates the spool write
+// descriptor announced by a contact in a spool update.
+func parseSpoolUpdate(message []byte) (*memspoolclient.SpoolWriteDescriptor, error) {
+	desc := new(memspoolclient.SpoolWriteDescriptor)
+	if err := cbor.Unmarshal(message, desc); err != nil {
+		return nil, err
 	}
+	switch {
+	case desc.ID == [common.SpoolIDSize]byte{}:
+		return nil, errors.New("missing spool ID")
+	case desc.Receiver == "" || len(desc.Receiver) > maxSpoolNameLength:
+		return nil, errors.New("invalid spool receiver")
+	case desc.Provider == "" || len(desc.Provider) > maxSpoolNameLength:
+		return nil, errors.New("invalid spool provider")
+	}
+	return desc, nil
 }
 
-func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
-	if ev, ok := c.sendMap.Load(*replyEvent.MessageID); ok {
-		defer c.sendMap.Delete(replyEvent.MessageID)
-		switch tp := ev.(type) {
-		case *SentMessageDescriptor:
-			spoolResponse, err := common.SpoolResponseFromBytes(replyEvent.Payload)
-			if err != nil {
-				c.fatalErrCh <- fmt.Errorf("BUG, invalid spool response, error is %s", err)
-				return
-			}
-			if !spoolResponse.IsOK() {
-				c.log.Errorf("Spool response ID %d status error: %s for SpoolID %x",
-					spoolResponse.MessageID, spoolResponse.Status, spoolResponse.SpoolID)
-				// XXX: should emit an event to the client ? eg spool write failure
-				return
-			}
-			if tp.Nickname != c.user {
-				// Is a Message Delivery acknowledgement for a spool write
-				c.log.Debugf("MessageDeliveredEvent for %s MessageID %x", tp.Nickname, *replyEvent.MessageID)
-				// cancel retransmission timer
-				if contact, ok := c.contactNicknames[tp.Nickname]; ok {
-					// cancel the retransmission timer
-					if contact.rtx != nil {
-						contact.rtx.Stop()
-					}
-					if _, err := contact.outbound.Pop(); err != nil {
-						// duplicate ACK?
-						c.log.Debugf("Maybe duplicate ACK received for %s with MessageID %x",
-							contact.Nickname, *replyEvent.MessageID)
-					} else {
-						// try to send the next message, if one exists
-						defer c.sendMessage(contact)
-					}
-				} else {
-					panic("contact is missing")
-				}
-				c.log.Debugf("Sending MessageDeliveredEvent for %s", tp.Nickname)
-				c.eventCh.In() <- &MessageDeliveredEvent{
-					Nickname:  tp.Nickname,
-					MessageID: tp.MessageID,
-				}
-				return
-			}
-
-			// is a valid response to the tip of our spool, so increment the pointer
-			off := binary.BigEndian.Uint32(tp.MessageID[:4])
-
-			c.log.Debugf("Got a valid spool response: %d, status: %s, len %d in response to: %d", spoolResponse.MessageID, spoolResponse.Status, len(spoolResponse.Message), off)
-			switch {
-			case spoolResponse.MessageID < c.spoolReadDescriptor.ReadOffset:
-				return // dup
-			case spoolResponse.MessageID == c.spoolReadDescriptor.ReadOffset:
-				c.spoolReadDescriptor.IncrementOffset()
-				c.log.Debugf("Calling decryptMessage(%x, xx)", *replyEvent.MessageID)
-				if !c.decryptMessage(replyEvent.MessageID, spoolResponse.Message) {
-					c.log.Debugf("failure to decrypt tip of spool - MessageID: %x", *replyEvent.MessageID)
-				}
-			default:
-				panic("received spool response for MessageID not requested yet")
-			}
-			return
-		default:
-			c.fatalErrCh <- errors.New("BUG, sendMap entry has incorrect type")
-			return
-		}
+// sendAck queues the acknowledgement of the message with the given
+// sequence number received from the contact. Acknowledgements are
+// best effort, they are dropped if the outbound queue is full.
+func (c *Client) sendAck(contact *Contact, sequence uint64) {
+	ackID, err := c.newMessageID()
+	if err != nil {
+		c.log.Errorf("failed to acknowledge message %d of %s: %s", sequence, contact.Nickname, err)
+		return
+	}
+	if err := c.enqueueFrame(contact, ackID, &frame{Ack: sequence}, 0); err != nil {
+		c.log.Debugf("Not acknowledging message %d of %s: %s", sequence, contact.Nickname, err)
 	}
 }
 
-func (c *Client) GetConversation(nickname string) map[MessageID]*Message {
+// handleAck marks the outbound message with the given sequence
+// number as received by the contact which acknowledged it.
+func (c *Client) handleAck(contact *Contact, sequence uint64) {
 	c.conversationsMutex.Lock()
 	defer c.conversationsMutex.Unlock()
-	return c.conversations[nickname]
+	for convoMesgID, message := range c.conversations[contact.Nickname] {
+		if !message.Outbound || message.Sequence != sequence {
+			continue
+		}
+		if message.Received {
+			return
+		}
+		message.Received = true
+		c.eventCh.In() <- &MessageEndToEndDeliveredEvent{
+			Nickname:  contact.Nickname,
+			MessageID: convoMesgID,
+		}
+		return
+	}
+	c.log.Debugf("Ignoring acknowledgement of unknown message %d by %s", sequence, contact.Nickname)
 }
 
-func (c *Client) GetAllConversations() map[string]map[MessageID]*Message {
-	c.conversationsMutex.Lock()
-	defer c.conversationsMutex.Unlock()
-	return c.conversations
+// quarantine keeps a ciphertext which none of our contacts could decrypt,
+// it may be sent by a contact whose key exchange has not completed on our
+// side yet. At most MaxQuarantinedMessages are kept, the oldest first
+// dropped. Quarantined ciphertexts are not persisted.
+func (c *Client) quarantine(ciphertext []byte) {
+	if len(c.quarantined) >= MaxQuarantinedMessages {
+		c.quarantined[0] = nil
+		c.quarantined = c.quarantined[1:]
+	}
+	c.quarantined = append(c.quarantined, append([]byte{}, ciphertext...))
 }
 
-func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, ciphertext []byte) (decrypted bool) {
-	var err error
-	message := Message{}
-	decrypted = false
-	var nickname string
-	for _, contact := range c.contacts {
-		if contact.IsPending {
-			continue
-		}
-		contact.ratchetMutex.Lock()
-		plaintext, err := contact.ratchet.Decrypt(ciphertext)
-		contact.ratchetMutex.Unlock()
-		if err != nil {
-			c.log.Debugf("Decryption err: %s", err.Error())
+// retryQuarantine decrypts the quarantined ciphertexts sent by the given
+// contact, whose key exchange has just completed.
+func (c *Client) retryQuarantine(contact *Contact) {
+	remaining := c.quarantined[:0]
+	for _, ciphertext := range c.quarantined {
+		if c.decryptFrom(contact, sha256.Sum256(ciphertext), ciphertext) == nil {
+			c.log.Debugf("Quarantined message decrypted for %s", contact.Nickname)
 			continue
-		} else {
-			decrypted = true
-			nickname = contact.Nickname
-			payloadLen := binary.BigEndian.Uint32(plaintext[:4])
-			message.Plaintext = plaintext[4 : 4+payloadLen]
-			message.Timestamp = time.Now()
-			message.Outbound = false
-			break
 		}
+		remaining = append(remaining, ciphertext)
 	}
-	if decrypted {
-		convoMesgID := MessageID{}
-		_, err = rand.Reader.Read(convoMesgID[:])
-		if err != nil {
-			c.fatalErrCh <- err
-		}
-		c.log.Debugf("Message decrypted for %s: %x", nickname, convoMesgID)
-		c.conversationsMutex.Lock()
-		defer c.conversationsMutex.Unlock()
-		_, ok := c.conversations[nickname]
-		if !ok {
-			c.conversations[nickname] = make(map[MessageID]*Message)
-		}
-		c.conversations[nickname][convoMesgID] = &message
-
-		c.eventCh.In() <- &MessageReceivedEvent{
-			Nickname:  nickname,
-			Message:   message.Plaintext,
-			Timestamp: message.Timestamp,
-		}
-		return
+	for i := len(remaining); i < len(c.quarantined); i++ {
+		c.quarantined[i] = nil
 	}
-	c.log.Debugf("trial ratchet decryption failure for message ID %x reported ratchet error: %s", *messageID, err)
-	return
+	c.quarantined = remaining
 }
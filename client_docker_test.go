@@ -544,3 +544,97 @@ loop2:
 	alice.Shutdown()
 	bob.Shutdown()
 }
+
+func TestDockerMigrateState(t *testing.T) {
+	require := require.New(t)
+
+	alice := createCatshadowClientWithState(t, createRandomStateFile(t), false)
+	bob := createCatshadowClientWithState(t, createRandomStateFile(t), false)
+
+	sharedSecret := []byte(`migration of the cat shadows`)
+	randBytes := [8]byte{}
+	_, err := rand.Reader.Read(randBytes[:])
+	require.NoError(err)
+	sharedSecret = append(sharedSecret, randBytes[:]...)
+
+	alice.NewContact("bob", sharedSecret)
+	bob.NewContact("alice", sharedSecret)
+
+	bobKXFinishedChan := make(chan bool)
+	bobReceivedMessageChan := make(chan []byte)
+	go func() {
+		for {
+			switch event := (<-bob.EventSink).(type) {
+			case *KeyExchangeCompletedEvent:
+				require.Nil(event.Err)
+				bobKXFinishedChan <- true
+			case *MessageReceivedEvent:
+				require.Equal("alice", event.Nickname)
+				bobReceivedMessageChan <- event.Message
+			default:
+			}
+		}
+	}()
+	aliceKXFinishedChan := make(chan bool)
+	go func() {
+		for {
+			switch event := (<-alice.EventSink).(type) {
+			case *KeyExchangeCompletedEvent:
+				require.Nil(event.Err)
+				aliceKXFinishedChan <- true
+				return
+			default:
+			}
+		}
+	}()
+	<-bobKXFinishedChan
+	<-aliceKXFinishedChan
+
+	// alice moves to a new device
+	passphrase := []byte(`a new phone`)
+	blob, err := alice.ExportState(passphrase)
+	require.NoError(err)
+	alice.Shutdown()
+
+	state, err := ImportState(blob, passphrase)
+	require.NoError(err)
+	catshadowCfg, err := config.LoadFile("testdata/catshadow.toml")
+	require.NoError(err)
+	catshadowCfg.Reunion.Enable = false
+	cfg, err := catshadowCfg.ClientConfig()
+	require.NoError(err)
+	cfg.Account = &cConfig.Account{
+		User:     state.User,
+		Provider: state.Provider,
+	}
+	logBackend, err := catshadowCfg.InitLogBackend()
+	require.NoError(err)
+	c, err := client.New(cfg)
+	require.NoError(err)
+	stateWorker, err := NewStateWriter(c.GetLogger("catshadow_state"), createRandomStateFile(t), []byte(""))
+	require.NoError(err)
+	newAlice, err := New(logBackend, c, stateWorker, state)
+	require.NoError(err)
+	stateWorker.Start()
+	newAlice.Start()
+
+	newAliceReceivedMessageChan := make(chan []byte)
+	go func() {
+		for {
+			switch event := (<-newAlice.EventSink).(type) {
+			case *MessageReceivedEvent:
+				require.Equal("bob", event.Nickname)
+				newAliceReceivedMessageChan <- event.Message
+			default:
+			}
+		}
+	}()
+
+	newAlice.SendMessage("bob", []byte(`Hello from my new phone`))
+	require.Equal([]byte(`Hello from my new phone`), <-bobReceivedMessageChan)
+	bob.SendMessage("alice", []byte(`Nice phone`))
+	require.Equal([]byte(`Nice phone`), <-newAliceReceivedMessageChan)
+
+	newAlice.Shutdown()
+	bob.Shutdown()
+}
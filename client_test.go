@@ -0,0 +1,2377 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// client_test.go - client tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/katzenpost/client"
+	"github.com/katzenpost/client/config"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/client/utils"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	ratchet "github.com/katzenpost/doubleratchet"
+	memspoolclient "github.com/katzenpost/memspool/client"
+	"github.com/katzenpost/memspool/common"
+	panda "github.com/katzenpost/panda/crypto"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/eapache/channels.v1"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestMarshalWhileInserting(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		clock:              realClock{},
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			id := MessageID{byte(i)}
+			err := c.doAppendHistoricalMessage(id, "alice", &Message{
+				Plaintext: []byte("hello"),
+				Timestamp: time.Now(),
+			})
+			assert.NoError(err)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, err := c.marshal()
+		assert.NoError(err)
+	}
+	wg.Wait()
+
+	serialized, err := c.marshal()
+	assert.NoError(err)
+	s2, err := unmarshalState(serialized)
+	assert.NoError(err)
+	assert.Equal(100, len(s2.Conversations["alice"]))
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestGarbageCollectConversations(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &testClock{now: time.Now()}
+	c := &Client{
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		clock:              clock,
+	}
+	err := c.doAppendHistoricalMessage(MessageID{1}, "alice", &Message{
+		Plaintext: []byte("hello"),
+		Timestamp: clock.now,
+	})
+	assert.NoError(err)
+
+	clock.now = clock.now.Add(MessageExpirationDuration - time.Minute)
+	c.garbageCollectConversations()
+	assert.Equal(1, len(c.conversations["alice"]))
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	c.garbageCollectConversations()
+	assert.Equal(0, len(c.conversations["alice"]))
+
+	err = c.doAppendHistoricalMessage(MessageID{2}, "alice", &Message{
+		Plaintext: []byte("hello"),
+		Timestamp: clock.now.Add(-MessageExpirationDuration - time.Minute),
+	})
+	assert.Equal(ErrMessageExpired, err)
+}
+
+func TestApplyEdit(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		eventCh:            channels.NewInfiniteChannel(),
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	c.conversations["alice"] = map[MessageID]*Message{
+		{1}: {Plaintext: []byte("helo"), Sequence: 1},
+		{2}: {Plaintext: []byte("mine"), Sequence: 1, Outbound: true},
+	}
+	alice := &Contact{Nickname: "alice"}
+
+	c.applyEdit(alice, 1, []byte("hello"))
+	assert.Equal([]byte("hello"), c.conversations["alice"][MessageID{1}].Plaintext)
+	assert.Equal([][]byte{[]byte("helo")}, c.conversations["alice"][MessageID{1}].EditHistory)
+	assert.Equal([]byte("mine"), c.conversations["alice"][MessageID{2}].Plaintext)
+	ev := (<-c.eventCh.Out()).(*MessageEditedEvent)
+	assert.Equal(MessageID{1}, ev.MessageID)
+	assert.Equal([]byte("hello"), ev.Message)
+
+	// edits of unknown messages are ignored
+	c.applyEdit(alice, 2, []byte("hello"))
+	assert.Equal(0, c.eventCh.Len())
+}
+
+func TestSenderTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &testClock{now: time.Now()}
+	c := &Client{clock: clock}
+	assert.Equal(clock.now, c.senderTimestamp(time.Time{}))
+	assert.Equal(clock.now, c.senderTimestamp(clock.now.Add(time.Hour)))
+	sent := clock.now.Add(-time.Hour)
+	assert.Equal(sent, c.senderTimestamp(sent))
+	assert.Equal(clock.now.Add(-MaxMessageDelay), c.senderTimestamp(clock.now.Add(-MessageExpirationDuration)))
+}
+
+func TestPrioritySequence(t *testing.T) {
+	assert := assert.New(t)
+
+	// the sender queues three messages, the last one with a higher priority
+	q := new(Queue)
+	for i, priority := range []int{0, 0, 1} {
+		err := q.Push(&queuedSpoolCommand{ID: MessageID{byte(i + 1)}, Priority: priority})
+		assert.NoError(err)
+	}
+
+	c := &Client{
+		eventCh: channels.NewInfiniteChannel(),
+		log:     logging.MustGetLogger("catshadow"),
+	}
+	alice := &Contact{Nickname: "alice", missingSequences: make(map[uint64]bool)}
+	for q.Len() > 0 {
+		cmd, err := q.Pop()
+		assert.NoError(err)
+		c.checkSequence(alice, uint64(cmd.ID[0]))
+	}
+	gap := (<-c.eventCh.Out()).(*MessageGapEvent)
+	assert.Equal(uint64(1), gap.Missing)
+	filled := (<-c.eventCh.Out()).(*MessageGapFilledEvent)
+	assert.Equal(uint64(2), filled.Sequence)
+	assert.Equal(0, len(alice.missingSequences))
+	assert.Equal(uint64(3), alice.recvSequence)
+}
+
+func TestLoadContactsDuplicateNickname(t *testing.T) {
+	assert := assert.New(t)
+
+	newClient := func() *Client {
+		return &Client{
+			contacts:         make(map[uint64]*Contact),
+			contactNicknames: make(map[string]*Contact),
+			eventCh:          channels.NewInfiniteChannel(),
+			log:              logging.MustGetLogger("catshadow"),
+		}
+	}
+
+	contacts := []*Contact{
+		{id: 2, Nickname: "bob"},
+		{id: 1, Nickname: "alice"},
+	}
+	c := newClient()
+	assert.NoError(c.loadContacts(contacts))
+	assert.Equal(uint64(1), c.contactNicknames["alice"].id)
+	assert.Equal(uint64(2), c.contactNicknames["bob"].id)
+	// the contacts of the state are left in order
+	assert.Equal(uint64(2), contacts[0].id)
+
+	// the contact with the higher ID is renamed, avoiding the
+	// nicknames of the other contacts
+	c = newClient()
+	assert.NoError(c.loadContacts([]*Contact{
+		{id: 3, Nickname: "alice"},
+		{id: 1, Nickname: "alice"},
+		{id: 2, Nickname: "alice (2)"},
+	}))
+	assert.Equal(uint64(1), c.contactNicknames["alice"].id)
+	assert.Equal(uint64(2), c.contactNicknames["alice (2)"].id)
+	assert.Equal(uint64(3), c.contactNicknames["alice (3)"].id)
+	assert.Equal("alice (3)", c.contacts[3].Nickname)
+	assert.Equal(&ContactRenamedEvent{
+		Nickname:  "alice",
+		ID:        1,
+		Renamed:   "alice (3)",
+		RenamedID: 3,
+	}, <-c.eventCh.Out())
+
+	// our user name is reserved for the notes to self
+	c = newClient()
+	c.user = "alice"
+	assert.NoError(c.loadContacts([]*Contact{{id: 1, Nickname: "alice"}}))
+	assert.Equal("alice (2)", c.contacts[1].Nickname)
+	assert.Equal(&ContactRenamedEvent{
+		Nickname:  "alice",
+		Renamed:   "alice (2)",
+		RenamedID: 1,
+	}, <-c.eventCh.Out())
+
+	c = newClient()
+	err := c.loadContacts([]*Contact{
+		{id: 1, Nickname: "alice"},
+		{id: 1, Nickname: "bob"},
+	})
+	assert.Error(err)
+}
+
+func TestSendWithoutRemoteSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		eventCh:            channels.NewInfiniteChannel(),
+		contactNicknames:   make(map[string]*Contact),
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		clock:              realClock{},
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	c.contactNicknames["alice"] = &Contact{Nickname: "alice"}
+
+	err := c.createContact("bob", []byte("secret"))
+	assert.Equal(ErrNoRemoteSpool, err)
+
+	c.doSendMessage(MessageID{1}, "alice", 0, []byte("hello"), 0)
+	assert.True(c.conversations["alice"][MessageID{1}].Failed)
+	e := <-c.eventCh.Out()
+	assert.Equal(&MessageNotSentEvent{Nickname: "alice", MessageID: MessageID{1}}, e)
+}
+
+func TestSubscribeContact(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		subscriptions:      make(map[*contactSubscription]struct{}),
+		subscriptionsMutex: new(sync.Mutex),
+	}
+	alice, unsubscribeAlice := c.SubscribeContact("alice")
+	bob, unsubscribeBob := c.SubscribeContact("bob")
+	defer unsubscribeBob()
+
+	c.publishToSubscribers(&MessageSentEvent{Nickname: "alice"})
+	c.publishToSubscribers(&InboxDrainedEvent{})
+	assert.Equal(&MessageSentEvent{Nickname: "alice"}, <-alice)
+	assert.Len(alice, 0)
+	assert.Len(bob, 0)
+
+	unsubscribeAlice()
+	unsubscribeAlice()
+	c.publishToSubscribers(&MessageSentEvent{Nickname: "alice"})
+	c.publishToSubscribers(&MessageSentEvent{Nickname: "bob"})
+	assert.Len(alice, 0)
+	assert.Equal(&MessageSentEvent{Nickname: "bob"}, <-bob)
+}
+
+func TestSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contacts: map[uint64]*Contact{
+			1: {Nickname: "alice"},
+			2: {Nickname: "bob", IsPending: true},
+		},
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {{1}: {}, {2}: {}},
+			"carol": {{3}: {}},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	assert.Equal(Summary{
+		Contacts:        2,
+		PendingContacts: 1,
+		Conversations:   2,
+		Messages:        3,
+	}, c.doSummary())
+}
+
+// memoryStateStore is a StateStore keeping the written
+// states in memory which fails the failAt-th write.
+type memoryStateStore struct {
+	states [][]byte
+	failAt int
+}
+
+func (s *memoryStateStore) WriteState(payload []byte) error {
+	if len(s.states)+1 == s.failAt {
+		s.failAt = 0
+		return errors.New("write failure")
+	}
+	s.states = append(s.states, payload)
+	return nil
+}
+
+func (s *memoryStateStore) Halt() {}
+
+func TestWriteStateFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	store := &memoryStateStore{failAt: 2}
+	c := &Client{
+		stateWorker:        store,
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		clock:              realClock{},
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.NoError(c.writeState())
+	assert.Len(store.states, 1)
+	size := c.StateSize()
+	assert.Equal(len(store.states[0]), size)
+
+	assert.Error(c.writeState())
+	assert.Len(store.states, 1)
+	assert.Equal(size, c.StateSize())
+	assert.Panics(func() {
+		store.failAt = 2
+		c.save()
+	})
+
+	assert.NoError(c.writeState())
+	assert.Len(store.states, 2)
+}
+
+func TestPruneBefore(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Timestamp: now.Add(-2 * time.Hour)},
+				{2}: {Timestamp: now.Add(-2 * time.Hour), Outbound: true},
+				{3}: {Timestamp: now.Add(-2 * time.Hour), Outbound: true, Delivered: true},
+				{4}: {Timestamp: now},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	assert.Equal(2, c.doPruneBefore(now.Add(-time.Hour), false))
+	assert.Len(c.conversations["alice"], 2)
+	assert.Equal(1, c.doPruneBefore(now.Add(-time.Hour), true))
+	assert.Len(c.conversations["alice"], 1)
+	assert.Contains(c.conversations["alice"], MessageID{4})
+}
+
+func TestQuarantine(t *testing.T) {
+	assert := assert.New(t)
+
+	c := new(Client)
+	for i := 0; i <= MaxQuarantinedMessages; i++ {
+		c.quarantine([]byte{byte(i)})
+	}
+	assert.Len(c.quarantined, MaxQuarantinedMessages)
+	assert.Equal([]byte{1}, c.quarantined[0])
+	assert.Equal([]byte{byte(MaxQuarantinedMessages)}, c.quarantined[MaxQuarantinedMessages-1])
+}
+
+func TestExpireMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &testClock{now: time.Now()}
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Plaintext: []byte("gone"), Expires: clock.now.Add(time.Minute)},
+				{2}: {Plaintext: []byte("later"), Expires: clock.now.Add(time.Hour)},
+				{3}: {Plaintext: []byte("kept")},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+		clock:              clock,
+	}
+	gone := c.conversations["alice"][MessageID{1}]
+	clock.now = clock.now.Add(2 * time.Minute)
+	c.expireMessages()
+	assert.Len(c.conversations["alice"], 2)
+	assert.Equal([]byte{0, 0, 0, 0}, gone.Plaintext)
+	assert.NotContains(c.conversations["alice"], MessageID{1})
+}
+
+func TestFileTransferChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		transfers:          make(map[TransferID]*fileTransfer),
+		incomingFiles:      make(map[TransferID]*incomingFile),
+		eventCh:            channels.NewInfiniteChannel(),
+		stateWorker:        &memoryStateStore{},
+		clock:              realClock{},
+		log:                logging.MustGetLogger("catshadow"),
+		conversationsMutex: new(sync.Mutex),
+	}
+	data := make([]byte, fileChunkLength+10)
+	data[fileChunkLength] = 0x42
+	out := &fileTransfer{
+		Nickname: "alice",
+		Filename: "cat.jpg",
+		Data:     data,
+		Pending:  map[MessageID]uint32{{0}: 0, {1}: 1, {2}: 2},
+		Next:     3,
+	}
+	assert.Equal(uint32(3), out.chunkCount())
+	c.transfers[7] = out
+
+	// the chunks arrive out of order at the recipient
+	bob := &Contact{Nickname: "bob"}
+	for _, i := range []uint32{2, 0, 1} {
+		c.receiveChunk(bob, &frame{TransferID: 7, ChunkIndex: i, ChunkCount: 3, Message: out.chunk(i)})
+	}
+	ev := (<-c.eventCh.Out()).(*FileReceivedEvent)
+	assert.Equal("cat.jpg", ev.Filename)
+	assert.Equal(data, ev.Data)
+	assert.Len(c.incomingFiles, 0)
+
+	assert.False(c.chunkDelivered("bob", MessageID{1}))
+	assert.True(c.chunkDelivered("alice", MessageID{2}))
+	progress := (<-c.eventCh.Out()).(*FileTransferProgressEvent)
+	assert.Equal(10, progress.BytesDelivered)
+	assert.Equal(len(data), progress.Total)
+	assert.True(c.chunkDelivered("alice", MessageID{0}))
+	<-c.eventCh.Out()
+	assert.True(c.chunkDelivered("alice", MessageID{1}))
+	progress = (<-c.eventCh.Out()).(*FileTransferProgressEvent)
+	assert.Equal(len(data), progress.BytesDelivered)
+	assert.Len(c.transfers, 0)
+}
+
+func TestContactLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contacts:           make(map[uint64]*Contact),
+		contactNicknames:   make(map[string]*Contact),
+		labels:             make(map[string]map[uint64]*Contact),
+		eventCh:            channels.NewInfiniteChannel(),
+		stateWorker:        &memoryStateStore{},
+		conversationsMutex: new(sync.Mutex),
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.NoError(c.loadContacts([]*Contact{
+		{id: 1, Nickname: "bob", Labels: []string{"work"}},
+		{id: 2, Nickname: "alice", Labels: []string{"family", "work"}},
+		{id: 3, Nickname: "carol"},
+	}))
+	assert.Equal([]ContactInfo{
+		{Nickname: "alice", Labels: []string{"family", "work"}, State: ContactEstablishedEmpty},
+		{Nickname: "bob", Labels: []string{"work"}, State: ContactEstablishedEmpty},
+	}, c.doContactsByLabel("work"))
+
+	assert.Equal(ErrContactNotFound, c.doSetContactLabel("dave", "work", true))
+	assert.NoError(c.doSetContactLabel("carol", "family", true))
+	assert.NoError(c.doSetContactLabel("carol", "family", true))
+	assert.Equal([]string{"family"}, c.contactNicknames["carol"].Labels)
+	assert.NoError(c.doSetContactLabel("alice", "family", false))
+	assert.Equal([]ContactInfo{
+		{Nickname: "carol", Labels: []string{"family"}, State: ContactEstablishedEmpty},
+	}, c.doContactsByLabel("family"))
+	assert.Empty(c.doContactsByLabel("friends"))
+
+	c.doContactRemoval("carol")
+	assert.NotContains(c.labels, "family")
+}
+
+func TestExportState(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := ratchet.InitRatchet(rand.Reader)
+	assert.NoError(err)
+	bob := &Contact{id: 1, Nickname: "bob", ratchet: r, outbound: new(Queue), Labels: []string{"work"}}
+	c := &Client{
+		contacts: map[uint64]*Contact{1: bob},
+		user:     "alice",
+		conversations: map[string]map[MessageID]*Message{
+			"bob": {{1}: {Plaintext: []byte("hello")}},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	blob, ok := c.doExportState([]byte("secret")).([]byte)
+	assert.True(ok)
+
+	state, err := ImportState(blob, []byte("secret"))
+	assert.NoError(err)
+	assert.Equal("alice", state.User)
+	assert.Len(state.Contacts, 1)
+	assert.Equal("bob", state.Contacts[0].Nickname)
+	assert.Equal([]string{"work"}, state.Contacts[0].Labels)
+	assert.Equal([]byte("hello"), state.Conversations["bob"][MessageID{1}].Plaintext)
+
+	_, err = ImportState(blob, []byte("wrong"))
+	assert.Error(err)
+	_, err = ImportState(blob[:saltSize+nonceSize], []byte("secret"))
+	assert.Error(err)
+}
+
+func TestRandomSource(t *testing.T) {
+	assert := assert.New(t)
+
+	// the zero ID and IDs of existing contacts are skipped
+	source := append(make([]byte, 8), 1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0)
+	c := &Client{
+		contacts:   map[uint64]*Contact{1: {id: 1}},
+		randReader: bytes.NewReader(source),
+	}
+	id, err := c.randID()
+	assert.NoError(err)
+	assert.Equal(uint64(2), id)
+
+	// read failures are returned instead of panicking
+	_, err = c.randID()
+	assert.Error(err)
+	_, err = c.newMessageID()
+	assert.Error(err)
+
+	c.randReader = bytes.NewReader([]byte{1, 2, 3, 4})
+	mesgID, err := c.newMessageID()
+	assert.NoError(err)
+	assert.Equal(MessageID{1, 2, 3, 4}, mesgID)
+}
+
+func TestCheckInboxStall(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &testClock{now: time.Now()}
+	c := &Client{
+		spoolReadDescriptor: &memspoolclient.SpoolReadDescriptor{ReadOffset: 3},
+		inboxReads:          map[[cConstants.MessageIDLength]byte]struct{}{{1}: {}},
+		inboxStallTimeout:   10 * time.Minute,
+		eventCh:             channels.NewInfiniteChannel(),
+		clock:               clock,
+		log:                 logging.MustGetLogger("catshadow"),
+	}
+	assert.False(c.checkInboxStall(true))
+	start := clock.now
+
+	// time spent disconnected doesn't count
+	clock.now = clock.now.Add(time.Hour)
+	assert.False(c.checkInboxStall(false))
+	clock.now = clock.now.Add(5 * time.Minute)
+	assert.False(c.checkInboxStall(true))
+	c.inboxReplied()
+
+	clock.now = clock.now.Add(11 * time.Minute)
+	assert.True(c.checkInboxStall(true))
+	assert.Empty(c.inboxReads)
+	ev := (<-c.eventCh.Out()).(*InboxStalledEvent)
+	assert.Equal(uint32(3), ev.Offset)
+	assert.True(ev.Since.After(start))
+
+	// the event is emitted once per stall
+	clock.now = clock.now.Add(11 * time.Minute)
+	assert.False(c.checkInboxStall(true))
+	c.inboxReplied()
+	assert.False(c.inboxStalled)
+}
+
+func TestTotalUnread(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contactNicknames: map[string]*Contact{
+			"alice": {Nickname: "alice"},
+			"bob":   {Nickname: "bob", muted: true},
+		},
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Plaintext: []byte("hi")},
+				{2}: {Plaintext: []byte("there")},
+				{3}: {Plaintext: []byte("hello"), Outbound: true},
+			},
+			"bob": {
+				{4}: {Plaintext: []byte("psst")},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+		stateWorker:        &memoryStateStore{},
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.Equal(2, c.doTotalUnread())
+	c.countMutedAsUnread = true
+	assert.Equal(3, c.doTotalUnread())
+
+	assert.NoError(c.doMarkConversationRead("alice"))
+	assert.Equal(1, c.doTotalUnread())
+	assert.Equal(ErrContactNotFound, c.doMarkConversationRead("carol"))
+}
+
+func TestContactsWithPreview(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	long := strings.Repeat("a", PreviewLength-1) + "ü and more"
+	c := &Client{
+		contactNicknames: map[string]*Contact{
+			"alice": {Nickname: "alice", lastInboundAt: now.Add(-time.Hour)},
+			"bob":   {Nickname: "bob", muted: true},
+			"carol": {Nickname: "carol", IsPending: true},
+			"dave":  {Nickname: "dave"},
+		},
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Plaintext: []byte("hi"), Timestamp: now.Add(-time.Hour)},
+				{2}: {Plaintext: []byte("bye"), Timestamp: now.Add(-time.Minute), Outbound: true},
+			},
+			"bob": {
+				{3}: {Plaintext: []byte(long), Timestamp: now},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	previews := c.doContactsWithPreview()
+	assert.Equal([]ContactPreview{
+		{Nickname: "bob", State: ContactActive, Muted: true, Timestamp: now, Preview: strings.Repeat("a", PreviewLength-1), Unread: 1},
+		{Nickname: "alice", State: ContactActive, Timestamp: now.Add(-time.Minute), Preview: "bye", Outbound: true, Unread: 1, LastInboundAt: now.Add(-time.Hour)},
+		{Nickname: "carol", IsPending: true, State: ContactPending},
+		{Nickname: "dave", State: ContactEstablishedEmpty},
+	}, previews)
+	assert.Equal("established-empty", ContactEstablishedEmpty.String())
+}
+
+func TestBroadcastSkipped(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contactNicknames: map[string]*Contact{
+			"alice": {Nickname: "alice"},
+			"bob":   {Nickname: "bob", IsPending: true},
+		},
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		randReader:         rand.Reader,
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	r := c.doBroadcast([]string{"alice", "bob", "carol"}, []byte("hello"))
+	ids, skipped := r.ids, r.skipped
+	assert.Empty(ids)
+	assert.Len(skipped, 3)
+	assert.Equal(ErrNoRemoteSpool, skipped["alice"])
+	assert.Error(skipped["bob"])
+	assert.Equal(ErrContactNotFound, skipped["carol"])
+	// skipped contacts don't get the message
+	assert.Empty(c.conversations)
+}
+
+// xorTransformer is a PayloadTransformer flipping the bits of payloads
+// and rejecting payloads without its marker byte.
+type xorTransformer struct{}
+
+func (xorTransformer) Transform(ciphertext []byte) ([]byte, error) {
+	payload := []byte{0x42}
+	for _, b := range ciphertext {
+		payload = append(payload, ^b)
+	}
+	return payload, nil
+}
+
+func (xorTransformer) Inverse(payload []byte) ([]byte, error) {
+	if len(payload) == 0 || payload[0] != 0x42 {
+		return nil, errors.New("not transformed")
+	}
+	ciphertext := []byte{}
+	for _, b := range payload[1:] {
+		ciphertext = append(ciphertext, ^b)
+	}
+	return ciphertext, nil
+}
+
+func TestPayloadTransformer(t *testing.T) {
+	assert := assert.New(t)
+
+	var transformer PayloadTransformer = xorTransformer{}
+	payload, err := transformer.Transform([]byte("ciphertext"))
+	assert.NoError(err)
+	ciphertext, err := transformer.Inverse(payload)
+	assert.NoError(err)
+	assert.Equal([]byte("ciphertext"), ciphertext)
+
+	// payloads which the transformer rejects are not decrypted
+	c := &Client{
+		payloadTransformer: transformer,
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.Error(c.decryptFrom(&Contact{Nickname: "alice"}, [32]byte{}, []byte("ciphertext")))
+}
+
+func TestMessagesByStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Plaintext: []byte("a"), Timestamp: now, Outbound: true, Failed: true},
+				{2}: {Plaintext: []byte("b"), Timestamp: now.Add(time.Second), Outbound: true, Sent: true},
+				{3}: {Plaintext: []byte("c"), Timestamp: now.Add(2 * time.Second), Outbound: true, Sent: true, Delivered: true},
+				{4}: {Plaintext: []byte("d"), Timestamp: now.Add(3 * time.Second), Outbound: true, Queued: true},
+				{5}: {Plaintext: []byte("e"), Timestamp: now.Add(4 * time.Second)},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	plaintexts := func(messages []*Message) []string {
+		s := []string{}
+		for _, m := range messages {
+			s = append(s, string(m.Plaintext))
+		}
+		return s
+	}
+	assert.Equal([]string{"a"}, plaintexts(c.MessagesByStatus("alice", StatusFailed)))
+	assert.Equal([]string{"c"}, plaintexts(c.MessagesByStatus("alice", StatusDelivered)))
+	assert.Equal([]string{"b", "d"}, plaintexts(c.MessagesByStatus("alice", StatusUndelivered)))
+	assert.Empty(c.MessagesByStatus("bob", StatusFailed))
+
+	// copies are returned
+	c.MessagesByStatus("alice", StatusFailed)[0].Plaintext[0] = 'x'
+	assert.Equal([]byte("a"), c.conversations["alice"][MessageID{1}].Plaintext)
+}
+
+func TestResendMessageErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	bob := &Contact{Nickname: "bob", outbound: new(Queue)}
+	assert.NoError(bob.outbound.Push(&queuedSpoolCommand{ID: MessageID{1}}))
+	assert.NoError(bob.outbound.Push(&queuedSpoolCommand{ID: MessageID{2}}))
+	c := &Client{
+		contactNicknames: map[string]*Contact{
+			"alice": {Nickname: "alice", IsPending: true},
+			"bob":   bob,
+		},
+		conversations: map[string]map[MessageID]*Message{
+			"bob": {
+				{2}: {Outbound: true, Failed: true},
+				{3}: {Outbound: true, Delivered: true},
+				{4}: {Outbound: true, Failed: true},
+				{5}: {},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	assert.Equal(ErrContactNotFound, c.doResendMessage("carol", MessageID{2}))
+	assert.Error(c.doResendMessage("alice", MessageID{2}))
+	assert.Equal(ErrMessageNotFound, c.doResendMessage("bob", MessageID{5}))
+	assert.Error(c.doResendMessage("bob", MessageID{3}))
+	// rejected by the remote spool
+	assert.Error(c.doResendMessage("bob", MessageID{4}))
+	// behind the tip
+	assert.Error(c.doResendMessage("bob", MessageID{2}))
+}
+
+func TestValidateState(t *testing.T) {
+	assert := assert.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	valid := func() *State {
+		return &State{
+			LinkKey: linkKey,
+			User:    "alice",
+			Contacts: []*Contact{
+				{Nickname: "bob", outbound: new(Queue), ratchet: new(ratchet.Ratchet), spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{}},
+				{Nickname: "carol", outbound: new(Queue), IsPending: true, pandaKeyExchange: []byte{1}},
+			},
+		}
+	}
+	assert.NoError(validateState(valid()))
+	assert.Error(validateState(nil))
+
+	for _, corrupt := range []func(*State){
+		func(s *State) { s.LinkKey = nil },
+		func(s *State) { s.User = "" },
+		func(s *State) { s.Contacts[0] = nil },
+		func(s *State) { s.Contacts[0].outbound = nil },
+		func(s *State) { s.Contacts[0].spoolWriteDescriptor = nil },
+		func(s *State) { s.Contacts[1].pandaKeyExchange = nil },
+		func(s *State) { s.Conversations = map[string]map[MessageID]*Message{"bob": {{1}: nil}} },
+	} {
+		s := valid()
+		corrupt(s)
+		assert.Error(validateState(s))
+	}
+}
+
+func TestNewWithoutConversations(t *testing.T) {
+	assert := assert.New(t)
+
+	logBackend, err := log.New("", "DEBUG", true)
+	assert.NoError(err)
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	bob := &Contact{
+		Nickname:             "bob",
+		id:                   1,
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+	}
+	state := &State{
+		LinkKey:  linkKey,
+		User:     "alice",
+		Contacts: []*Contact{bob},
+	}
+	c, err := New(logBackend, nil, &memoryStateStore{}, state, WithSession(new(fakeSession), make(chan client.Event)))
+	assert.NoError(err)
+
+	c.storeReceived(bob, &Message{Plaintext: []byte("hello")})
+	conversation := c.GetConversation("bob")
+	assert.Len(conversation, 1)
+	for _, message := range conversation {
+		assert.Equal([]byte("hello"), message.Plaintext)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	alice := &Contact{Nickname: "alice", outbound: new(Queue), fileTransfer: true}
+	c := &Client{
+		readOnly:           true,
+		clock:              realClock{},
+		randReader:         rand.Reader,
+		contacts:           map[uint64]*Contact{1: alice},
+		contactNicknames:   map[string]*Contact{"alice": alice},
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		eventCh:            channels.NewInfiniteChannel(),
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	c.doSendMessage(MessageID{1}, "alice", 0, []byte("hello"), 0)
+	assert.Equal(&MessageNotSentEvent{Nickname: "alice", MessageID: MessageID{1}}, <-c.eventCh.Out())
+	assert.Empty(c.conversations)
+
+	assert.Equal(ErrReadOnly, c.createContact("bob", []byte("secret")))
+	assert.Equal(ErrReadOnly, c.doRetransmitAll())
+	assert.Equal(ErrReadOnly, c.doSendFile("alice", "cat.jpg", []byte{1}))
+	assert.Equal(ErrReadOnly, c.doSetDisappearingTimer("alice", time.Hour))
+	assert.Equal(0, alice.outbound.Len())
+}
+
+func TestSweepSendMap(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &testClock{now: time.Now()}
+	c := &Client{
+		sendMap:    new(sync.Map),
+		inboxReads: make(map[[cConstants.MessageIDLength]byte]struct{}),
+		clock:      clock,
+		log:        logging.MustGetLogger("catshadow"),
+	}
+	c.storeSent([cConstants.MessageIDLength]byte{1}, &SentMessageDescriptor{Nickname: "alice"})
+	c.inboxReads[[cConstants.MessageIDLength]byte{1}] = struct{}{}
+	clock.now = clock.now.Add(SendMapTTL / 2)
+	c.storeSent([cConstants.MessageIDLength]byte{2}, &SentMessageDescriptor{Nickname: "bob"})
+	c.storeSent([cConstants.MessageIDLength]byte{2}, &SentMessageDescriptor{Nickname: "bob"})
+	assert.Equal(2, c.SendMapSize())
+
+	clock.now = clock.now.Add(SendMapTTL/2 + time.Second)
+	c.sweepSendMap()
+	assert.Equal(1, c.SendMapSize())
+	assert.Empty(c.inboxReads)
+	_, ok := c.sendMap.Load([cConstants.MessageIDLength]byte{2})
+	assert.True(ok)
+
+	c.deleteSent([cConstants.MessageIDLength]byte{2})
+	c.deleteSent([cConstants.MessageIDLength]byte{2})
+	assert.Equal(0, c.SendMapSize())
+}
+
+// fakeSession is a Session recording the messages sent.
+type fakeSession struct {
+	sent  [][]byte
+	panda *config.Panda
+}
+
+func (s *fakeSession) SendUnreliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	s.sent = append(s.sent, message)
+	mesgID := [cConstants.MessageIDLength]byte{byte(len(s.sent))}
+	return &mesgID, nil
+}
+
+func (s *fakeSession) BlockingSendUnreliableMessage(recipient, provider string, message []byte) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeSession) GetService(serviceName string) (*utils.ServiceDescriptor, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeSession) GetPandaConfig() *config.Panda { return s.panda }
+
+func (s *fakeSession) GetReunionConfig() *config.Reunion { return nil }
+
+func (s *fakeSession) CurrentDocument() *pki.Document { return nil }
+
+// newTestClient creates a Client with New which keeps its state in a
+// memoryStateStore and sends through the returned fakeSession. The
+// Client has a remote spool and no contacts, it isn't started.
+func newTestClient(t *testing.T, opts ...Option) (*Client, *fakeSession) {
+	logBackend, err := log.New("", "DEBUG", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &State{
+		SpoolReadDescriptor: &memspoolclient.SpoolReadDescriptor{},
+		User:                "me",
+		LinkKey:             linkKey,
+	}
+	session := new(fakeSession)
+	opts = append([]Option{WithSession(session, make(chan client.Event))}, opts...)
+	c, err := New(logBackend, nil, &memoryStateStore{}, state, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, session
+}
+
+// addTestContact adds the given contact to the Client as if it was loaded
+// from the statefile, the fields a contact of the statefile always has
+// are filled in.
+func addTestContact(t *testing.T, c *Client, contact *Contact) *Contact {
+	contact.id = uint64(len(c.contacts) + 1)
+	if contact.outbound == nil {
+		contact.outbound = new(Queue)
+	}
+	if contact.seenMessages == nil {
+		contact.seenMessages = make(map[[sha256.Size]byte]time.Time)
+	}
+	if contact.missingSequences == nil {
+		contact.missingSequences = make(map[uint64]bool)
+	}
+	if !contact.IsPending {
+		contact.ratchet = new(ratchet.Ratchet)
+		contact.spoolWriteDescriptor = &memspoolclient.SpoolWriteDescriptor{}
+	}
+	if err := c.loadContacts([]*Contact{contact}); err != nil {
+		t.Fatal(err)
+	}
+	return contact
+}
+
+func TestFakeSessionSend(t *testing.T) {
+	assert := assert.New(t)
+
+	c, session := newTestClient(t)
+	alice := addTestContact(t, c, &Contact{Nickname: "alice"})
+	assert.NoError(alice.outbound.Push(&queuedSpoolCommand{ID: MessageID{1}, Command: []byte("append")}))
+	c.conversations["alice"] = map[MessageID]*Message{{1}: {Outbound: true, Queued: true}}
+	c.sendMessage(alice)
+	assert.Equal([][]byte{[]byte("append")}, session.sent)
+	assert.Equal(1, c.SendMapSize())
+	message := c.conversations["alice"][MessageID{1}]
+	assert.Equal(1, message.Attempts)
+	assert.False(message.Queued)
+
+	c.handleSent(&client.MessageSentEvent{
+		MessageID: &[cConstants.MessageIDLength]byte{1},
+		ReplyETA:  time.Hour,
+	})
+	alice.rtx.Stop()
+	assert.Equal(&MessageSentEvent{Nickname: "alice", MessageID: MessageID{1}}, <-c.eventCh.Out())
+	assert.True(message.Sent)
+	sentAt := message.SentAt
+	assert.False(sentAt.IsZero())
+	assert.True(message.DeliveredAt.IsZero())
+
+	// a retransmission keeps the time of the first transmission
+	c.handleSent(&client.MessageSentEvent{
+		MessageID: &[cConstants.MessageIDLength]byte{1},
+		ReplyETA:  time.Hour,
+	})
+	alice.rtx.Stop()
+	assert.Equal(sentAt, message.SentAt)
+	assert.Equal(sentAt, c.ConversationStatuses("alice")[0].SentAt)
+}
+
+func TestMessageRetransmitEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	c, _ := newTestClient(t)
+	alice := addTestContact(t, c, &Contact{Nickname: "alice"})
+	assert.NoError(alice.outbound.Push(&queuedSpoolCommand{ID: MessageID{1}, Command: []byte("append")}))
+	c.conversations["alice"] = map[MessageID]*Message{{1}: {Outbound: true, Queued: true}}
+	c.sendMessage(alice)
+	assert.Equal(0, c.eventCh.Len())
+
+	c.sendMessage(alice)
+	c.sendMessage(alice)
+	assert.Equal(&MessageRetransmitEvent{Nickname: "alice", MessageID: MessageID{1}, Attempt: 2}, <-c.eventCh.Out())
+	assert.Equal(&MessageRetransmitEvent{Nickname: "alice", MessageID: MessageID{1}, Attempt: 3}, <-c.eventCh.Out())
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, ordered := range []bool{false, true} {
+		c := &Client{
+			orderedDelivery: ordered,
+			paused:          true,
+			log:             logging.MustGetLogger("catshadow"),
+		}
+		alice := &Contact{
+			Nickname:             "alice",
+			outbound:             new(Queue),
+			ratchet:              new(ratchet.Ratchet),
+			ratchetMutex:         new(sync.Mutex),
+			spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+		}
+		for i, priority := range []int{0, 0, 1} {
+			assert.NoError(c.enqueueFrame(alice, MessageID{byte(i)}, &frame{Message: []byte("hi")}, priority))
+		}
+		var order []MessageID
+		for alice.outbound.Len() > 0 {
+			cmd, err := alice.outbound.Pop()
+			assert.NoError(err)
+			order = append(order, cmd.ID)
+		}
+		if ordered {
+			assert.Equal([]MessageID{{0}, {1}, {2}}, order)
+		} else {
+			assert.Equal([]MessageID{{0}, {2}, {1}}, order)
+		}
+	}
+}
+
+func TestSetReadOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		sendMap:            new(sync.Map),
+		inboxReads:         make(map[[cConstants.MessageIDLength]byte]struct{}),
+		stateWorker:        &memoryStateStore{},
+		conversationsMutex: new(sync.Mutex),
+		clock:              realClock{},
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.Equal(ErrNotMaintenance, c.doSetReadOffset(3))
+	c.maintenance = true
+	assert.Equal(ErrNoRemoteSpool, c.doSetReadOffset(3))
+
+	c.spoolReadDescriptor = &memspoolclient.SpoolReadDescriptor{ReadOffset: 5}
+	read := [cConstants.MessageIDLength]byte{1}
+	c.storeSent(read, &SentMessageDescriptor{Nickname: c.user})
+	c.inboxReads[read] = struct{}{}
+	assert.NoError(c.doSetReadOffset(3))
+	assert.Equal(uint32(3), c.spoolReadDescriptor.ReadOffset)
+	assert.Len(c.inboxReads, 0)
+	assert.Equal(0, c.SendMapSize())
+}
+
+func TestWaitShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		shutdownCh:         make(chan struct{}),
+		stateWorker:        &memoryStateStore{},
+		conversationsMutex: new(sync.Mutex),
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	reason := errors.New("spool is gone")
+	go c.shutdown(reason)
+	assert.Equal(reason, c.WaitShutdown())
+
+	// the first reason is kept
+	c.Shutdown()
+	assert.Equal(reason, c.WaitShutdown())
+}
+
+func TestDeliveryAck(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Outbound: true, Sequence: 1, Delivered: true},
+				{2}: {Outbound: false, Sequence: 1},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+		eventCh:            channels.NewInfiniteChannel(),
+		paused:             true,
+		randReader:         rand.Reader,
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	alice := &Contact{
+		Nickname:             "alice",
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+		frameHeader:          true,
+		deliveryAck:          true,
+	}
+	c.sendAck(alice, 5)
+	assert.Equal(1, alice.outbound.Len())
+	assert.Equal(uint64(1), alice.sendSequence)
+
+	c.handleAck(alice, 1)
+	assert.Equal(&MessageEndToEndDeliveredEvent{Nickname: "alice", MessageID: MessageID{1}}, <-c.eventCh.Out())
+	message := c.conversations["alice"][MessageID{1}]
+	assert.True(message.Received)
+	assert.Equal(StatusReceived, deliveryStatus(message))
+
+	// duplicate and unknown acks are ignored
+	c.handleAck(alice, 1)
+	c.handleAck(alice, 2)
+	assert.Equal(0, c.eventCh.Len())
+}
+
+func TestReserveContact(t *testing.T) {
+	assert := assert.New(t)
+
+	c, _ := newTestClient(t)
+	assert.NoError(c.doReserveContact("alice"))
+	assert.Equal(&ContactCreatedEvent{Nickname: "alice", IsPending: true}, <-c.eventCh.Out())
+	assert.Error(c.doReserveContact("alice"))
+	alice := c.contactNicknames["alice"]
+	assert.True(alice.reserved)
+	assert.Error(c.doRestartKeyExchange("alice", []byte("secret")))
+
+	assert.NoError(c.doBeginKeyExchange("alice", []byte("secret")))
+	assert.False(alice.reserved)
+	assert.True(alice.IsPending)
+	assert.Error(c.doBeginKeyExchange("alice", []byte("secret")))
+	assert.Equal(ErrContactNotFound, c.doBeginKeyExchange("bob", []byte("secret")))
+}
+
+func TestRandomizedPolling(t *testing.T) {
+	assert := assert.New(t)
+
+	c := new(Client)
+	WithRandomizedPolling(time.Minute, time.Second)(c)
+	assert.Equal(time.Duration(0), c.pollJitter())
+
+	WithRandomizedPolling(time.Second, time.Minute)(c)
+	for i := 0; i < 100; i++ {
+		interval := c.readInboxInterval(0.001, 100)
+		assert.True(interval >= time.Second && interval <= time.Minute)
+		assert.True(c.pollJitter() <= time.Minute-time.Second)
+	}
+}
+
+func TestWaitAllKeyExchanges(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contacts: map[uint64]*Contact{
+			1: {Nickname: "alice", IsPending: true},
+			2: {Nickname: "bob", IsPending: true, pandaResult: "timeout"},
+			3: {Nickname: "carol"},
+		},
+		opCh:               make(chan interface{}),
+		subscriptions:      make(map[*contactSubscription]struct{}),
+		subscriptionsMutex: new(sync.Mutex),
+	}
+	go func() {
+		op := (<-c.opCh).(*opPendingKeyExchanges)
+		op.responseChan <- c.doPendingKeyExchanges()
+		c.publishToSubscribers(&KeyExchangeCompletedEvent{Nickname: "carol"})
+		c.publishToSubscribers(&KeyExchangeCompletedEvent{Nickname: "alice"})
+	}()
+	err := c.WaitAllKeyExchanges(context.Background())
+	assert.EqualError(err, "key exchanges failed: bob: timeout")
+	assert.Len(c.subscriptions, 0)
+
+	// nothing is pending
+	c.contacts = map[uint64]*Contact{3: {Nickname: "carol"}}
+	go func() {
+		op := (<-c.opCh).(*opPendingKeyExchanges)
+		op.responseChan <- c.doPendingKeyExchanges()
+	}()
+	assert.NoError(c.WaitAllKeyExchanges(context.Background()))
+
+	c.contacts = map[uint64]*Contact{1: {Nickname: "alice", IsPending: true}}
+	go func() {
+		op := (<-c.opCh).(*opPendingKeyExchanges)
+		op.responseChan <- c.doPendingKeyExchanges()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, c.WaitAllKeyExchanges(ctx))
+}
+
+func TestDeleteMessageForEveryone(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Outbound: true, Sequence: 3},
+				{2}: {Outbound: false, Sequence: 3},
+				{3}: {Outbound: true},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+		stateWorker:        &memoryStateStore{},
+		eventCh:            channels.NewInfiniteChannel(),
+		paused:             true,
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	alice := &Contact{
+		Nickname:             "alice",
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+		frameHeader:          true,
+	}
+	c.contactNicknames = map[string]*Contact{"alice": alice}
+
+	assert.Error(c.doDeleteMessageForEveryone(MessageID{9}, MessageID{1}, "alice"))
+	alice.remoteDelete = true
+	assert.Equal(ErrMessageNotFound, c.doDeleteMessageForEveryone(MessageID{9}, MessageID{4}, "alice"))
+	assert.Error(c.doDeleteMessageForEveryone(MessageID{9}, MessageID{2}, "alice"))
+	assert.Error(c.doDeleteMessageForEveryone(MessageID{9}, MessageID{3}, "alice"))
+	assert.NoError(c.doDeleteMessageForEveryone(MessageID{9}, MessageID{1}, "alice"))
+	assert.NotContains(c.conversations["alice"], MessageID{1})
+	assert.Equal(1, alice.outbound.Len())
+
+	// the contact deletes the inbound message with the sequence number
+	c.applyDelete(alice, 3)
+	assert.Equal(&MessageRemotelyDeletedEvent{Nickname: "alice", MessageID: MessageID{2}}, <-c.eventCh.Out())
+	assert.NotContains(c.conversations["alice"], MessageID{2})
+	c.applyDelete(alice, 3)
+	assert.Equal(0, c.eventCh.Len())
+}
+
+func TestContactApproval(t *testing.T) {
+	assert := assert.New(t)
+
+	asked := 0
+	c := &Client{
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		stateWorker:        &memoryStateStore{},
+		eventCh:            channels.NewInfiniteChannel(),
+		paused:             true,
+		randReader:         rand.Reader,
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	WithContactApproval(func(nickname string) bool {
+		asked++
+		return nickname == "bob"
+	})(c)
+	alice := &Contact{
+		Nickname:             "alice",
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+		frameHeader:          true,
+		deliveryAck:          true,
+	}
+	c.contactNicknames = map[string]*Contact{"alice": alice}
+
+	for i, text := range []string{"hi", "there"} {
+		assert.True(c.needsApproval(alice))
+		c.holdMessage(alice, &Message{Plaintext: []byte(text), Sequence: uint64(i + 1)})
+	}
+	// held messages are only acknowledged once approved
+	assert.Equal(0, alice.outbound.Len())
+	assert.Equal(1, asked)
+	assert.Equal(&ContactApprovalRequestedEvent{Nickname: "alice"}, <-c.eventCh.Out())
+	assert.Equal(0, c.eventCh.Len())
+	assert.Len(c.conversations, 0)
+
+	assert.NoError(c.doApproveContact("alice", true))
+	first := (<-c.eventCh.Out()).(*MessageReceivedEvent)
+	assert.Equal([]byte("hi"), first.Message)
+	assert.True(first.IsFirstMessage)
+	second := (<-c.eventCh.Out()).(*MessageReceivedEvent)
+	assert.Equal([]byte("there"), second.Message)
+	assert.False(second.IsFirstMessage)
+	assert.Len(c.conversations["alice"], 2)
+	assert.Equal(2, alice.outbound.Len())
+	assert.False(c.needsApproval(alice))
+	assert.Error(c.doApproveContact("alice", true))
+
+	// rejected messages are discarded
+	c.conversations = make(map[string]map[MessageID]*Message)
+	assert.True(c.needsApproval(alice))
+	c.holdMessage(alice, &Message{Plaintext: []byte("spam"), Sequence: 3})
+	<-c.eventCh.Out()
+	assert.NoError(c.doApproveContact("alice", false))
+	assert.Len(c.conversations, 0)
+	assert.Equal(2, alice.outbound.Len())
+	assert.Len(alice.heldMessages, 0)
+	assert.Equal(ErrContactNotFound, c.doApproveContact("bob", true))
+}
+
+func TestKeyExchangePhase(t *testing.T) {
+	assert := assert.New(t)
+
+	contacts := map[Phase]*Contact{
+		PhaseReserved:    {Nickname: "alice", IsPending: true, reserved: true, keyExchange: []byte("kx")},
+		PhaseExchanging:  {Nickname: "bob", IsPending: true, pandaKeyExchange: []byte("panda")},
+		PhaseEstablished: {Nickname: "carol"},
+		PhaseFailed:      {Nickname: "dave", IsPending: true, pandaResult: "timeout"},
+	}
+	c := &Client{contactNicknames: make(map[string]*Contact)}
+	for phase, contact := range contacts {
+		contact.ratchet = new(ratchet.Ratchet)
+		assert.Equal(phase, contact.phase(), phase.String())
+
+		// the phase survives saving and loading the contact
+		blob, err := contact.MarshalBinary()
+		assert.NoError(err)
+		loaded := new(Contact)
+		assert.NoError(loaded.UnmarshalBinary(blob))
+		assert.Equal(phase, loaded.phase(), phase.String())
+		c.contactNicknames[loaded.Nickname] = loaded
+	}
+	assert.Equal(PhaseFailed, c.doKeyExchangePhase("dave"))
+	assert.Equal(ErrContactNotFound, c.doKeyExchangePhase("eve"))
+	assert.Equal("exchanging", PhaseExchanging.String())
+}
+
+func TestInboundLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &testClock{now: time.Now()}
+	c := &Client{
+		eventCh: channels.NewInfiniteChannel(),
+		clock:   clock,
+		log:     logging.MustGetLogger("catshadow"),
+	}
+	alice := &Contact{Nickname: "alice"}
+	c.inboundLimit = DefaultInboundLimit
+	for i := 0; i < 1000; i++ {
+		assert.False(c.isFlooding(alice))
+	}
+
+	WithInboundLimit(2, time.Minute)(c)
+	assert.False(c.isFlooding(alice))
+	assert.False(c.isFlooding(alice))
+	assert.True(c.isFlooding(alice))
+	assert.True(c.isFlooding(alice))
+	ev := (<-c.eventCh.Out()).(*ContactFloodingEvent)
+	assert.Equal("alice", ev.Nickname)
+	assert.Equal(clock.now.Add(time.Minute), ev.Until)
+	assert.Equal(0, c.eventCh.Len())
+
+	// the next window starts afresh
+	clock.now = clock.now.Add(time.Minute)
+	assert.False(c.isFlooding(alice))
+}
+
+func TestForEachConversation(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"bob": {
+				{1}: {Plaintext: []byte("second"), Timestamp: now},
+				{2}: {Plaintext: []byte("first"), Timestamp: now.Add(-time.Minute)},
+			},
+			"alice": {{3}: {Plaintext: []byte("hi"), Timestamp: now}},
+			"carol": {{4}: {Plaintext: []byte("hey"), Timestamp: now}},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	visited := []string{}
+	c.ForEachConversation(func(nickname string, messages []*Message) bool {
+		visited = append(visited, nickname)
+		if nickname == "bob" {
+			assert.Equal([]byte("first"), messages[0].Plaintext)
+			assert.Equal([]byte("second"), messages[1].Plaintext)
+			return false
+		}
+		return true
+	})
+	assert.Equal([]string{"alice", "bob"}, visited)
+}
+
+func TestSpoolUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		conversationsMutex: new(sync.Mutex),
+		stateWorker:        &memoryStateStore{},
+		eventCh:            channels.NewInfiniteChannel(),
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	old := &memspoolclient.SpoolWriteDescriptor{ID: [12]byte{1}, Receiver: "spool", Provider: "provider1"}
+	alice := &Contact{Nickname: "alice", spoolWriteDescriptor: old}
+
+	for _, invalid := range []*memspoolclient.SpoolWriteDescriptor{
+		{Receiver: "spool", Provider: "provider2"},
+		{ID: [12]byte{2}, Provider: "provider2"},
+		{ID: [12]byte{2}, Receiver: "spool", Provider: strings.Repeat("p", 256)},
+	} {
+		blob, err := cbor.Marshal(invalid)
+		assert.NoError(err)
+		c.applySpoolUpdate(alice, blob)
+		assert.Equal(old, alice.spoolWriteDescriptor)
+	}
+	c.applySpoolUpdate(alice, []byte("garbage"))
+	assert.Equal(old, alice.spoolWriteDescriptor)
+	assert.Equal(0, c.eventCh.Len())
+
+	moved := &memspoolclient.SpoolWriteDescriptor{ID: [12]byte{2}, Receiver: "spool", Provider: "provider2"}
+	blob, err := cbor.Marshal(moved)
+	assert.NoError(err)
+	c.applySpoolUpdate(alice, blob)
+	assert.Equal(moved, alice.spoolWriteDescriptor)
+	assert.Equal(&ContactSpoolUpdatedEvent{Nickname: "alice"}, <-c.eventCh.Out())
+
+	// repeated updates are ignored
+	c.applySpoolUpdate(alice, blob)
+	assert.Equal(0, c.eventCh.Len())
+}
+
+func TestStorageBreakdown(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contacts: make(map[uint64]*Contact),
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Plaintext: []byte("hello")},
+				{2}: {Plaintext: []byte("edited"), EditHistory: [][]byte{[]byte("edit")}},
+			},
+			"bob": {},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	usage := c.doStorageBreakdown().(StorageUsage)
+	serialized, err := c.marshal()
+	assert.NoError(err)
+	assert.Equal(len(serialized), usage.Total)
+	assert.Equal(map[string]ConversationUsage{
+		"alice": {Messages: 2, Bytes: 15},
+		"bob":   {},
+	}, usage.Conversations)
+}
+
+func TestAddContactSync(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contacts:           make(map[uint64]*Contact),
+		contactNicknames:   make(map[string]*Contact),
+		opCh:               make(chan interface{}),
+		subscriptions:      make(map[*contactSubscription]struct{}),
+		subscriptionsMutex: new(sync.Mutex),
+		log:                logging.MustGetLogger("catshadow"),
+	}
+
+	// the contact could not be created
+	go func() {
+		op := (<-c.opCh).(*opAddContact)
+		op.responseChan <- ErrNoRemoteSpool
+	}()
+	assert.Equal(ErrNoRemoteSpool, c.AddContactSync(context.Background(), "alice", []byte("secret")))
+	assert.Len(c.subscriptions, 0)
+
+	// the key exchange failed
+	exchangeErr := errors.New("timeout")
+	go func() {
+		op := (<-c.opCh).(*opAddContact)
+		op.responseChan <- nil
+		c.publishToSubscribers(&KeyExchangeCompletedEvent{Nickname: "bob"})
+		c.publishToSubscribers(&KeyExchangeCompletedEvent{Nickname: "alice", Err: exchangeErr})
+	}()
+	assert.Equal(exchangeErr, c.AddContactSync(context.Background(), "alice", []byte("secret")))
+
+	// the pending contact is removed upon cancellation
+	alice := &Contact{Nickname: "alice", id: 1, IsPending: true}
+	c.contacts[alice.id] = alice
+	c.contactNicknames[alice.Nickname] = alice
+	c.stateWorker = &memoryStateStore{}
+	c.conversationsMutex = new(sync.Mutex)
+	c.eventCh = channels.NewInfiniteChannel()
+	done := make(chan struct{})
+	go func() {
+		op := (<-c.opCh).(*opAddContact)
+		op.responseChan <- nil
+		cancelOp := (<-c.opCh).(*opCancelPendingContact)
+		c.doCancelPendingContact(cancelOp.name)
+		close(done)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, c.AddContactSync(ctx, "alice", []byte("secret")))
+	<-done
+	assert.NotContains(c.contactNicknames, "alice")
+
+	// an established contact is kept
+	c.contacts[alice.id] = alice
+	c.contactNicknames[alice.Nickname] = alice
+	alice.IsPending = false
+	c.doCancelPendingContact("alice")
+	assert.Contains(c.contactNicknames, "alice")
+}
+
+func TestDeliveryLog(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	c := &Client{
+		clock:           &testClock{now: now},
+		deliveryRecords: newBoundedChannel(1, false),
+	}
+	sentAt := now.Add(-time.Minute)
+	c.logDelivery("alice", MessageID{1}, sentAt)
+	c.logDelivery("alice", MessageID{2}, sentAt)
+	record := (<-c.deliveryRecords.Out()).(*DeliveryRecord)
+	assert.Equal(&DeliveryRecord{
+		Nickname:    "alice",
+		MessageID:   MessageID{1},
+		SentAt:      sentAt,
+		DeliveredAt: now,
+	}, record)
+	assert.Equal(uint64(1), c.DroppedDeliveryRecords())
+
+	// the delivery log is optional
+	c.deliveryRecords = nil
+	c.logDelivery("alice", MessageID{3}, sentAt)
+	assert.Equal(uint64(0), c.DroppedDeliveryRecords())
+}
+
+func TestStateChecksum(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contacts:           make(map[uint64]*Contact),
+		conversations:      map[string]map[MessageID]*Message{"alice": {{1}: {Plaintext: []byte("hello")}}},
+		conversationsMutex: new(sync.Mutex),
+		user:               "bob",
+	}
+	serialized, err := c.marshal()
+	assert.NoError(err)
+	state, err := unmarshalState(serialized)
+	assert.NoError(err)
+	assert.Equal("bob", state.User)
+
+	corrupt := append([]byte{}, serialized...)
+	corrupt[len(corrupt)-1] ^= 1
+	_, err = unmarshalState(corrupt)
+	assert.Equal(ErrStateCorrupt, err)
+	_, err = unmarshalState(serialized[:10])
+	assert.Equal(ErrStateCorrupt, err)
+	_, err = unmarshalState(nil)
+	assert.Equal(ErrStateCorrupt, err)
+
+	// a state serialized without checksum is loaded as is
+	legacy, err := cbor.Marshal(&State{User: "bob"})
+	assert.NoError(err)
+	state, err = unmarshalState(legacy)
+	assert.NoError(err)
+	assert.Equal("bob", state.User)
+}
+
+func TestDecryptionCandidates(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	alice := &Contact{Nickname: "alice", id: 1, ratchet: new(ratchet.Ratchet), lastInboundAt: now.Add(-time.Hour)}
+	bob := &Contact{Nickname: "bob", id: 2, ratchet: new(ratchet.Ratchet), lastInboundAt: now}
+	carol := &Contact{Nickname: "carol", id: 3, ratchet: new(ratchet.Ratchet)}
+	dave := &Contact{Nickname: "dave", id: 4, IsPending: true}
+	c := &Client{
+		contacts: map[uint64]*Contact{1: alice, 2: bob, 3: carol, 4: dave},
+	}
+	assert.ElementsMatch([]*Contact{alice, bob, carol}, c.trialContacts(nil))
+
+	c.decryptionCandidates = RecentlyActiveFirst
+	assert.Equal([]*Contact{bob, alice, carol}, c.trialContacts(nil))
+
+	// omitted contacts are tried afterwards, unknown ones never
+	c.decryptionCandidates = func(ciphertext []byte, contacts []*Contact) []*Contact {
+		return []*Contact{carol, carol, dave, {id: 5}}
+	}
+	contacts := c.trialContacts(nil)
+	assert.Equal(carol, contacts[0])
+	assert.ElementsMatch([]*Contact{alice, bob}, contacts[1:])
+}
+
+func TestCorruptContact(t *testing.T) {
+	assert := assert.New(t)
+
+	contact := &Contact{
+		Nickname:             "alice",
+		id:                   1,
+		outbound:             new(Queue),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+		ratchetMutex:         new(sync.Mutex),
+	}
+	serialized, err := contact.MarshalBinary()
+	assert.NoError(err)
+	loaded := new(Contact)
+	assert.NoError(loaded.UnmarshalBinary(serialized))
+	assert.True(loaded.corrupt())
+	assert.NoError(validateState(&State{
+		LinkKey:  new(ecdh.PrivateKey),
+		User:     "bob",
+		Contacts: []*Contact{loaded},
+	}))
+
+	c := &Client{
+		contacts:         make(map[uint64]*Contact),
+		contactNicknames: make(map[string]*Contact),
+		log:              logging.MustGetLogger("catshadow"),
+	}
+	assert.NoError(c.loadContacts([]*Contact{loaded}))
+	assert.Empty(c.trialContacts(nil))
+	assert.Equal(ErrContactCorrupt, c.enqueueFrame(loaded, MessageID{1}, &frame{Message: []byte("hello")}, 0))
+	assert.Equal(0, loaded.outbound.Len())
+}
+
+func TestUnknownOp(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		eventCh: channels.NewInfiniteChannel(),
+		log:     logging.MustGetLogger("catshadow"),
+	}
+	c.handleOp(struct{}{})
+	event := (<-c.eventCh.Out()).(*InternalErrorEvent)
+	assert.EqualError(event.Err, "BUG, unknown operation type struct {}")
+}
+
+func TestDrainOutbound(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Outbound: true, Sent: true},
+				{2}: {Outbound: true, Sent: true},
+				{3}: {Outbound: true, Sent: true, Delivered: true},
+				{4}: {Outbound: true, Queued: true},
+			},
+			"bob": {
+				{1}: {Outbound: true, Sent: true},
+				{2}: {Outbound: false, Sent: true},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+		subscriptions:      make(map[*contactSubscription]struct{}),
+		subscriptionsMutex: new(sync.Mutex),
+	}
+	waitSubscribed := func() {
+		for {
+			c.subscriptionsMutex.Lock()
+			n := len(c.subscriptions)
+			c.subscriptionsMutex.Unlock()
+			if n > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go func() {
+		waitSubscribed()
+		c.publishToSubscribers(&MessageDeliveredEvent{Nickname: "alice", MessageID: MessageID{3}})
+		c.publishToSubscribers(&MessageDeliveredEvent{Nickname: "alice", MessageID: MessageID{1}})
+		c.publishToSubscribers(&SpoolWriteFailedEvent{Nickname: "alice", MessageID: MessageID{2}})
+		c.publishToSubscribers(&MessageDeliveredEvent{Nickname: "bob", MessageID: MessageID{1}})
+	}()
+	assert.EqualError(c.DrainOutbound(context.Background()), "1 messages were not delivered")
+	assert.Len(c.subscriptions, 0)
+
+	// nothing is undelivered
+	c.conversations = map[string]map[MessageID]*Message{}
+	assert.NoError(c.DrainOutbound(context.Background()))
+
+	c.conversations["alice"] = map[MessageID]*Message{{1}: {Outbound: true, Sent: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.EqualError(c.DrainOutbound(ctx), "1 messages were not delivered: context deadline exceeded")
+}
+
+func TestPopDelivered(t *testing.T) {
+	assert := assert.New(t)
+
+	contact := &Contact{outbound: new(Queue)}
+	assert.NoError(contact.outbound.Push(&queuedSpoolCommand{ID: MessageID{1}}))
+	assert.NoError(contact.outbound.Push(&queuedSpoolCommand{ID: MessageID{2}}))
+	c := &Client{}
+
+	// a duplicated ACK doesn't pop the next message
+	assert.True(c.popDelivered(contact, MessageID{1}))
+	assert.False(c.popDelivered(contact, MessageID{1}))
+	assert.Equal(1, contact.outbound.Len())
+	assert.True(c.popDelivered(contact, MessageID{2}))
+	assert.False(c.popDelivered(contact, MessageID{2}))
+}
+
+func TestDrainOps(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contacts:         make(map[uint64]*Contact),
+		contactNicknames: map[string]*Contact{"alice": {Nickname: "alice"}},
+		opCh:             make(chan interface{}, 8),
+	}
+	alice := &opHasContact{name: "alice", responseChan: make(chan bool, 1)}
+	bob := &opHasContact{name: "bob", responseChan: make(chan bool, 1)}
+	c.opCh <- alice
+	c.opCh <- bob
+	c.drainOps()
+	assert.True(<-alice.responseChan)
+	assert.False(<-bob.responseChan)
+	assert.Len(c.opCh, 0)
+}
+
+func TestImportConversation(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UTC().Round(0)
+	conversation := map[MessageID]*Message{
+		{1}: {Plaintext: []byte("hello"), Timestamp: now.Add(-2 * time.Minute), Outbound: true, Delivered: true},
+		{2}: {Plaintext: []byte("hi"), Timestamp: now.Add(-time.Minute), Read: true},
+		{3}: {Plaintext: []byte("lost"), Timestamp: now, Outbound: true, Failed: true},
+	}
+	c := &Client{
+		conversations:      map[string]map[MessageID]*Message{"alice": conversation},
+		conversationsMutex: new(sync.Mutex),
+	}
+	exported, err := c.ExportConversation("alice")
+	assert.NoError(err)
+
+	c = &Client{
+		contactNicknames:   map[string]*Contact{"alice": {Nickname: "alice"}},
+		conversations:      map[string]map[MessageID]*Message{},
+		conversationsMutex: new(sync.Mutex),
+		stateWorker:        &memoryStateStore{},
+		clock:              &testClock{now: now},
+		randReader:         rand.Reader,
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.Equal(ErrContactNotFound, c.doImportConversation("bob", exported))
+	assert.NoError(c.doImportConversation("alice", exported))
+	assert.Equal(conversation, c.conversations["alice"])
+
+	// importing again changes nothing
+	assert.NoError(c.doImportConversation("alice", exported))
+	assert.Len(c.conversations["alice"], 3)
+
+	// a message under a taken ID gets a new one, expired messages are dropped
+	c.conversations["alice"][MessageID{4}] = &Message{Plaintext: []byte("other"), Timestamp: now.Add(-time.Second)}
+	blob := []byte(`[
+		{"id": "04000000", "timestamp": "` + now.Format(time.RFC3339Nano) + `", "direction": "received", "message": "new"},
+		{"timestamp": "` + now.Add(-MessageExpirationDuration-time.Hour).Format(time.RFC3339Nano) + `", "direction": "received", "message": "old"}
+	]`)
+	assert.NoError(c.doImportConversation("alice", blob))
+	assert.Len(c.conversations["alice"], 5)
+	assert.Equal([]byte("other"), c.conversations["alice"][MessageID{4}].Plaintext)
+
+	assert.Error(c.doImportConversation("alice", []byte(`[{"direction": "sideways"}]`)))
+}
+
+func TestWorkerRecovery(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		eventCh:       channels.NewInfiniteChannel(),
+		fatalErrCh:    make(chan error, 1),
+		workerRestart: true,
+		log:           logging.MustGetLogger("catshadow"),
+	}
+	panicking := func() { panic("bug") }
+	assert.True(c.runWorker(panicking))
+	event := (<-c.eventCh.Out()).(*WorkerPanicEvent)
+	assert.Equal("bug", event.Value)
+	assert.True(event.Restarted)
+	assert.NotEmpty(event.Stack)
+	assert.False(c.runWorker(func() {}))
+
+	c.workerRestart = false
+	assert.False(c.runWorker(panicking))
+	event = (<-c.eventCh.Out()).(*WorkerPanicEvent)
+	assert.False(event.Restarted)
+	assert.EqualError(<-c.fatalErrCh, "worker panic: bug")
+}
+
+func TestReplayEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Now()
+	clock := &testClock{now: start}
+	c := &Client{
+		clock:                 clock,
+		eventHistorySize:      3,
+		eventHistoryRetention: time.Hour,
+		eventHistoryMutex:     new(sync.Mutex),
+	}
+	for i := 1; i <= 4; i++ {
+		clock.now = start.Add(time.Duration(i) * time.Minute)
+		c.recordEvent(&MessageSentEvent{MessageID: MessageID{byte(i)}})
+	}
+	assert.Equal([]interface{}{
+		&MessageSentEvent{MessageID: MessageID{2}},
+		&MessageSentEvent{MessageID: MessageID{3}},
+		&MessageSentEvent{MessageID: MessageID{4}},
+	}, c.ReplayEvents(time.Time{}))
+	assert.Equal([]interface{}{
+		&MessageSentEvent{MessageID: MessageID{4}},
+	}, c.ReplayEvents(start.Add(3*time.Minute)))
+
+	// events beyond the retention are not replayed
+	clock.now = start.Add(time.Hour + 3*time.Minute + time.Second)
+	assert.Equal([]interface{}{
+		&MessageSentEvent{MessageID: MessageID{4}},
+	}, c.ReplayEvents(time.Time{}))
+
+	c = &Client{clock: clock, eventHistoryMutex: new(sync.Mutex)}
+	c.recordEvent(&InboxDrainedEvent{})
+	assert.Empty(c.ReplayEvents(time.Time{}))
+}
+
+func TestReplayDeliveredEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	c, _ := newTestClient(t, WithEventHistory(10, time.Hour))
+	c.Go(c.eventSinkWorker)
+	c.eventCh.In() <- &MessageSentEvent{MessageID: MessageID{1}}
+	c.eventCh.In() <- &MessageSentEvent{MessageID: MessageID{2}}
+	c.eventCh.In() <- &MessageSentEvent{MessageID: MessageID{3}}
+	assert.Equal(&MessageSentEvent{MessageID: MessageID{1}}, <-c.EventSink)
+	assert.Equal(&MessageSentEvent{MessageID: MessageID{2}}, <-c.EventSink)
+
+	// the event which was never read from the EventSink is not replayed
+	c.Halt()
+	assert.Equal([]interface{}{
+		&MessageSentEvent{MessageID: MessageID{1}},
+		&MessageSentEvent{MessageID: MessageID{2}},
+	}, c.ReplayEvents(time.Time{}))
+}
+
+func TestMessageChannels(t *testing.T) {
+	assert := assert.New(t)
+
+	alice := &Contact{Nickname: "alice", outbound: new(Queue), ratchet: new(ratchet.Ratchet)}
+	c := &Client{
+		clock:              realClock{},
+		randReader:         rand.Reader,
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		eventCh:            channels.NewInfiniteChannel(),
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.Error(c.enqueueFrame(alice, MessageID{1}, &frame{Channel: 1, Message: []byte("hi")}, 0))
+	assert.Equal(0, alice.outbound.Len())
+
+	c.storeReceived(alice, &Message{Plaintext: []byte("chat")})
+	c.storeReceived(alice, &Message{Plaintext: []byte("online"), Channel: 1})
+	chat := (<-c.eventCh.Out()).(*MessageReceivedEvent)
+	presence := (<-c.eventCh.Out()).(*MessageReceivedEvent)
+	assert.Equal(uint8(0), chat.Channel)
+	assert.Equal([]byte("chat"), chat.Message)
+	assert.Equal(uint8(1), presence.Channel)
+	assert.Equal([]byte("online"), presence.Message)
+	assert.Equal(uint8(1), c.conversations["alice"][presence.MessageID].Channel)
+}
+
+func TestConversationSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	message := &Message{Plaintext: []byte("hello"), Outbound: true, EditHistory: [][]byte{[]byte("helo")}}
+	c := &Client{
+		conversations:      map[string]map[MessageID]*Message{"alice": {{1}: message}},
+		conversationsMutex: new(sync.Mutex),
+	}
+	conversation := c.GetConversation("alice")
+	all := c.GetAllConversations()
+
+	// the worker mutates its messages in place
+	c.conversationsMutex.Lock()
+	message.Delivered = true
+	copy(message.Plaintext, "xxxxx")
+	copy(message.EditHistory[0], "xxxx")
+	c.conversationsMutex.Unlock()
+
+	for _, snapshot := range []*Message{conversation[MessageID{1}], all["alice"][MessageID{1}]} {
+		assert.False(snapshot.Delivered)
+		assert.Equal([]byte("hello"), snapshot.Plaintext)
+		assert.Equal([][]byte{[]byte("helo")}, snapshot.EditHistory)
+	}
+}
+
+func TestInboxReadInterleave(t *testing.T) {
+	assert := assert.New(t)
+
+	c, session := newTestClient(t, WithInboxReadInterleave(2))
+	var contacts []*Contact
+	for i, nickname := range []string{"alice", "bob", "carol"} {
+		contact := addTestContact(t, c, &Contact{Nickname: nickname})
+		assert.NoError(contact.outbound.Push(&queuedSpoolCommand{ID: MessageID{byte(i)}, Command: []byte("append")}))
+		contacts = append(contacts, contact)
+	}
+	c.flushQueues()
+	assert.Len(session.sent, 4)
+	assert.Nil(session.sent[2])
+	assert.Len(c.inboxReads, 1)
+	assert.Equal(1, c.sendsSinceInboxRead)
+
+	// without interleaving only the periodic reads read the spool
+	c.inboxReadInterleave = 0
+	c.sendMessage(contacts[0])
+	c.sendMessage(contacts[1])
+	assert.Len(session.sent, 6)
+	assert.Len(c.inboxReads, 1)
+}
+
+func TestDecryptionFailureHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	alice := &Contact{Nickname: "alice", id: 1, ratchet: new(ratchet.Ratchet), ratchetMutex: new(sync.Mutex)}
+	bob := &Contact{Nickname: "bob", id: 2, ratchet: new(ratchet.Ratchet), ratchetMutex: new(sync.Mutex)}
+	c := &Client{
+		contacts: map[uint64]*Contact{1: alice, 2: bob},
+		log:      logging.MustGetLogger("catshadow"),
+	}
+	var failures map[string]error
+	quarantine := false
+	c.decryptionFailure = func(messageID [cConstants.MessageIDLength]byte, ciphertext []byte, errs map[string]error) bool {
+		assert.Equal([cConstants.MessageIDLength]byte{1}, messageID)
+		assert.Equal([]byte("ciphertext"), ciphertext)
+		failures = errs
+		return quarantine
+	}
+	assert.False(c.decryptMessage(&[cConstants.MessageIDLength]byte{1}, []byte("ciphertext")))
+	assert.Len(failures, 2)
+	assert.Error(failures["alice"])
+	assert.Error(failures["bob"])
+	assert.Empty(c.quarantined)
+	assert.Equal("\n  alice: "+failures["alice"].Error()+"\n  bob: "+failures["bob"].Error(), formatDecryptionErrors(failures))
+
+	quarantine = true
+	assert.False(c.decryptMessage(&[cConstants.MessageIDLength]byte{1}, []byte("ciphertext")))
+	assert.Len(c.quarantined, 1)
+}
+
+func TestCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	alice := &Contact{Nickname: "alice"}
+	store := &memoryStateStore{}
+	c := &Client{
+		stateWorker:      store,
+		contactNicknames: map[string]*Contact{"alice": alice},
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Plaintext: []byte("hello"), Timestamp: now},
+				{2}: {Plaintext: bytes.Repeat([]byte{1}, 1000), Timestamp: now, Expires: now.Add(-time.Second)},
+			},
+			"bob": {},
+		},
+		conversationsMutex: new(sync.Mutex),
+		eventCh:            channels.NewInfiniteChannel(),
+		clock:              &testClock{now: now},
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	assert.NoError(c.writeState())
+	before := c.StateSize()
+
+	assert.NoError(c.doCompact())
+	assert.Len(store.states, 2)
+	assert.Len(c.conversations, 1)
+	assert.Len(c.conversations["alice"], 1)
+	event := (<-c.eventCh.Out()).(*StateCompactedEvent)
+	assert.Equal(before, event.Before)
+	assert.Equal(c.StateSize(), event.After)
+	assert.True(event.After < event.Before)
+}
+
+func TestExpiringBefore(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				{1}: {Timestamp: now.Add(-MessageExpirationDuration + time.Hour)},
+				{2}: {Timestamp: now},
+				{3}: {Timestamp: now, Expires: now.Add(time.Minute)},
+			},
+			"bob": {
+				{4}: {Timestamp: now.Add(-MessageExpirationDuration + time.Hour)},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+	}
+	assert.Equal([]SearchResult{
+		{Nickname: "alice", MessageID: MessageID{3}, Timestamp: now, Expires: now.Add(time.Minute)},
+		{Nickname: "alice", MessageID: MessageID{1}, Timestamp: now.Add(-MessageExpirationDuration + time.Hour), Expires: now.Add(time.Hour)},
+		{Nickname: "bob", MessageID: MessageID{4}, Timestamp: now.Add(-MessageExpirationDuration + time.Hour), Expires: now.Add(time.Hour)},
+	}, c.ExpiringBefore(now.Add(2*time.Hour)))
+	assert.Empty(c.ExpiringBefore(now))
+	assert.Len(c.conversations["alice"], 3)
+}
+
+func TestSendMessageDurable(t *testing.T) {
+	assert := assert.New(t)
+
+	alice := &Contact{
+		Nickname:             "alice",
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+	}
+	store := &memoryStateStore{failAt: 2}
+	c := &Client{
+		paused:              true,
+		stateWorker:         store,
+		contacts:            map[uint64]*Contact{1: alice},
+		contactNicknames:    map[string]*Contact{"alice": alice},
+		conversations:       make(map[string]map[MessageID]*Message),
+		conversationsMutex:  new(sync.Mutex),
+		spoolReadDescriptor: &memspoolclient.SpoolReadDescriptor{},
+		eventCh:             channels.NewInfiniteChannel(),
+		clock:               realClock{},
+		log:                 logging.MustGetLogger("catshadow"),
+	}
+	assert.NoError(c.doSendMessageDurable(MessageID{1}, "alice", []byte("hello")))
+	assert.Len(store.states, 1)
+	assert.Equal(1, alice.outbound.Len())
+
+	// the failure to write the statefile is returned rather than fatal
+	assert.Error(c.doSendMessageDurable(MessageID{2}, "alice", []byte("hello")))
+	assert.Equal(2, alice.outbound.Len())
+
+	assert.Error(c.doSendMessageDurable(MessageID{3}, "bob", []byte("hello")))
+	assert.True(c.conversations["bob"][MessageID{3}].Failed)
+}
+
+func TestPandaConfigInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	c, session := newTestClient(t)
+	_, _, _, ok := c.PandaConfigInfo()
+	assert.False(ok)
+
+	session.panda = &config.Panda{Provider: "provider", Receiver: "panda", BlobSize: 1000}
+	provider, receiver, blobSize, ok := c.PandaConfigInfo()
+	assert.True(ok)
+	assert.Equal("provider", provider)
+	assert.Equal("panda", receiver)
+	assert.Equal(1000, blobSize)
+}
+
+func TestReplaceReadSpoolDescriptor(t *testing.T) {
+	assert := assert.New(t)
+
+	alice := &Contact{
+		Nickname:             "alice",
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+		frameHeader:          true,
+		spoolUpdate:          true,
+	}
+	bob := &Contact{
+		Nickname:             "bob",
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+		frameHeader:          true,
+	}
+	c := &Client{
+		contacts:            map[uint64]*Contact{1: alice, 2: bob},
+		paused:              true,
+		randReader:          rand.Reader,
+		spoolReadDescriptor: &memspoolclient.SpoolReadDescriptor{ID: [common.SpoolIDSize]byte{1}, ReadOffset: 7},
+		inboxReads:          make(map[[cConstants.MessageIDLength]byte]struct{}),
+		inboxDrained:        true,
+		sendMap:             new(sync.Map),
+		conversations:       make(map[string]map[MessageID]*Message),
+		conversationsMutex:  new(sync.Mutex),
+		eventCh:             channels.NewInfiniteChannel(),
+		clock:               realClock{},
+		log:                 logging.MustGetLogger("catshadow"),
+	}
+	c.storeSent([cConstants.MessageIDLength]byte{1}, &SentMessageDescriptor{Nickname: c.user})
+	c.inboxReads[[cConstants.MessageIDLength]byte{1}] = struct{}{}
+
+	assert.Equal(ErrNoRemoteSpool, c.doReplaceReadSpoolDescriptor(nil))
+	desc := &memspoolclient.SpoolReadDescriptor{ID: [common.SpoolIDSize]byte{2}, Provider: "provider", ReadOffset: 3}
+	assert.NoError(c.doReplaceReadSpoolDescriptor(desc))
+	assert.Equal(desc, c.spoolReadDescriptor)
+	assert.Equal(uint32(0), c.spoolReadDescriptor.ReadOffset)
+	assert.False(c.inboxDrained)
+	assert.Empty(c.inboxReads)
+	assert.Equal(0, c.SendMapSize())
+
+	// alice is told about the new spool, bob must be rekeyed
+	assert.Equal(1, alice.outbound.Len())
+	assert.Equal(0, bob.outbound.Len())
+	assert.Equal(&ContactRekeyNeededEvent{Nickname: "bob"}, <-c.eventCh.Out())
+	assert.Equal(&RemoteSpoolRecreatedEvent{Provider: "provider"}, <-c.eventCh.Out())
+	assert.Error(c.enqueueFrame(bob, MessageID{1}, &frame{SpoolUpdate: true}, 0))
+}
+
+func TestDeliveryTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	clock := &testClock{now: now}
+	c := &Client{
+		conversations: map[string]map[MessageID]*Message{
+			"alice": {
+				// composed long ago but sent recently
+				{1}: {Outbound: true, Sent: true, Timestamp: now.Add(-time.Hour), SentAt: now},
+				// queued while offline, never sent
+				{2}: {Outbound: true, Queued: true, Timestamp: now.Add(-time.Hour)},
+				// loaded from a statefile predating the Sent flag
+				{3}: {Outbound: true, Timestamp: now.Add(-time.Hour)},
+				{4}: {Outbound: true, Sent: true, Delivered: true, Timestamp: now, SentAt: now},
+				{5}: {Outbound: false, Timestamp: now.Add(-time.Hour)},
+			},
+		},
+		conversationsMutex: new(sync.Mutex),
+		stateWorker:        &memoryStateStore{},
+		eventCh:            channels.NewInfiniteChannel(),
+		clock:              clock,
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	WithDeliveryTimeout(time.Minute)(c)
+	c.checkDeliveryTimeouts()
+	assert.Equal(0, c.eventCh.Len())
+
+	clock.now = now.Add(2 * time.Minute)
+	c.checkDeliveryTimeouts()
+	assert.Equal(&MessageDeliveryTimeoutEvent{Nickname: "alice", MessageID: MessageID{1}}, <-c.eventCh.Out())
+	assert.Equal(0, c.eventCh.Len())
+	for id, message := range c.conversations["alice"] {
+		assert.Equal(id == MessageID{1}, message.Failed)
+	}
+}
+
+func TestSpoolWriteFailureOfRemovedContact(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		sendMap:            new(sync.Map),
+		contactNicknames:   make(map[string]*Contact),
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		eventCh:            channels.NewInfiniteChannel(),
+		clock:              realClock{},
+		log:                logging.MustGetLogger("catshadow"),
+	}
+	// the reply to a write rejected by the spool of
+	// a contact arrives after the contact was removed
+	mesgID := [cConstants.MessageIDLength]byte{1}
+	c.storeSent(mesgID, &SentMessageDescriptor{Nickname: "alice", MessageID: MessageID{1}})
+	assert.NotPanics(func() {
+		c.handleReply(&client.MessageReplyEvent{MessageID: &mesgID})
+	})
+	assert.Equal(0, c.SendMapSize())
+	assert.Equal(0, c.eventCh.Len())
+}
+
+func TestRatchetInfoFrameHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{
+		contactNicknames: map[string]*Contact{
+			"alice": {
+				Nickname:     "alice",
+				outbound:     new(Queue),
+				ratchetMutex: new(sync.Mutex),
+				frameHeader:  true,
+			},
+			"bob": {
+				Nickname:     "bob",
+				outbound:     new(Queue),
+				ratchetMutex: new(sync.Mutex),
+			},
+		},
+	}
+	info, ok := c.doRatchetInfo("alice").(RatchetInfo)
+	assert.True(ok)
+	assert.True(info.FrameHeader)
+	info, ok = c.doRatchetInfo("bob").(RatchetInfo)
+	assert.True(ok)
+	assert.False(info.FrameHeader)
+}
+
+func TestRatchetInfoSent(t *testing.T) {
+	assert := assert.New(t)
+
+	// the contact can't decode frame headers,
+	// so no sequence numbers are assigned
+	alice := &Contact{
+		Nickname:             "alice",
+		outbound:             new(Queue),
+		ratchet:              new(ratchet.Ratchet),
+		ratchetMutex:         new(sync.Mutex),
+		spoolWriteDescriptor: &memspoolclient.SpoolWriteDescriptor{},
+	}
+	c := &Client{
+		clock:            realClock{},
+		contactNicknames: map[string]*Contact{"alice": alice},
+		paused:           true,
+		log:              logging.MustGetLogger("catshadow"),
+	}
+	assert.NoError(c.enqueueFrame(alice, MessageID{1}, &frame{Message: []byte("hi")}, 0))
+	assert.NoError(c.enqueueFrame(alice, MessageID{2}, &frame{Message: []byte("hi")}, 0))
+	info := c.doRatchetInfo("alice").(RatchetInfo)
+	assert.Equal(uint64(2), info.Sent)
+	assert.Equal(uint64(0), alice.sendSequence)
+
+	blob, err := alice.MarshalBinary()
+	assert.NoError(err)
+	loaded := new(Contact)
+	assert.NoError(loaded.UnmarshalBinary(blob))
+	assert.Equal(uint64(2), loaded.sendCount)
+}
+
+func TestReplayedMessageDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	ciphertext := []byte("ciphertext")
+	alice := &Contact{
+		Nickname:     "alice",
+		id:           1,
+		outbound:     new(Queue),
+		ratchet:      new(ratchet.Ratchet),
+		ratchetMutex: new(sync.Mutex),
+		seenMessages: map[[sha256.Size]byte]time.Time{sha256.Sum256(ciphertext): time.Now()},
+	}
+
+	// the seen messages survive a restart
+	blob, err := alice.MarshalBinary()
+	assert.NoError(err)
+	loaded := new(Contact)
+	assert.NoError(loaded.UnmarshalBinary(blob))
+	loaded.ratchetMutex = new(sync.Mutex)
+
+	c := &Client{
+		contacts: map[uint64]*Contact{1: loaded},
+		log:      logging.MustGetLogger("catshadow"),
+	}
+	tried := 0
+	c.decryptionFailure = func(messageID [cConstants.MessageIDLength]byte, ciphertext []byte, errs map[string]error) bool {
+		tried++
+		return false
+	}
+
+	// a replayed spool entry is dropped before trial decryption
+	assert.False(c.decryptMessage(&[cConstants.MessageIDLength]byte{1}, ciphertext))
+	assert.Equal(0, tried)
+	assert.Empty(c.quarantined)
+
+	assert.False(c.decryptMessage(&[cConstants.MessageIDLength]byte{2}, []byte("other ciphertext")))
+	assert.Equal(1, tried)
+}
+
+func TestOfflineQueueing(t *testing.T) {
+	assert := assert.New(t)
+
+	c, session := newTestClient(t)
+	store := c.stateWorker.(*memoryStateStore)
+	addTestContact(t, c, &Contact{Nickname: "alice"})
+	c.doSetOffline(true)
+	c.doSendMessage(MessageID{1}, "alice", 0, []byte("hello"), 0)
+	assert.Empty(session.sent)
+	assert.Equal(1, c.contactNicknames["alice"].outbound.Len())
+	assert.True(c.conversations["alice"][MessageID{1}].Queued)
+
+	// the offline mode is persisted
+	state, err := unmarshalState(store.states[len(store.states)-1])
+	assert.NoError(err)
+	assert.True(state.Offline)
+
+	c.doSetOffline(false)
+	assert.Len(session.sent, 1)
+	message := c.conversations["alice"][MessageID{1}]
+	assert.False(message.Queued)
+	assert.Equal(1, message.Attempts)
+}
+
+func TestMaxInboxReads(t *testing.T) {
+	assert := assert.New(t)
+
+	c, session := newTestClient(t)
+
+	// by default a single read awaits its reply at a time
+	c.sendReadInbox()
+	c.sendReadInbox()
+	assert.Len(session.sent, 1)
+	assert.Len(c.inboxReads, 1)
+
+	c.handleReply(&client.MessageReplyEvent{MessageID: &[cConstants.MessageIDLength]byte{1}})
+	assert.Empty(c.inboxReads)
+	c.sendReadInbox()
+	assert.Len(session.sent, 2)
+
+	// a read whose reply won't arrive anymore is given up
+	c.garbageCollectSendMap(&client.MessageIDGarbageCollected{MessageID: [cConstants.MessageIDLength]byte{2}})
+	assert.Empty(c.inboxReads)
+
+	WithMaxInboxReads(2)(c)
+	c.sendReadInbox()
+	c.sendReadInbox()
+	c.sendReadInbox()
+	assert.Len(session.sent, 4)
+	assert.Len(c.inboxReads, 2)
+}
+
+func TestKeyExchangeRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	c, _ := newTestClient(t)
+	alice := addTestContact(t, c, &Contact{
+		Nickname:          "alice",
+		IsPending:         true,
+		pandaKeyExchange:  []byte("panda"),
+		pandaShutdownChan: make(chan struct{}),
+	})
+
+	// a timed out exchange is retried and doesn't appear failed
+	c.processPANDAUpdate(&panda.PandaUpdate{ID: 1, Err: client.ErrReplyTimeout})
+	assert.Equal(&KeyExchangeRetryEvent{Nickname: "alice", Err: client.ErrReplyTimeout}, <-c.eventCh.Out())
+	assert.Equal(0, c.eventCh.Len())
+	assert.Equal("", alice.pandaResult)
+	assert.NotNil(alice.pandaKeyExchange)
+	assert.Equal(PhaseExchanging, alice.phase())
+
+	// other errors are terminal
+	exchangeErr := errors.New("gave up")
+	c.processPANDAUpdate(&panda.PandaUpdate{ID: 1, Err: exchangeErr})
+	assert.Equal(&KeyExchangeCompletedEvent{Nickname: "alice", Err: exchangeErr}, <-c.eventCh.Out())
+	assert.Equal(PhaseFailed, alice.phase())
+}
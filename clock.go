@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// clock.go - clock
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"time"
+)
+
+// Clock is the source of the current time used by the Client.
+// It can be replaced with WithClock to test time dependent behavior.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// realClock is the Clock returning the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -19,6 +19,7 @@
 package catshadow
 
 import (
+	"crypto"
 	"time"
 
 	ratchet "github.com/katzenpost/doubleratchet"
@@ -29,9 +30,19 @@ const (
 	// DoubleRatchetPayloadLength is the length of the payload encrypted by the ratchet.
 	DoubleRatchetPayloadLength = common.SpoolPayloadLength - ratchet.DoubleRatchetOverhead
 
+	// StateChecksumAlgorithm is the hash function of the checksum of
+	// the serialized state, which is verified before the state is
+	// decoded when it is loaded.
+	StateChecksumAlgorithm = crypto.SHA256
+
 	// MessageExpirationDuration is the duration of time after which messages will be removed.
 	MessageExpirationDuration = 168 * time.Hour
 
+	// MaxMessageDelay is the largest delay between the time a contact
+	// sent a message and the time we received it which is accepted,
+	// timestamps of received messages are bounded by it.
+	MaxMessageDelay = 72 * time.Hour
+
 	// MessageIDLen is the length of our message IDs which are used the keys in a map
 	// to reference individual messages of a conversation.
 	MessageIDLen = 4
@@ -39,4 +50,87 @@ const (
 	// GarbageCollectionInterval is the time interval between garbage collecting
 	// old messages.
 	GarbageCollectionInterval = 120 * time.Minute
+
+	// DeliveryTimeoutCheckInterval is the time interval between checking
+	// outbound messages for an expired delivery timeout.
+	DeliveryTimeoutCheckInterval = time.Minute
+
+	// InboxStallCheckInterval is the time interval between checking
+	// whether the reads of our remote spool are answered.
+	InboxStallCheckInterval = time.Minute
+
+	// DefaultInboxStallTimeout is the default duration without a valid
+	// reply to the reads of our remote spool after which the inbox is
+	// considered stalled.
+	DefaultInboxStallTimeout = 15 * time.Minute
+
+	// SendMapSweepInterval is the time interval between sweeping
+	// the stale entries of the map of sent messages.
+	SendMapSweepInterval = 10 * time.Minute
+
+	// SendMapTTL is the duration after which a sent message whose
+	// reply didn't arrive is forgotten.
+	SendMapTTL = time.Hour
+
+	// ExpireMessagesInterval is the time interval between
+	// deleting the disappearing messages whose time has come.
+	ExpireMessagesInterval = 10 * time.Second
+
+	// PANDARetryInterval is the time interval between retrying the
+	// PANDA key exchanges deferred for lack of a PANDA configuration.
+	PANDARetryInterval = time.Minute
+
+	// DefaultPANDAGracePeriod is the default duration after which a PANDA
+	// key exchange deferred for lack of a PANDA configuration is fatal.
+	DefaultPANDAGracePeriod = time.Hour
+
+	// DefaultInboundLimit is the default number of messages of a contact
+	// which are received within the DefaultInboundWindow, further messages
+	// are dropped until the window ends. It is zero, i.e. there is no
+	// limit by default: the window is measured by the time of reception,
+	// so reading a backlog after a reconnect would count as flooding.
+	DefaultInboundLimit = 0
+
+	// DefaultInboundWindow is the default window of the inbound limit.
+	DefaultInboundWindow = 10 * time.Minute
+
+	// GetServiceAttempts is the number of attempts to find the spool
+	// service in the PKI document when creating our remote spool.
+	GetServiceAttempts = 3
+
+	// GetServiceRetryInterval is the time interval between the
+	// attempts to find the spool service in the PKI document.
+	GetServiceRetryInterval = 10 * time.Second
+
+	// MaxQuarantinedMessages is the number of undecryptable messages
+	// which are kept to retry their decryption once a key exchange
+	// completes.
+	MaxQuarantinedMessages = 16
+
+	// MaxHeldMessages is the number of messages of a contact
+	// which are held while the contact awaits approval.
+	MaxHeldMessages = 64
+
+	// PreviewLength is the maximum length in bytes of
+	// the message previews of ContactsWithPreview.
+	PreviewLength = 64
+
+	// MaxFileSize is the largest file which can be sent with SendFile.
+	MaxFileSize = 4 << 20
+
+	// FileTransferWindow is the number of chunks of a file
+	// transfer which are queued for a contact at a time.
+	FileTransferWindow = 4
+
+	// DefaultDeliveryLogBuffer is the default number of
+	// DeliveryRecords buffered for the delivery log.
+	DefaultDeliveryLogBuffer = 1024
+
+	// DefaultMaxInboxReads is the default number of reads of our
+	// remote spool which may await their reply at a time.
+	DefaultMaxInboxReads = 1
+
+	// DefaultInboxReadInterleave is the default number of messages
+	// transmitted to contacts after which our remote spool is read.
+	DefaultInboxReadInterleave = 4
 )
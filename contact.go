@@ -19,19 +19,57 @@
 package catshadow
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/client"
+	"github.com/katzenpost/client/config"
 	"github.com/katzenpost/core/crypto/rand"
 	ratchet "github.com/katzenpost/doubleratchet"
 	memspoolClient "github.com/katzenpost/memspool/client"
 )
 
+// featureFrameHeader is set in the Features of the contact exchange by
+// peers which can decode the header fields of a frame. Peers predating it
+// misinterpret the header flags as part of the message length.
+const featureFrameHeader = 1 << 0
+
+// featureCompression is set in the Features of the contact exchange
+// by peers which can decode frames with a compressed message.
+const featureCompression = 1 << 1
+
+// featureDisappearing is set in the Features of the contact exchange by
+// peers which apply the disappearing message timers we set.
+const featureDisappearing = 1 << 2
+
+// featureFileTransfer is set in the Features of the contact
+// exchange by peers which can receive file transfers.
+const featureFileTransfer = 1 << 3
+
+// featureDeliveryAck is set in the Features of the contact exchange
+// by peers which acknowledge the messages they received and which
+// understand the acknowledgements of their messages.
+const featureDeliveryAck = 1 << 4
+
+// featureRemoteDelete is set in the Features of the contact exchange by
+// peers which delete the messages upon our request.
+const featureRemoteDelete = 1 << 5
+
+// featureSpoolUpdate is set in the Features of the contact exchange by
+// peers which write to our new remote spool once we announce it.
+const featureSpoolUpdate = 1 << 6
+
+// featureChannels is set in the Features of the contact exchange by
+// peers which decode the channel of the messages.
+const featureChannels = 1 << 7
+
 type contactExchange struct {
 	SpoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
 	SignedKeyExchange    *ratchet.SignedKeyExchange
+	Features             uint32
 }
 
 // NewContactExchangeBytes returns serialized contact exchange information.
@@ -39,6 +77,7 @@ func NewContactExchangeBytes(spoolWriteDescriptor *memspoolClient.SpoolWriteDesc
 	exchange := contactExchange{
 		SpoolWriteDescriptor: spoolWriteDescriptor,
 		SignedKeyExchange:    signedKeyExchange,
+		Features:             featureFrameHeader | featureCompression | featureDisappearing | featureFileTransfer | featureDeliveryAck | featureRemoteDelete | featureSpoolUpdate | featureChannels,
 	}
 	return cbor.Marshal(exchange)
 }
@@ -63,12 +102,34 @@ type serializedContact struct {
 	Ratchet              []byte
 	Outbound             *Queue
 	SpoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
+	SeenMessages         map[[sha256.Size]byte]time.Time
+	SendSequence         uint64
+	RecvSequence         uint64
+	RecvCount            uint64
+	SendCount            uint64
+	PandaConfig          *config.Panda
+	Muted                bool
+	FrameHeader          bool
+	Compression          bool
+	Disappearing         bool
+	DisappearingTimer    time.Duration
+	FileTransfer         bool
+	DeliveryAck          bool
+	Reserved             bool
+	RemoteDelete         bool
+	Channels             bool
+	SpoolUpdate          bool
+	LastInboundAt        time.Time
+	AwaitingApproval     bool
+	HeldMessages         []*Message
+	Labels               []string
+	MissingSequences     map[uint64]bool
 }
 
 type boundExchange struct {
 	serialized []byte
-	recipient string
-	provider string
+	recipient  string
+	provider   string
 }
 
 // Contact is a communications contact that we have bidirectional
@@ -83,6 +144,10 @@ type Contact struct {
 	// IsPending is true if the key exchange has not been completed.
 	IsPending bool
 
+	// Labels are the local labels the contact is grouped by,
+	// they are not sent to the contact.
+	Labels []string
+
 	// keyExchange is the serialised double ratchet key exchange we generated.
 	keyExchange []byte
 
@@ -96,6 +161,10 @@ type Contact struct {
 	// pandaResult contains an error message if the PANDA exchange fails.
 	pandaResult string
 
+	// pandaConfig overrides the PANDA meeting place of the session
+	// for this contact, it is nil if the session default is used.
+	pandaConfig *config.Panda
+
 	// reunionKeyExchange is the serialized Reunion exchange state.
 	reunionKeyExchange map[uint64]boundExchange
 
@@ -118,33 +187,227 @@ type Contact struct {
 	// be sent
 	outbound *Queue
 	rtx      *time.Timer
+
+	// seenMessages maps the hashes of ciphertexts received from this
+	// contact to the time of their receipt, it is used to drop
+	// replayed spool entries.
+	seenMessages map[[sha256.Size]byte]time.Time
+
+	// sendSequence is the sequence number of the last message we sent
+	// and recvSequence is the highest sequence number we received.
+	sendSequence uint64
+	recvSequence uint64
+
+	// sendCount is the number of frames encrypted with the ratchet and
+	// recvCount is the number of messages decrypted with it.
+	sendCount uint64
+	recvCount uint64
+
+	// missingSequences are the sequence numbers below recvSequence
+	// of messages which were not yet received and may still arrive
+	// because they were overtaken by messages of a higher priority.
+	missingSequences map[uint64]bool
+
+	// muted is true if messages received from this
+	// contact should not trigger notifications.
+	muted bool
+
+	// frameHeader is true if the contact can decode the header fields of
+	// the frames we send. It is only announced in the key exchange, a
+	// contact established with an older client has to be rekeyed.
+	frameHeader bool
+
+	// compression is true if the contact can decode
+	// frames with a compressed message.
+	compression bool
+
+	// disappearing is true if the contact applies the
+	// disappearing message timers we set.
+	disappearing bool
+
+	// disappearingTimer is the duration after which messages of the
+	// conversation are deleted once delivered or received, zero if
+	// messages don't disappear.
+	disappearingTimer time.Duration
+
+	// fileTransfer is true if the contact can receive file transfers.
+	fileTransfer bool
+
+	// deliveryAck is true if the contact acknowledges
+	// the messages it received.
+	deliveryAck bool
+
+	// reserved is true for a pending contact created by ReserveContact
+	// until its key exchange is started by BeginKeyExchange.
+	reserved bool
+
+	// remoteDelete is true if the contact deletes
+	// messages upon our request.
+	remoteDelete bool
+
+	// channels is true if the contact decodes
+	// the channel of our messages.
+	channels bool
+
+	// spoolUpdate is true if the contact writes to
+	// our new remote spool once we announce it.
+	spoolUpdate bool
+
+	// lastInboundAt is the time at which the contact sent the most
+	// recent message we received, zero if we received none.
+	lastInboundAt time.Time
+
+	// awaitingApproval is true while the messages of the contact are
+	// held in heldMessages until the user approves the contact.
+	awaitingApproval bool
+	heldMessages     []*Message
+
+	// inboundCount is the number of messages received from the
+	// contact since inboundWindowStart, it is not persisted.
+	inboundWindowStart time.Time
+	inboundCount       int
+}
+
+// Phase is the phase of the key exchange with a contact.
+type Phase int
+
+const (
+	// PhaseReserved is the phase of a contact created by ReserveContact
+	// whose key exchange was not begun yet.
+	PhaseReserved Phase = iota
+	// PhaseExchanging is the phase of a key exchange in progress.
+	PhaseExchanging
+	// PhaseEstablished is the phase of a completed key exchange.
+	PhaseEstablished
+	// PhaseFailed is the phase of a failed key exchange,
+	// which can be restarted with RestartKeyExchange.
+	PhaseFailed
+)
+
+// String returns the name of the Phase.
+func (p Phase) String() string {
+	switch p {
+	case PhaseReserved:
+		return "reserved"
+	case PhaseExchanging:
+		return "exchanging"
+	case PhaseEstablished:
+		return "established"
+	case PhaseFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+}
+
+// phase returns the Phase of the key exchange with the Contact.
+func (c *Contact) phase() Phase {
+	switch {
+	case !c.IsPending:
+		return PhaseEstablished
+	case c.reserved:
+		return PhaseReserved
+	case c.pandaResult != "":
+		return PhaseFailed
+	case len(c.reunionResult) > 0 && len(c.reunionKeyExchange) == 0:
+		// all Reunion exchanges gave up
+		return PhaseFailed
+	default:
+		return PhaseExchanging
+	}
+}
+
+// ContactInfo describes a contact.
+type ContactInfo struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// IsPending is true if the key exchange has not been completed.
+	IsPending bool
+
+	// State is the state of the contact and its conversation.
+	State ContactState
+
+	// Labels are the local labels of the contact.
+	Labels []string
+
+	// LastInboundAt is the time at which the contact sent the most
+	// recent message we received, zero if we received none.
+	LastInboundAt time.Time
+}
+
+// RatchetInfo is diagnostic information about the
+// double ratchet shared with a contact.
+type RatchetInfo struct {
+	// Sent is the number of messages encrypted with the ratchet.
+	Sent uint64
+
+	// Received is the number of messages decrypted with the ratchet.
+	Received uint64
+
+	// LastReceivedSequence is the highest sequence number received.
+	LastReceivedSequence uint64
+
+	// UnACKed is the number of outbound messages which have not been
+	// acknowledged by the remote spool of the contact.
+	UnACKed int
+
+	// FrameHeader is true if the contact announced in the key exchange
+	// that it can decode frame headers. Without them messages carry no
+	// sequence numbers or timestamps and can't be edited, which only
+	// RekeyContact can change.
+	FrameHeader bool
 }
 
 // NewContact creates a new Contact or returns an error.
 func NewContact(nickname string, id uint64, spoolReadDescriptor *memspoolClient.SpoolReadDescriptor, session *client.Session) (*Contact, error) {
-	ratchet, err := ratchet.InitRatchet(rand.Reader)
-	if err != nil {
+	contact := &Contact{
+		Nickname:          nickname,
+		id:                id,
+		IsPending:         true,
+		ratchetMutex:      new(sync.Mutex),
+		pandaShutdownChan: make(chan struct{}),
+		outbound:          new(Queue),
+		seenMessages:      make(map[[sha256.Size]byte]time.Time),
+		missingSequences:  make(map[uint64]bool),
+	}
+	if err := contact.newKeyExchange(spoolReadDescriptor); err != nil {
 		return nil, err
 	}
-	signedKeyExchange, err := ratchet.CreateKeyExchange()
+	return contact, nil
+}
+
+// newKeyExchange replaces the double ratchet of the Contact with a fresh
+// one and prepares the serialized contact exchange for the key exchange.
+func (c *Contact) newKeyExchange(spoolReadDescriptor *memspoolClient.SpoolReadDescriptor) error {
+	r, exchange, err := createKeyExchange(spoolReadDescriptor)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	c.ratchetMutex.Lock()
+	c.ratchet = r
+	c.ratchetMutex.Unlock()
+	c.keyExchange = exchange
+	return nil
+}
+
+// createKeyExchange returns a fresh double ratchet and the serialized
+// contact exchange announcing it along with the given remote spool.
+func createKeyExchange(spoolReadDescriptor *memspoolClient.SpoolReadDescriptor) (*ratchet.Ratchet, []byte, error) {
+	r, err := ratchet.InitRatchet(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	signedKeyExchange, err := r.CreateKeyExchange()
+	if err != nil {
+		return nil, nil, err
 	}
 	spoolWriteDescriptor := spoolReadDescriptor.GetWriteDescriptor()
 	exchange, err := NewContactExchangeBytes(spoolWriteDescriptor, signedKeyExchange)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &Contact{
-		Nickname:          nickname,
-		id:                id,
-		IsPending:         true,
-		ratchet:           ratchet,
-		ratchetMutex:      new(sync.Mutex),
-		keyExchange:       exchange,
-		pandaShutdownChan: make(chan struct{}),
-		outbound:          new(Queue),
-	}, nil
+	return r, exchange, nil
 }
 
 // ID returns the Contact ID.
@@ -155,9 +418,12 @@ func (c *Contact) ID() uint64 {
 // MarshalBinary does what you expect and returns
 // a serialized Contact.
 func (c *Contact) MarshalBinary() ([]byte, error) {
-	ratchetBlob, err := c.ratchet.MarshalBinary()
-	if err != nil {
-		return nil, err
+	var ratchetBlob []byte
+	if c.ratchet != nil {
+		var err error
+		if ratchetBlob, err = c.ratchet.MarshalBinary(); err != nil {
+			return nil, err
+		}
 	}
 	s := &serializedContact{
 		ID:                   c.id,
@@ -171,6 +437,28 @@ func (c *Contact) MarshalBinary() ([]byte, error) {
 		Ratchet:              ratchetBlob,
 		SpoolWriteDescriptor: c.spoolWriteDescriptor,
 		Outbound:             c.outbound,
+		SeenMessages:         c.seenMessages,
+		SendSequence:         c.sendSequence,
+		RecvSequence:         c.recvSequence,
+		RecvCount:            c.recvCount,
+		SendCount:            c.sendCount,
+		PandaConfig:          c.pandaConfig,
+		Muted:                c.muted,
+		FrameHeader:          c.frameHeader,
+		Compression:          c.compression,
+		Disappearing:         c.disappearing,
+		DisappearingTimer:    c.disappearingTimer,
+		FileTransfer:         c.fileTransfer,
+		DeliveryAck:          c.deliveryAck,
+		Reserved:             c.reserved,
+		RemoteDelete:         c.remoteDelete,
+		Channels:             c.channels,
+		SpoolUpdate:          c.spoolUpdate,
+		LastInboundAt:        c.lastInboundAt,
+		AwaitingApproval:     c.awaitingApproval,
+		HeldMessages:         c.heldMessages,
+		Labels:               c.Labels,
+		MissingSequences:     c.missingSequences,
 	}
 	return cbor.Marshal(s)
 }
@@ -191,7 +479,11 @@ func (c *Contact) UnmarshalBinary(data []byte) error {
 
 	err = r.UnmarshalBinary(s.Ratchet)
 	if err != nil {
-		return err
+		if s.IsPending {
+			return err
+		}
+		// the contact is loaded as corrupt, see corrupt
+		r = nil
 	}
 
 	c.id = s.ID
@@ -205,10 +497,48 @@ func (c *Contact) UnmarshalBinary(data []byte) error {
 	c.ratchet = r
 	c.spoolWriteDescriptor = s.SpoolWriteDescriptor
 	c.outbound = s.Outbound
+	c.sendSequence = s.SendSequence
+	c.recvSequence = s.RecvSequence
+	c.recvCount = s.RecvCount
+	c.sendCount = s.SendCount
+	c.pandaConfig = s.PandaConfig
+	c.muted = s.Muted
+	c.frameHeader = s.FrameHeader
+	c.compression = s.Compression
+	c.disappearing = s.Disappearing
+	c.disappearingTimer = s.DisappearingTimer
+	c.fileTransfer = s.FileTransfer
+	c.deliveryAck = s.DeliveryAck
+	c.reserved = s.Reserved
+	c.remoteDelete = s.RemoteDelete
+	c.channels = s.Channels
+	c.spoolUpdate = s.SpoolUpdate
+	c.lastInboundAt = s.LastInboundAt
+	c.awaitingApproval = s.AwaitingApproval
+	c.heldMessages = s.HeldMessages
+	c.Labels = s.Labels
+	c.missingSequences = s.MissingSequences
+	if c.missingSequences == nil {
+		c.missingSequences = make(map[uint64]bool)
+	}
+	c.seenMessages = s.SeenMessages
+	if c.seenMessages == nil {
+		c.seenMessages = make(map[[sha256.Size]byte]time.Time)
+	}
 
 	return nil
 }
 
+// corrupt returns true if the key exchange with the contact has
+// completed but its double ratchet is missing, e.g. because it
+// failed to load. Nothing can be sent to or received from the
+// contact until it is rekeyed.
+func (c *Contact) corrupt() bool {
+	return !c.IsPending && c.ratchet == nil
+}
+
 func (c *Contact) Destroy() {
-	ratchet.DestroyRatchet(c.ratchet)
+	if c.ratchet != nil {
+		ratchet.DestroyRatchet(c.ratchet)
+	}
 }
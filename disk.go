@@ -19,6 +19,8 @@
 package catshadow
 
 import (
+	"bytes"
+	_ "crypto/sha256" // StateChecksumAlgorithm
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -36,8 +38,14 @@ import (
 )
 
 const (
+	// stateFormatChecksum is the first byte of a serialized state
+	// followed by its checksum, the states serialized before the
+	// checksum was introduced are bare CBOR maps.
+	stateFormatChecksum = 0x01
+
 	keySize   = 32
 	nonceSize = 24
+	saltSize  = 16
 )
 
 // Message encapsulates message that is sent or received.
@@ -45,6 +53,108 @@ type Message struct {
 	Plaintext []byte
 	Timestamp time.Time
 	Outbound  bool
+
+	// Sequence is the per contact sequence number of the message
+	// which gives the order in which the sender sent its messages.
+	// It is zero for received messages of peers which don't send
+	// sequence numbers.
+	Sequence uint64
+
+	// Priority is the transmission priority of an outbound message,
+	// queued messages with a higher priority are sent first.
+	Priority int
+
+	// Queued is set for outbound messages composed while offline
+	// until their transmission is first attempted.
+	Queued bool
+
+	// Sent and Delivered are set for outbound messages once they
+	// have been sent to and written to the remote spool respectively.
+	Sent      bool
+	Delivered bool
+
+	// SentAt and DeliveredAt are the times at which an outbound message
+	// was first sent and delivered respectively, they are the zero time
+	// until then.
+	SentAt      time.Time
+	DeliveredAt time.Time
+
+	// Received is set for outbound messages once the contact
+	// acknowledged that its client received them.
+	Received bool
+
+	// Failed is set for outbound messages which were not
+	// delivered within the delivery timeout.
+	Failed bool
+
+	// Read is set for received messages once
+	// their conversation is marked as read.
+	Read bool
+
+	// Channel is the channel of the message, see SendMessageOnChannel.
+	Channel uint8
+
+	// Authenticated is set for received messages which were decrypted
+	// with the double ratchet shared with the contact, as opposed to
+	// messages inserted locally, e.g. with AppendHistoricalMessage or
+	// ImportConversation, which can't be attributed to the contact.
+	Authenticated bool
+
+	// Expires is the time at which a disappearing message is
+	// deleted, it is the zero time for other messages.
+	Expires time.Time
+
+	// Attempts is the number of times an outbound message
+	// was transmitted to the remote spool of the contact.
+	Attempts int
+
+	// EditHistory holds the previous contents of an edited
+	// message, oldest first.
+	EditHistory [][]byte
+}
+
+// clone returns a copy of the Message which doesn't share
+// any memory with the original.
+func (m *Message) clone() *Message {
+	n := *m
+	n.Plaintext = make([]byte, len(m.Plaintext))
+	copy(n.Plaintext, m.Plaintext)
+	n.EditHistory = nil
+	for _, p := range m.EditHistory {
+		n.EditHistory = append(n.EditHistory, append([]byte{}, p...))
+	}
+	return &n
+}
+
+// expiresAt returns the time after which the Message is deleted, by the
+// garbage collection of the conversations or earlier if it disappears.
+func (m *Message) expiresAt() time.Time {
+	expires := m.Timestamp.Add(MessageExpirationDuration)
+	if !m.Expires.IsZero() && m.Expires.Before(expires) {
+		return m.Expires
+	}
+	return expires
+}
+
+// edit replaces the content of the Message with a copy of the
+// given plaintext and keeps the previous content in the edit history.
+func (m *Message) edit(plaintext []byte) {
+	m.EditHistory = append(m.EditHistory, m.Plaintext)
+	m.Plaintext = append([]byte{}, plaintext...)
+}
+
+// wipe overwrites the content and the edit history of the Message
+// with zeros. The Message owns its content, it is copied when the
+// Message is stored and when it is handed out.
+func (m *Message) wipe() {
+	for i := range m.Plaintext {
+		m.Plaintext[i] = 0
+	}
+	for _, p := range m.EditHistory {
+		for i := range p {
+			p[i] = 0
+		}
+	}
 }
 
 // State is the struct type representing the Client's state
@@ -56,6 +166,20 @@ type State struct {
 	Provider            string
 	LinkKey             *ecdh.PrivateKey
 	Conversations       map[string]map[MessageID]*Message
+	Offline             bool
+	FileTransfers       map[TransferID]*fileTransfer
+	IncomingFiles       map[TransferID]*incomingFile
+}
+
+// StateStore persists the serialized state of a Client,
+// StateWriter is the StateStore of the encrypted statefile.
+type StateStore interface {
+	// WriteState stores the serialized state and
+	// returns once it is written durably.
+	WriteState(payload []byte) error
+
+	// Halt is called upon Shutdown of the Client.
+	Halt()
 }
 
 // StateWriter takes ownership of the Client's encrypted statefile
@@ -71,6 +195,45 @@ type StateWriter struct {
 	key *[32]byte
 }
 
+// checksumState prefixes the serialized state with its checksum.
+func checksumState(serialized []byte) []byte {
+	h := StateChecksumAlgorithm.New()
+	h.Write(serialized)
+	payload := make([]byte, 0, 1+h.Size()+len(serialized))
+	payload = append(payload, stateFormatChecksum)
+	payload = h.Sum(payload)
+	return append(payload, serialized...)
+}
+
+// unmarshalState verifies the checksum of the serialized
+// state and decodes it, it returns ErrStateCorrupt if the
+// checksum doesn't match.
+func unmarshalState(payload []byte) (*State, error) {
+	serialized := payload
+	switch {
+	case len(payload) > 0 && payload[0]>>5 == 5:
+		// a CBOR map without checksum
+	case len(payload) > 0 && payload[0] == stateFormatChecksum:
+		h := StateChecksumAlgorithm.New()
+		if len(payload) < 1+h.Size() {
+			return nil, ErrStateCorrupt
+		}
+		checksum := payload[1 : 1+h.Size()]
+		serialized = payload[1+h.Size():]
+		h.Write(serialized)
+		if !bytes.Equal(h.Sum(nil), checksum) {
+			return nil, ErrStateCorrupt
+		}
+	default:
+		return nil, ErrStateCorrupt
+	}
+	state := new(State)
+	if err := cbor.Unmarshal(serialized, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
 func encryptState(state []byte, key *[32]byte) ([]byte, error) {
 	nonce := [nonceSize]byte{}
 	_, err := rand.Reader.Read(nonce[:])
@@ -94,12 +257,44 @@ func decryptState(ciphertext []byte, key *[32]byte) ([]byte, error) {
 }
 
 func stretchKey(passphrase []byte) *[32]byte {
-	secret := argon2.Key(passphrase, nil, 3, 32*1024, 4, keySize)
+	return stretchKeyWithSalt(passphrase, nil)
+}
+
+func stretchKeyWithSalt(passphrase, salt []byte) *[32]byte {
+	secret := argon2.Key(passphrase, salt, 3, 32*1024, 4, keySize)
 	key := [keySize]byte{}
 	copy(key[:], secret)
 	return &key
 }
 
+// encryptExportedState encrypts the serialized state with a key derived
+// from the passphrase and a random salt which is prepended to the blob.
+func encryptExportedState(state []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Reader.Read(salt); err != nil {
+		return nil, err
+	}
+	ciphertext, err := encryptState(state, stretchKeyWithSalt(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, ciphertext...), nil
+}
+
+// ImportState decrypts a state exported with ExportState, the returned
+// State is used to construct the Client on the new device with New.
+func ImportState(blob, passphrase []byte) (*State, error) {
+	if len(blob) < saltSize+nonceSize+secretbox.Overhead {
+		return nil, errors.New("exported state is truncated")
+	}
+	key := stretchKeyWithSalt(passphrase, blob[:saltSize])
+	plaintext, err := decryptState(blob[saltSize:], key)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalState(plaintext)
+}
+
 func decryptStateFile(stateFile string, key *[32]byte) (*State, error) {
 	rawFile, err := ioutil.ReadFile(stateFile)
 	if err != nil {
@@ -109,11 +304,7 @@ func decryptStateFile(stateFile string, key *[32]byte) (*State, error) {
 	if err != nil {
 		return nil, err
 	}
-	state := new(State)
-	if err = cbor.Unmarshal(plaintext, &state); err != nil {
-		return nil, err
-	}
-	return state, nil
+	return unmarshalState(plaintext)
 }
 
 func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
@@ -130,6 +321,14 @@ func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
 	}
 	_, err = out.Write(ciphertext)
 	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
 		return err
 	}
 	if err := os.Rename(outFn, backupFn); err != nil && !os.IsNotExist(err) {
@@ -177,7 +376,8 @@ func (w *StateWriter) Start() {
 	w.Go(w.worker)
 }
 
-func (w *StateWriter) writeState(payload []byte) error {
+// WriteState encrypts the serialized state and writes it to the statefile.
+func (w *StateWriter) WriteState(payload []byte) error {
 	return encryptStateFile(w.stateFile, payload, w.key)
 }
 
@@ -188,7 +388,7 @@ func (w *StateWriter) worker() {
 			w.log.Debugf("Terminating gracefully.")
 			return
 		case newState := <-w.stateCh:
-			err := w.writeState(newState)
+			err := w.WriteState(newState)
 			if err != nil {
 				w.log.Errorf("Failure to write state to disk: %s", err)
 				panic(err)
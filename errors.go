@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// errors.go - catshadow errors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import "errors"
+
+// ErrContactNotFound is the error issued when
+// there is no contact with the given nickname or ID.
+var ErrContactNotFound = errors.New("contact not found")
+
+// ErrStateCorrupt is the error issued when the checksum
+// of the state does not match upon loading it.
+var ErrStateCorrupt = errors.New("state is corrupt")
+
+// ErrContactCorrupt is the error issued when the contact has no double
+// ratchet, e.g. because it failed to load, see ContactCorruptEvent.
+var ErrContactCorrupt = errors.New("contact has no double ratchet")
+
+// ErrNoRemoteSpool is the error issued when our remote
+// spool has not been created yet.
+var ErrNoRemoteSpool = errors.New("remote spool was not created yet")
+
+// ErrMessageNotFound is the error issued when there
+// is no message with the given message ID.
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrMessageExpired is the error issued when a message is too old
+// to be stored because it would be garbage collected right away.
+var ErrMessageExpired = errors.New("message is expired")
+
+// ErrTransferNotFound is the error issued when there
+// is no file transfer with the given ID.
+var ErrTransferNotFound = errors.New("file transfer not found")
+
+// ErrMixnetClientHalted is the shutdown reason
+// of a Client whose mixnet client halted.
+var ErrMixnetClientHalted = errors.New("mixnet client halted")
+
+// ErrNotMaintenance is the error issued when a recovery operation
+// is requested from a Client which is not in maintenance mode.
+var ErrNotMaintenance = errors.New("client is not in maintenance mode")
+
+// ErrReadOnly is the error issued when a read-only
+// Client is asked to send or to exchange keys.
+var ErrReadOnly = errors.New("client is read-only")
+
+// ErrMessageTooLarge is the error issued when a message does not fit
+// into a single double ratchet payload.
+var ErrMessageTooLarge = errors.New("message is too large")
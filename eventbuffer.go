@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// eventbuffer.go - bounded event buffer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"sync/atomic"
+
+	"gopkg.in/eapache/channels.v1"
+)
+
+// boundedChannel is a channels.Channel buffering at most size values.
+// A value written to a full boundedChannel either replaces the oldest
+// buffered value or is dropped itself.
+type boundedChannel struct {
+	input      chan interface{}
+	output     chan interface{}
+	size       int
+	dropOldest bool
+
+	// length and dropped are accessed atomically.
+	length  int32
+	dropped uint64
+}
+
+func newBoundedChannel(size int, dropOldest bool) *boundedChannel {
+	ch := &boundedChannel{
+		input:      make(chan interface{}),
+		output:     make(chan interface{}),
+		size:       size,
+		dropOldest: dropOldest,
+	}
+	go ch.run()
+	return ch
+}
+
+func (ch *boundedChannel) In() chan<- interface{} {
+	return ch.input
+}
+
+func (ch *boundedChannel) Out() <-chan interface{} {
+	return ch.output
+}
+
+func (ch *boundedChannel) Len() int {
+	return int(atomic.LoadInt32(&ch.length))
+}
+
+func (ch *boundedChannel) Cap() channels.BufferCap {
+	return channels.BufferCap(ch.size)
+}
+
+func (ch *boundedChannel) Close() {
+	close(ch.input)
+}
+
+// Dropped returns the number of values dropped because the buffer was full.
+func (ch *boundedChannel) Dropped() uint64 {
+	return atomic.LoadUint64(&ch.dropped)
+}
+
+func (ch *boundedChannel) run() {
+	var buffer []interface{}
+	input := ch.input
+	for input != nil || len(buffer) > 0 {
+		var output chan interface{}
+		var next interface{}
+		if len(buffer) > 0 {
+			output = ch.output
+			next = buffer[0]
+		}
+		select {
+		case v, ok := <-input:
+			if !ok {
+				input = nil
+				continue
+			}
+			switch {
+			case len(buffer) < ch.size:
+				buffer = append(buffer, v)
+			case ch.dropOldest:
+				buffer[0] = nil
+				buffer = append(buffer[1:], v)
+				atomic.AddUint64(&ch.dropped, 1)
+			default:
+				atomic.AddUint64(&ch.dropped, 1)
+			}
+		case output <- next:
+			buffer[0] = nil
+			buffer = buffer[1:]
+		}
+		atomic.StoreInt32(&ch.length, int32(len(buffer)))
+	}
+	close(ch.output)
+}
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// eventbuffer_test.go - bounded event buffer tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitLen waits for the buffer of ch to hold n values.
+func waitLen(ch *boundedChannel, n int) {
+	for ch.Len() != n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBoundedChannel(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, dropOldest := range []bool{true, false} {
+		ch := newBoundedChannel(2, dropOldest)
+		for i := 1; i <= 3; i++ {
+			ch.In() <- i
+		}
+		waitLen(ch, 2)
+		assert.Equal(uint64(1), ch.Dropped())
+		if dropOldest {
+			assert.Equal(2, <-ch.Out())
+			assert.Equal(3, <-ch.Out())
+		} else {
+			assert.Equal(1, <-ch.Out())
+			assert.Equal(2, <-ch.Out())
+		}
+		ch.In() <- 4
+		ch.Close()
+		assert.Equal(4, <-ch.Out())
+		_, ok := <-ch.Out()
+		assert.False(ok)
+	}
+}
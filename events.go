@@ -32,6 +32,116 @@ type KeyExchangeCompletedEvent struct {
 	Err error
 }
 
+// ContactCreatedEvent is an event signaling that
+// a contact was added to the Client's state.
+type ContactCreatedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// IsPending is true if the key exchange with
+	// the contact has not completed yet.
+	IsPending bool
+}
+
+// ContactApprovalRequestedEvent is an event signaling that the messages
+// of a contact are held until ApproveContact or RejectContact is called
+// since the ContactApprovalFunc did not approve the new conversation.
+type ContactApprovalRequestedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+}
+
+// ContactFloodingEvent is an event signaling that a contact exceeded
+// the limit of messages set with WithInboundLimit, its messages are
+// dropped until the end of the current window.
+type ContactFloodingEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// Until is the end of the window during which
+	// the messages of the contact are dropped.
+	Until time.Time
+}
+
+// ContactReadyEvent is an event signaling upon Start that the key
+// exchange with a contact loaded from the statefile has completed.
+type ContactReadyEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+}
+
+// ContactCorruptEvent is an event signaling upon Start that the double
+// ratchet of a contact loaded from the statefile is missing, nothing can
+// be sent to or received from the contact until it is rekeyed with
+// RekeyContact or removed.
+type ContactCorruptEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+}
+
+// ContactRemovedEvent is an event signaling that
+// a contact was removed from the Client's state.
+type ContactRemovedEvent struct {
+	// Nickname is the nickname of the removed contact.
+	Nickname string
+}
+
+// RemoteSpoolCreatingEvent is an event signaling that
+// EnsureRemoteSpool is creating our remote spool.
+type RemoteSpoolCreatingEvent struct{}
+
+// RemoteSpoolCreatedEvent is an event signaling the creation
+// of our remote spool or failure if Err is non-nil.
+type RemoteSpoolCreatedEvent struct {
+	// Err is the error which caused the failure or is set to nil on success.
+	Err error
+}
+
+// RemoteSpoolRecreatedEvent is an event signaling that our remote
+// spool was replaced by a new one with RecreateRemoteSpool, the
+// unread messages of the previous spool are lost.
+type RemoteSpoolRecreatedEvent struct {
+	// Provider is the provider of the new remote spool.
+	Provider string
+}
+
+// ContactRenamedEvent is an event signaling that a contact of the
+// statefile was renamed upon loading since another contact, or the notes
+// to self, have the same nickname. The conversation under the nickname
+// stays with the other contact or the notes.
+type ContactRenamedEvent struct {
+	// Nickname and ID identify the contact which kept the nickname,
+	// the ID is zero if the nickname is our own user name.
+	Nickname string
+	ID       uint64
+	// Renamed is the new nickname of the contact with the ID RenamedID.
+	Renamed   string
+	RenamedID uint64
+}
+
+// ContactRekeyNeededEvent is an event signaling that the contact can't
+// reach us anymore since it doesn't learn our new remote spool, e.g. after
+// RecreateRemoteSpool, until the key exchange with the contact is redone.
+type ContactRekeyNeededEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+}
+
+// KeyExchangeRetryEvent is an event signaling that the key exchange
+// with the contact timed out and is being retried.
+type KeyExchangeRetryEvent struct {
+	// Nickname is the nickname of the contact with whom
+	// the key exchange is being retried.
+	Nickname string
+	// Err is the error which caused the retry.
+	Err error
+}
+
+// ContactSpoolUpdatedEvent is an event signaling that the spool
+// write descriptor of a contact has been replaced.
+type ContactSpoolUpdatedEvent struct {
+	// Nickname is the nickname of the contact whose spool changed.
+	Nickname string
+}
+
 // MessageNotSentEvent is an event signalling that the message
 // was not sent.
 type MessageNotSentEvent struct {
@@ -52,8 +162,22 @@ type MessageSentEvent struct {
 	MessageID MessageID
 }
 
+// MessageRetransmitEvent is the event signaling that a message
+// which was sent before is retransmitted to the contact.
+type MessageRetransmitEvent struct {
+	// Nickname is the nickname of the recipient of the message.
+	Nickname string
+	// MessageID is the ID of the message in the conversation.
+	MessageID MessageID
+	// Attempt is the number of transmissions of the message
+	// including this one, it is at least two.
+	Attempt int
+}
+
 // MessageDeliveredEvent is an event signaling that the message
-// has been delivered to the remote spool.
+// has been delivered to the remote spool. It does not mean that the
+// contact fetched the message from its spool yet, which is signaled
+// by a MessageEndToEndDeliveredEvent.
 type MessageDeliveredEvent struct {
 	// Nickname is the nickname of the recipient of our delivered message.
 	Nickname string
@@ -62,12 +186,263 @@ type MessageDeliveredEvent struct {
 	MessageID MessageID
 }
 
+// MessageEndToEndDeliveredEvent is an event signaling that the contact
+// acknowledged the receipt of the message, i.e. that its client fetched
+// and decrypted the message. Only contacts announcing the support for
+// acknowledgements in their key exchange send them.
+type MessageEndToEndDeliveredEvent struct {
+	// Nickname is the nickname of the recipient of the message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// MessageGapEvent is the event signaling that messages from a contact
+// were skipped, as detected by a gap in the message sequence numbers.
+type MessageGapEvent struct {
+	// Nickname is the nickname of the contact whose messages are missing.
+	Nickname string
+	// Missing is the number of skipped messages.
+	Missing uint64
+}
+
+// MessageGapFilledEvent is the event signaling that a message which
+// was reported missing by a MessageGapEvent was received late, e.g.
+// because it was overtaken by a message sent with a higher priority.
+type MessageGapFilledEvent struct {
+	// Nickname is the nickname of the contact who sent the message.
+	Nickname string
+	// Sequence is the sequence number of the received message.
+	Sequence uint64
+}
+
+// MessageDeliveryTimeoutEvent is an event signaling that the message
+// was not delivered to the remote spool within the delivery timeout
+// and has been marked as failed.
+type MessageDeliveryTimeoutEvent struct {
+	// Nickname is the nickname of the recipient of our message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// SpoolWriteFailedEvent is the event signaling that the remote spool
+// of the contact rejected our message, e.g. because the spool is full
+// or was removed.
+type SpoolWriteFailedEvent struct {
+	// Nickname is the nickname of the recipient of our message.
+	Nickname string
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+	// Status is the error status returned by the spool service.
+	Status string
+}
+
 // MessageReceivedEvent is the event signaling that a message was received.
 type MessageReceivedEvent struct {
 	// Nickname is the nickname from whom we received a message.
 	Nickname string
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
 	// Message is the message content which was received.
 	Message []byte
-	// Timestamp is the time the message was received.
+	// Timestamp is the time the message was sent by the contact,
+	// bounded by the time it was received.
 	Timestamp time.Time
+	// Muted is true if the contact is muted and the
+	// message should not trigger a notification.
+	Muted bool
+	// Channel is the channel on which the contact sent the
+	// message, it is 0 for messages sent with SendMessage.
+	Channel uint8
+	// IsFirstMessage is true if the message starts
+	// the conversation with the contact.
+	IsFirstMessage bool
+}
+
+// MessageEditedEvent is the event signaling that a contact
+// replaced the content of a previously received message.
+type MessageEditedEvent struct {
+	// Nickname is the nickname of the contact who edited the message.
+	Nickname string
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+	// Message is the new message content.
+	Message []byte
+}
+
+// MessageRemotelyDeletedEvent is the event signaling that a contact
+// deleted a previously received message for everyone.
+type MessageRemotelyDeletedEvent struct {
+	// Nickname is the nickname of the contact who deleted the message.
+	Nickname string
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// SpoolOffsetAdvancedEvent is the event signaling that the read
+// offset of our remote spool advanced past a message read from it.
+type SpoolOffsetAdvancedEvent struct {
+	// Previous is the read offset before the advance.
+	Previous uint32
+	// Offset is the read offset after the advance.
+	Offset uint32
+}
+
+// DisappearingTimerChangedEvent is the event signaling that the
+// disappearing message timer of a conversation was set.
+type DisappearingTimerChangedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// Timer is the duration after which messages are deleted
+	// once delivered or received, zero if they don't disappear.
+	Timer time.Duration
+	// Remote is true if the contact set the timer.
+	Remote bool
+}
+
+// FileTransferProgressEvent is the event signaling the
+// delivery of a chunk of a file transfer to a contact.
+type FileTransferProgressEvent struct {
+	// TransferID is the ID returned by SendFile.
+	TransferID TransferID
+	// Nickname is the nickname of the recipient of the file.
+	Nickname string
+	// BytesDelivered is the number of bytes of the file delivered,
+	// the transfer is complete once it equals Total.
+	BytesDelivered int
+	// Total is the size of the file.
+	Total int
+}
+
+// FileTransferFailedEvent is the event signaling
+// that a file transfer to a contact failed.
+type FileTransferFailedEvent struct {
+	// TransferID is the ID returned by SendFile.
+	TransferID TransferID
+	// Nickname is the nickname of the recipient of the file.
+	Nickname string
+	// Err is the error which caused the failure.
+	Err error
+}
+
+// FileReceivedEvent is the event signaling that
+// a file was received from a contact.
+type FileReceivedEvent struct {
+	// Nickname is the nickname of the sender of the file.
+	Nickname string
+	// TransferID is the ID of the transfer chosen by the sender.
+	TransferID TransferID
+	// Filename is the name of the file given by the sender.
+	Filename string
+	// Data is the content of the file.
+	Data []byte
+}
+
+// InboxDrainedEvent is the event signaling that all pending messages
+// have been read from our remote spool.
+type InboxDrainedEvent struct{}
+
+// InboxStalledEvent is the event signaling that the reads of our remote
+// spool were not answered validly for the inbox stall timeout such that
+// no messages are received. The spool is read again and reading resumes
+// silently once it answers.
+type InboxStalledEvent struct {
+	// Since is the time of the last valid reply.
+	Since time.Time
+	// Offset is the read offset of our remote spool.
+	Offset uint32
+}
+
+// WorkerPanicEvent is the event signaling that the worker of
+// the Client panicked and recovered, see WithWorkerRecovery.
+type WorkerPanicEvent struct {
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+	// Restarted is true if the worker was restarted, the
+	// panic is a fatal error of the Client otherwise.
+	Restarted bool
+}
+
+// StateCompactedEvent is the event signaling that
+// the statefile was rewritten by Compact.
+type StateCompactedEvent struct {
+	// Before and After are the sizes in bytes of the serialized
+	// state before and after the compaction, see StateSize.
+	Before int
+	After  int
+}
+
+// InternalErrorEvent is the event signaling a programming
+// error of the Client which it survives, e.g. an unknown
+// operation sent to its worker.
+type InternalErrorEvent struct {
+	// Err is the error.
+	Err error
+}
+
+// EventNickname returns the nickname of the contact the
+// given event concerns and false if it concerns no contact.
+func EventNickname(event interface{}) (string, bool) {
+	switch e := event.(type) {
+	case *ContactCreatedEvent:
+		return e.Nickname, true
+	case *ContactReadyEvent:
+		return e.Nickname, true
+	case *ContactCorruptEvent:
+		return e.Nickname, true
+	case *ContactRemovedEvent:
+		return e.Nickname, true
+	case *KeyExchangeCompletedEvent:
+		return e.Nickname, true
+	case *KeyExchangeRetryEvent:
+		return e.Nickname, true
+	case *MessageNotSentEvent:
+		return e.Nickname, true
+	case *MessageSentEvent:
+		return e.Nickname, true
+	case *MessageDeliveredEvent:
+		return e.Nickname, true
+	case *MessageGapEvent:
+		return e.Nickname, true
+	case *MessageGapFilledEvent:
+		return e.Nickname, true
+	case *MessageDeliveryTimeoutEvent:
+		return e.Nickname, true
+	case *SpoolWriteFailedEvent:
+		return e.Nickname, true
+	case *MessageReceivedEvent:
+		return e.Nickname, true
+	case *MessageEditedEvent:
+		return e.Nickname, true
+	case *DisappearingTimerChangedEvent:
+		return e.Nickname, true
+	case *ContactSpoolUpdatedEvent:
+		return e.Nickname, true
+	case *ContactRekeyNeededEvent:
+		return e.Nickname, true
+	case *ContactRenamedEvent:
+		return e.Renamed, true
+	case *ContactFloodingEvent:
+		return e.Nickname, true
+	case *ContactApprovalRequestedEvent:
+		return e.Nickname, true
+	case *MessageRemotelyDeletedEvent:
+		return e.Nickname, true
+	case *MessageEndToEndDeliveredEvent:
+		return e.Nickname, true
+	case *MessageRetransmitEvent:
+		return e.Nickname, true
+	case *FileTransferProgressEvent:
+		return e.Nickname, true
+	case *FileTransferFailedEvent:
+		return e.Nickname, true
+	case *FileReceivedEvent:
+		return e.Nickname, true
+	}
+	return "", false
 }
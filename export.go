@@ -0,0 +1,251 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// export.go - conversation export
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// sortedMessageIDs returns the IDs of the given messages sorted by their
+// timestamps, ties are ordered by sequence number and ID.
+func sortedMessageIDs(messages map[MessageID]*Message) []MessageID {
+	ids := make([]MessageID, 0, len(messages))
+	for mesgID := range messages {
+		ids = append(ids, mesgID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := messages[ids[i]], messages[ids[j]]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.Sequence != b.Sequence {
+			return a.Sequence < b.Sequence
+		}
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// exportedMessage is the JSON representation of a Message.
+type exportedMessage struct {
+	ID        string    `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Direction string    `json:"direction"`
+	Message   string    `json:"message"`
+	Status    string    `json:"status,omitempty"`
+}
+
+func messageStatus(message *Message) string {
+	if !message.Outbound {
+		return ""
+	}
+	switch deliveryStatus(message) {
+	case StatusReceived:
+		return "received"
+	case StatusDelivered:
+		return "delivered"
+	case StatusFailed:
+		return "failed"
+	case StatusSent:
+		return "sent"
+	case StatusQueued:
+		return "queued"
+	default:
+		return "pending"
+	}
+}
+
+// ExportState returns the entire state of the Client, i.e. the contacts
+// with their double ratchets, the conversations, the spool descriptors
+// and the link key, encrypted with a key derived from the given
+// passphrase. It is independent of the statefile and migrates the Client
+// to another device with ImportState. The Client must not be used once
+// its state is exported: the ratchets of both devices would diverge.
+func (c *Client) ExportState(passphrase []byte) ([]byte, error) {
+	op := &opExportState{
+		passphrase:   passphrase,
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return nil, r
+	case []byte:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doExportState(passphrase []byte) interface{} {
+	state, err := c.marshal()
+	if err != nil {
+		return err
+	}
+	blob, err := encryptExportedState(state, passphrase)
+	if err != nil {
+		return err
+	}
+	return blob
+}
+
+// ExportConversation returns the messages of the conversation with the
+// given contact as a JSON array sorted by time. The export contains the
+// plaintext of the messages and must be handled with the same care as
+// the conversation itself.
+func (c *Client) ExportConversation(nickname string) ([]byte, error) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	messages, ok := c.conversations[nickname]
+	if !ok {
+		return nil, fmt.Errorf("no conversation with %s", nickname)
+	}
+	ids := sortedMessageIDs(messages)
+	export := make([]exportedMessage, 0, len(ids))
+	for _, mesgID := range ids {
+		message := messages[mesgID]
+		direction := "received"
+		if message.Outbound {
+			direction = "sent"
+		}
+		export = append(export, exportedMessage{
+			ID:        hex.EncodeToString(mesgID[:]),
+			Timestamp: message.Timestamp,
+			Direction: direction,
+			Message:   string(message.Plaintext),
+			Status:    messageStatus(message),
+		})
+	}
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// ImportConversation merges the messages of a conversation exported with
+// ExportConversation into the conversation with the given contact, e.g.
+// to restore the history backed up before the contact was added again.
+// Messages which are in the conversation already are skipped such that
+// importing is idempotent, expired messages are dropped. Nothing is sent
+// to the contact, imported messages which were not delivered are marked
+// as failed.
+func (c *Client) ImportConversation(nickname string, data []byte) error {
+	op := &opImportConversation{
+		name:         nickname,
+		data:         data,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doImportConversation(nickname string, data []byte) error {
+	if _, ok := c.contactNicknames[nickname]; !ok {
+		return ErrContactNotFound
+	}
+	var imported []exportedMessage
+	if err := json.Unmarshal(data, &imported); err != nil {
+		return err
+	}
+	messages := make(map[MessageID]*Message)
+	for i, exported := range imported {
+		var mesgID MessageID
+		if exported.ID != "" {
+			id, err := hex.DecodeString(exported.ID)
+			if err != nil || len(id) != MessageIDLen {
+				return fmt.Errorf("message %d has an invalid ID", i)
+			}
+			copy(mesgID[:], id)
+		}
+		message := &Message{
+			Plaintext: []byte(exported.Message),
+			Timestamp: exported.Timestamp,
+		}
+		switch exported.Direction {
+		case "sent":
+			message.Outbound = true
+			switch exported.Status {
+			case "received":
+				message.Delivered = true
+				message.Received = true
+			case "delivered":
+				message.Delivered = true
+			default:
+				message.Failed = true
+			}
+		case "received":
+			message.Read = true
+		default:
+			return fmt.Errorf("message %d has an invalid direction", i)
+		}
+		messages[mesgID] = message
+	}
+
+	c.conversationsMutex.Lock()
+	conversation, ok := c.conversations[nickname]
+	if !ok {
+		conversation = make(map[MessageID]*Message)
+	}
+	added := 0
+	for mesgID, message := range messages {
+		if c.clock.Now().After(message.Timestamp.Add(MessageExpirationDuration)) {
+			continue
+		}
+		if isImported(conversation, mesgID, message) {
+			continue
+		}
+		if _, ok := conversation[mesgID]; ok || mesgID == (MessageID{}) {
+			// the ID is taken by another message or missing
+			id, err := c.newMessageID()
+			if err != nil {
+				c.conversationsMutex.Unlock()
+				return err
+			}
+			mesgID = id
+		}
+		conversation[mesgID] = message
+		added++
+	}
+	if added > 0 {
+		c.conversations[nickname] = conversation
+	}
+	c.conversationsMutex.Unlock()
+	if added > 0 {
+		c.save()
+	}
+	return nil
+}
+
+// isImported returns true if the conversation has the given message,
+// either under the same ID or with the same timestamp and contents.
+func isImported(conversation map[MessageID]*Message, mesgID MessageID, message *Message) bool {
+	if existing, ok := conversation[mesgID]; ok && existing.Timestamp.Equal(message.Timestamp) {
+		return true
+	}
+	for _, existing := range conversation {
+		if existing.Outbound == message.Outbound &&
+			existing.Timestamp.Equal(message.Timestamp) &&
+			bytes.Equal(existing.Plaintext, message.Plaintext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,372 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// frame.go - ratchet payload framing
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// The payload encrypted by the double ratchet starts with a four byte big
+// endian prefix. The lower 22 bits of the prefix hold the length of the
+// message and the upper 10 bits are flags signaling which optional header
+// fields follow the prefix. The two lowest flag bits used to be part of
+// the length, which never exceeds DoubleRatchetPayloadLength. Header
+// fields are written in the order of their flag bits and are followed by
+// the message. Peers predating the header fields always set the flags to
+// zero and fail to decode frames with header fields, which must therefore
+// only be sent to peers that announced featureFrameHeader in their contact
+// exchange. Likewise compressed messages must only be sent to peers that
+// announced featureCompression, timers to peers that announced
+// featureDisappearing, chunks to peers that announced featureFileTransfer,
+// acknowledgements to peers that announced featureDeliveryAck, deletes to
+// peers that announced featureRemoteDelete, spool updates, which announce
+// our remote spool after RecreateRemoteSpool, to peers that announced
+// featureSpoolUpdate and channels to peers that announced featureChannels.
+const (
+	framePrefixLength = 4
+	frameLengthMask   = 0x003fffff
+
+	// frameChannel flags the 1 byte channel of the message, the
+	// channel is zero if the flag is not set.
+	frameChannel = 1 << 22
+
+	// frameSpoolUpdate flags a message which holds the CBOR encoded
+	// spool write descriptor of the remote spool the sender moved to.
+	frameSpoolUpdate = 1 << 23
+
+	// frameSequence flags an 8 byte big endian sequence number.
+	frameSequence = 1 << 24
+
+	// frameEdit flags an 8 byte big endian sequence number of a
+	// previously sent message which the message replaces.
+	frameEdit = 1 << 25
+
+	// frameTimestamp flags the 8 byte big endian time at which the
+	// message was sent in nanoseconds since the Unix epoch.
+	frameTimestamp = 1 << 26
+
+	// frameCompressed flags a message compressed with DEFLATE, the
+	// length in the prefix is the length of the compressed message.
+	frameCompressed = 1 << 27
+
+	// frameTimer flags the 8 byte big endian disappearing message
+	// timer in nanoseconds which the sender set for the conversation.
+	frameTimer = 1 << 28
+
+	// frameChunk flags the 8 byte big endian ID of a file transfer
+	// followed by the 4 byte big endian index of the chunk carried
+	// by the message and the 4 byte big endian number of chunks.
+	frameChunk       = 1 << 29
+	frameChunkLength = 16
+
+	// frameAck flags the 8 byte big endian sequence number of a
+	// message received from the peer which the frame acknowledges.
+	frameAck = 1 << 30
+
+	// frameDelete flags the 8 byte big endian sequence number of a
+	// previously sent message which the recipient should delete.
+	frameDelete = 1 << 31
+
+	// maxDecompressedLength bounds the length of a decompressed message.
+	maxDecompressedLength = 0x00ffffff
+)
+
+// errInvalidFrame is the error issued when a decrypted
+// payload is not a well formed frame.
+var errInvalidFrame = errors.New("invalid frame")
+
+// frame is the decoded payload of a double ratchet message.
+type frame struct {
+	// Sequence is the per contact sequence number of the message,
+	// it is zero if the sender did not include one.
+	Sequence uint64
+
+	// Edit is the sequence number of the message which is replaced
+	// by this message, it is zero if the message is not an edit.
+	Edit uint64
+
+	// Timestamp is the time at which the message was sent, it is
+	// the zero time if the sender did not include one.
+	Timestamp time.Time
+
+	// SetTimer is true if the frame sets the disappearing message
+	// timer of the conversation to Timer, zero disables it.
+	SetTimer bool
+	Timer    time.Duration
+
+	// TransferID, ChunkIndex and ChunkCount identify the chunk of
+	// a file transfer carried by the message, ChunkCount is zero
+	// if the message is not a chunk.
+	TransferID uint64
+	ChunkIndex uint32
+	ChunkCount uint32
+
+	// Ack is the sequence number of the message of the recipient
+	// which the sender acknowledges as received, it is zero if the
+	// frame is not an acknowledgement.
+	Ack uint64
+
+	// Delete is the sequence number of a message previously sent by
+	// the sender which the recipient deletes, it is zero if the frame
+	// is not a delete.
+	Delete uint64
+
+	// Channel is the channel of the message chosen by the sender,
+	// it is zero if the sender did not include one.
+	Channel uint8
+
+	// SpoolUpdate is true if the message is the spool write
+	// descriptor of the new remote spool of the sender.
+	SpoolUpdate bool
+
+	// Compressed is true if the message is compressed in the payload.
+	// marshal only compresses the message if this makes it smaller.
+	Compressed bool
+
+	// Message is the message content.
+	Message []byte
+}
+
+func (f *frame) headerLength() int {
+	n := framePrefixLength
+	if f.Channel != 0 {
+		n++
+	}
+	if f.Sequence != 0 {
+		n += 8
+	}
+	if f.Edit != 0 {
+		n += 8
+	}
+	if !f.Timestamp.IsZero() {
+		n += 8
+	}
+	if f.SetTimer {
+		n += 8
+	}
+	if f.ChunkCount != 0 {
+		n += frameChunkLength
+	}
+	if f.Ack != 0 {
+		n += 8
+	}
+	if f.Delete != 0 {
+		n += 8
+	}
+	return n
+}
+
+// maxMessageLength returns the length of the longest message which fits
+// in the frame of a message sent with SendMessage, i.e. with a sequence
+// number and a timestamp.
+func maxMessageLength() int {
+	f := &frame{Sequence: 1, Timestamp: time.Unix(0, 1)}
+	return DoubleRatchetPayloadLength - f.headerLength()
+}
+
+// marshal returns the frame padded to DoubleRatchetPayloadLength.
+func (f *frame) marshal() ([]byte, error) {
+	message := f.Message
+	var prefix uint32
+	if f.Compressed {
+		compressed, err := compress(message)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(message) {
+			message = compressed
+			prefix |= frameCompressed
+		}
+	}
+	offset := f.headerLength()
+	if len(message) > DoubleRatchetPayloadLength-offset {
+		return nil, ErrMessageTooLarge
+	}
+	payload := make([]byte, DoubleRatchetPayloadLength)
+	prefix |= uint32(len(message))
+	if f.SpoolUpdate {
+		prefix |= frameSpoolUpdate
+	}
+	header := payload[framePrefixLength:]
+	if f.Channel != 0 {
+		prefix |= frameChannel
+		header[0] = f.Channel
+		header = header[1:]
+	}
+	if f.Sequence != 0 {
+		prefix |= frameSequence
+		binary.BigEndian.PutUint64(header, f.Sequence)
+		header = header[8:]
+	}
+	if f.Edit != 0 {
+		prefix |= frameEdit
+		binary.BigEndian.PutUint64(header, f.Edit)
+		header = header[8:]
+	}
+	if !f.Timestamp.IsZero() {
+		prefix |= frameTimestamp
+		binary.BigEndian.PutUint64(header, uint64(f.Timestamp.UnixNano()))
+		header = header[8:]
+	}
+	if f.SetTimer {
+		prefix |= frameTimer
+		binary.BigEndian.PutUint64(header, uint64(f.Timer))
+		header = header[8:]
+	}
+	if f.ChunkCount != 0 {
+		prefix |= frameChunk
+		binary.BigEndian.PutUint64(header, f.TransferID)
+		binary.BigEndian.PutUint32(header[8:], f.ChunkIndex)
+		binary.BigEndian.PutUint32(header[12:], f.ChunkCount)
+		header = header[frameChunkLength:]
+	}
+	if f.Ack != 0 {
+		prefix |= frameAck
+		binary.BigEndian.PutUint64(header, f.Ack)
+		header = header[8:]
+	}
+	if f.Delete != 0 {
+		prefix |= frameDelete
+		binary.BigEndian.PutUint64(header, f.Delete)
+	}
+	binary.BigEndian.PutUint32(payload, prefix)
+	copy(payload[offset:], message)
+	return payload, nil
+}
+
+// parseFrame decodes a decrypted double ratchet payload.
+func parseFrame(payload []byte) (*frame, error) {
+	if len(payload) < framePrefixLength {
+		return nil, errInvalidFrame
+	}
+	prefix := binary.BigEndian.Uint32(payload)
+	offset := framePrefixLength
+	f := new(frame)
+	f.SpoolUpdate = prefix&frameSpoolUpdate != 0
+	if prefix&frameChannel != 0 {
+		if len(payload) < offset+1 {
+			return nil, errInvalidFrame
+		}
+		f.Channel = payload[offset]
+		offset++
+	}
+	if prefix&frameSequence != 0 {
+		if len(payload) < offset+8 {
+			return nil, errInvalidFrame
+		}
+		f.Sequence = binary.BigEndian.Uint64(payload[offset:])
+		offset += 8
+	}
+	if prefix&frameEdit != 0 {
+		if len(payload) < offset+8 {
+			return nil, errInvalidFrame
+		}
+		f.Edit = binary.BigEndian.Uint64(payload[offset:])
+		offset += 8
+	}
+	if prefix&frameTimestamp != 0 {
+		if len(payload) < offset+8 {
+			return nil, errInvalidFrame
+		}
+		f.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(payload[offset:])))
+		offset += 8
+	}
+	if prefix&frameTimer != 0 {
+		if len(payload) < offset+8 {
+			return nil, errInvalidFrame
+		}
+		f.SetTimer = true
+		f.Timer = time.Duration(binary.BigEndian.Uint64(payload[offset:]))
+		if f.Timer < 0 {
+			return nil, errInvalidFrame
+		}
+		offset += 8
+	}
+	if prefix&frameChunk != 0 {
+		if len(payload) < offset+frameChunkLength {
+			return nil, errInvalidFrame
+		}
+		f.TransferID = binary.BigEndian.Uint64(payload[offset:])
+		f.ChunkIndex = binary.BigEndian.Uint32(payload[offset+8:])
+		f.ChunkCount = binary.BigEndian.Uint32(payload[offset+12:])
+		if f.ChunkIndex >= f.ChunkCount {
+			return nil, errInvalidFrame
+		}
+		offset += frameChunkLength
+	}
+	if prefix&frameAck != 0 {
+		if len(payload) < offset+8 {
+			return nil, errInvalidFrame
+		}
+		f.Ack = binary.BigEndian.Uint64(payload[offset:])
+		offset += 8
+	}
+	if prefix&frameDelete != 0 {
+		if len(payload) < offset+8 {
+			return nil, errInvalidFrame
+		}
+		f.Delete = binary.BigEndian.Uint64(payload[offset:])
+		offset += 8
+	}
+	messageLen := int(prefix & frameLengthMask)
+	if messageLen > len(payload)-offset {
+		return nil, errInvalidFrame
+	}
+	f.Message = payload[offset : offset+messageLen]
+	if prefix&frameCompressed != 0 {
+		message, err := decompress(f.Message)
+		if err != nil {
+			return nil, err
+		}
+		f.Compressed = true
+		f.Message = message
+	}
+	return f, nil
+}
+
+func compress(message []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(message); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(compressed []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	message, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedLength+1))
+	if err != nil || len(message) > maxDecompressedLength {
+		return nil, errInvalidFrame
+	}
+	return message, nil
+}
@@ -0,0 +1,291 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// frame_test.go - ratchet payload framing tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &frame{Sequence: 42, Message: []byte("hello")}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	assert.Equal(DoubleRatchetPayloadLength, len(payload))
+	f2, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(f, f2)
+
+	f = &frame{Sequence: 43, Edit: 42, Timestamp: time.Unix(0, 1600000000123456789), Message: []byte("hello, world")}
+	payload, err = f.marshal()
+	assert.NoError(err)
+	f2, err = parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(f, f2)
+
+	// a disappearing message timer without a message
+	f = &frame{Sequence: 44, Timestamp: time.Unix(0, 1600000000123456789), SetTimer: true, Timer: time.Hour, Message: []byte{}}
+	payload, err = f.marshal()
+	assert.NoError(err)
+	f2, err = parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(f, f2)
+
+	// frames from peers without header fields
+	legacy := make([]byte, DoubleRatchetPayloadLength)
+	binary.BigEndian.PutUint32(legacy, 5)
+	copy(legacy[4:], []byte("hello"))
+	f2, err = parseFrame(legacy)
+	assert.NoError(err)
+	assert.Equal(uint64(0), f2.Sequence)
+	assert.True(f2.Timestamp.IsZero())
+	assert.Equal([]byte("hello"), f2.Message)
+
+	f = &frame{Sequence: 1, Message: make([]byte, DoubleRatchetPayloadLength)}
+	_, err = f.marshal()
+	assert.Equal(ErrMessageTooLarge, err)
+}
+
+// legacyParse decodes a payload like peers predating the frame header.
+func legacyParse(payload []byte) (message []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("legacy decoder panic: %v", r)
+		}
+	}()
+	payloadLen := binary.BigEndian.Uint32(payload[:4])
+	return payload[4 : 4+payloadLen], nil
+}
+
+func TestFrameLegacyPeer(t *testing.T) {
+	assert := assert.New(t)
+
+	// the frame enqueueFrame sends to contacts without featureFrameHeader
+	f := &frame{Message: []byte("hello")}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	message, err := legacyParse(payload)
+	assert.NoError(err)
+	assert.Equal([]byte("hello"), message)
+
+	// header fields break legacy peers
+	f = &frame{Sequence: 1, Message: []byte("hello")}
+	payload, err = f.marshal()
+	assert.NoError(err)
+	_, err = legacyParse(payload)
+	assert.Error(err)
+
+	exchange, err := NewContactExchangeBytes(nil, nil)
+	assert.NoError(err)
+	parsed, err := parseContactExchangeBytes(exchange)
+	assert.NoError(err)
+	assert.NotZero(parsed.Features & featureFrameHeader)
+}
+
+func TestFrameCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	message := bytes.Repeat([]byte("hello, world "), DoubleRatchetPayloadLength/8)
+	f := &frame{Sequence: 1, Compressed: true, Message: message}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	assert.NotZero(binary.BigEndian.Uint32(payload) & frameCompressed)
+	f2, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(f, f2)
+
+	// uncompressed without the flag
+	_, err = (&frame{Sequence: 1, Message: message}).marshal()
+	assert.Equal(ErrMessageTooLarge, err)
+
+	// tiny messages are sent uncompressed
+	f = &frame{Sequence: 1, Compressed: true, Message: []byte("hi")}
+	payload, err = f.marshal()
+	assert.NoError(err)
+	assert.Zero(binary.BigEndian.Uint32(payload) & frameCompressed)
+	f2, err = parseFrame(payload)
+	assert.NoError(err)
+	assert.False(f2.Compressed)
+	assert.Equal([]byte("hi"), f2.Message)
+
+	// corrupt compressed messages are rejected
+	payload = make([]byte, DoubleRatchetPayloadLength)
+	binary.BigEndian.PutUint32(payload, frameCompressed|4)
+	copy(payload[4:], []byte{0xff, 0xff, 0xff, 0xff})
+	_, err = parseFrame(payload)
+	assert.Equal(errInvalidFrame, err)
+
+	exchange, err := NewContactExchangeBytes(nil, nil)
+	assert.NoError(err)
+	parsed, err := parseContactExchangeBytes(exchange)
+	assert.NoError(err)
+	assert.NotZero(parsed.Features & featureCompression)
+}
+
+func TestMaxMessageLength(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &frame{Sequence: 1, Timestamp: time.Now(), Message: make([]byte, maxMessageLength())}
+	_, err := f.marshal()
+	assert.NoError(err)
+	f.Message = append(f.Message, 0)
+	_, err = f.marshal()
+	assert.Equal(ErrMessageTooLarge, err)
+
+	// chunks carry their header fields in addition
+	assert.Equal(maxMessageLength()-frameChunkLength, fileChunkLength)
+}
+
+func TestFrameChunk(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &frame{
+		Sequence:   1,
+		Timestamp:  time.Unix(1234, 0),
+		TransferID: 42,
+		ChunkIndex: 1,
+		ChunkCount: 3,
+		Message:    bytes.Repeat([]byte{0x55}, fileChunkLength),
+	}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	f2, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(f.TransferID, f2.TransferID)
+	assert.Equal(f.ChunkIndex, f2.ChunkIndex)
+	assert.Equal(f.ChunkCount, f2.ChunkCount)
+	assert.Equal(f.Message, f2.Message)
+
+	// chunk indexes beyond the count are rejected
+	f.ChunkIndex = 3
+	payload, err = f.marshal()
+	assert.NoError(err)
+	_, err = parseFrame(payload)
+	assert.Error(err)
+}
+
+func TestParseFrameBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	// a length prefix beyond the end of the payload
+	payload := make([]byte, DoubleRatchetPayloadLength)
+	binary.BigEndian.PutUint32(payload, DoubleRatchetPayloadLength)
+	_, err := parseFrame(payload)
+	assert.Equal(errInvalidFrame, err)
+
+	// header fields beyond the end of the payload
+	binary.BigEndian.PutUint32(payload, frameSequence|frameEdit|frameTimestamp)
+	_, err = parseFrame(payload[:framePrefixLength+16])
+	assert.Equal(errInvalidFrame, err)
+
+	_, err = parseFrame(payload[:framePrefixLength-1])
+	assert.Equal(errInvalidFrame, err)
+
+	binary.BigEndian.PutUint32(payload, DoubleRatchetPayloadLength-framePrefixLength)
+	f, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.Len(f.Message, DoubleRatchetPayloadLength-framePrefixLength)
+}
+
+func TestFrameAck(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &frame{Sequence: 7, Ack: 3}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	f2, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(uint64(7), f2.Sequence)
+	assert.Equal(uint64(3), f2.Ack)
+	assert.Len(f2.Message, 0)
+
+	// an ack after a chunk header
+	f = &frame{TransferID: 1, ChunkIndex: 0, ChunkCount: 1, Ack: 9, Message: []byte("x")}
+	payload, err = f.marshal()
+	assert.NoError(err)
+	f2, err = parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(uint64(9), f2.Ack)
+	assert.Equal(uint32(1), f2.ChunkCount)
+	assert.Equal([]byte("x"), f2.Message)
+}
+
+func TestFrameDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &frame{Sequence: 4, Delete: 2}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	f2, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(uint64(4), f2.Sequence)
+	assert.Equal(uint64(2), f2.Delete)
+	assert.Equal(uint64(0), f2.Ack)
+}
+
+func TestFrameSpoolUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &frame{Sequence: 1, SpoolUpdate: true, Message: bytes.Repeat([]byte{0xff}, 300)}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	f2, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.True(f2.SpoolUpdate)
+	assert.Equal(f.Message, f2.Message)
+
+	f.SpoolUpdate = false
+	payload, err = f.marshal()
+	assert.NoError(err)
+	f2, err = parseFrame(payload)
+	assert.NoError(err)
+	assert.False(f2.SpoolUpdate)
+}
+
+func TestFrameChannel(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &frame{Channel: 7, Sequence: 2, Timestamp: time.Unix(10, 0), Message: []byte("presence")}
+	payload, err := f.marshal()
+	assert.NoError(err)
+	f2, err := parseFrame(payload)
+	assert.NoError(err)
+	assert.Equal(uint8(7), f2.Channel)
+	assert.Equal(uint64(2), f2.Sequence)
+	assert.Equal(f.Message, f2.Message)
+
+	// frames of channel 0 don't carry the channel
+	f.Channel = 0
+	payload2, err := f.marshal()
+	assert.NoError(err)
+	f2, err = parseFrame(payload2)
+	assert.NoError(err)
+	assert.Equal(uint8(0), f2.Channel)
+	assert.Equal(f.Message, f2.Message)
+
+	_, err = parseFrame(payload[:framePrefixLength])
+	assert.Error(err)
+}
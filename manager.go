@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// manager.go - multiple clients within one process
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/katzenpost/client"
+	"github.com/katzenpost/core/log"
+	"gopkg.in/eapache/channels.v1"
+)
+
+// UserEvent is an event of the Client of the given user,
+// as delivered by the event stream of a ClientManager.
+type UserEvent struct {
+	// User is the user of the Client.
+	User string
+	// Event is the event of the Client's EventSink.
+	Event interface{}
+}
+
+type managedClient struct {
+	client *Client
+	stopCh chan struct{}
+}
+
+// ClientManager hosts the Clients of several users within one process.
+// The Clients share a log backend and their events are merged into a
+// single stream of UserEvents. Each Client keeps its own statefile and
+// mixnet session.
+type ClientManager struct {
+	sync.Mutex
+
+	logBackend *log.Backend
+	clients    map[string]*managedClient
+	events     *channels.InfiniteChannel
+	forwarders sync.WaitGroup
+}
+
+// NewClientManager returns a ClientManager whose
+// Clients log to the given log backend.
+func NewClientManager(logBackend *log.Backend) *ClientManager {
+	return &ClientManager{
+		logBackend: logBackend,
+		clients:    make(map[string]*managedClient),
+		events:     channels.NewInfiniteChannel(),
+	}
+}
+
+// New constructs a Client with New using the shared log backend and
+// adds it to the ClientManager, the Client is yet to be started. The
+// ClientManager stays locked meanwhile, such that no other Client of the
+// user can be added before.
+func (m *ClientManager) New(mixnetClient *client.Client, stateWorker StateStore, state *State, opts ...Option) (*Client, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.clients[state.User]; ok {
+		return nil, fmt.Errorf("client of user %s already exists", state.User)
+	}
+	c, err := New(m.logBackend, mixnetClient, stateWorker, state, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m.add(c)
+	return c, nil
+}
+
+// Add adds a Client to the ClientManager under its user, its events are
+// read from its EventSink and delivered by Events from then on.
+func (m *ClientManager) Add(c *Client) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.clients[c.user]; ok {
+		return fmt.Errorf("client of user %s already exists", c.user)
+	}
+	m.add(c)
+	return nil
+}
+
+// add adds the Client, the ClientManager must be locked.
+func (m *ClientManager) add(c *Client) {
+	managed := &managedClient{
+		client: c,
+		stopCh: make(chan struct{}),
+	}
+	m.clients[c.user] = managed
+	m.forwarders.Add(1)
+	go m.forwardEvents(managed)
+}
+
+func (m *ClientManager) forwardEvents(managed *managedClient) {
+	defer m.forwarders.Done()
+	for {
+		select {
+		case <-managed.stopCh:
+			return
+		case event, ok := <-managed.client.EventSink:
+			if !ok {
+				return
+			}
+			m.events.In() <- &UserEvent{
+				User:  managed.client.user,
+				Event: event,
+			}
+		}
+	}
+}
+
+// Remove removes the Client of the given user from the ClientManager
+// and returns it, or false if there is none. The Client is not shut
+// down, its events must be read from its EventSink again.
+func (m *ClientManager) Remove(user string) (*Client, bool) {
+	m.Lock()
+	defer m.Unlock()
+	managed, ok := m.clients[user]
+	if !ok {
+		return nil, false
+	}
+	delete(m.clients, user)
+	close(managed.stopCh)
+	return managed.client, true
+}
+
+// Get returns the Client of the given user, or false if there is none.
+func (m *ClientManager) Get(user string) (*Client, bool) {
+	m.Lock()
+	defer m.Unlock()
+	managed, ok := m.clients[user]
+	if !ok {
+		return nil, false
+	}
+	return managed.client, true
+}
+
+// Users returns the sorted users of the Clients of the ClientManager.
+func (m *ClientManager) Users() []string {
+	m.Lock()
+	defer m.Unlock()
+	users := make([]string, 0, len(m.clients))
+	for user := range m.clients {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Events returns the merged stream of the events of all Clients as
+// UserEvents, the events are buffered until read. It is closed by
+// Shutdown.
+func (m *ClientManager) Events() <-chan interface{} {
+	return m.events.Out()
+}
+
+// Shutdown shuts down and removes all Clients of
+// the ClientManager and closes the event stream.
+func (m *ClientManager) Shutdown() {
+	m.Lock()
+	clients := m.clients
+	m.clients = make(map[string]*managedClient)
+	m.Unlock()
+	for _, managed := range clients {
+		managed.client.Shutdown()
+		close(managed.stopCh)
+	}
+	m.forwarders.Wait()
+	m.events.Close()
+}
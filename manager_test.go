@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// manager_test.go - client manager tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientManager(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewClientManager(nil)
+	alice := &Client{user: "alice", EventSink: make(chan interface{})}
+	bob := &Client{user: "bob", EventSink: make(chan interface{})}
+	assert.NoError(m.Add(bob))
+	assert.NoError(m.Add(alice))
+	assert.Error(m.Add(&Client{user: "alice"}))
+	assert.Equal([]string{"alice", "bob"}, m.Users())
+
+	c, ok := m.Get("alice")
+	assert.True(ok)
+	assert.Equal(alice, c)
+
+	alice.EventSink <- &InboxDrainedEvent{}
+	bob.EventSink <- &MessageSentEvent{Nickname: "carol"}
+	assert.Equal(&UserEvent{User: "alice", Event: &InboxDrainedEvent{}}, <-m.Events())
+	assert.Equal(&UserEvent{User: "bob", Event: &MessageSentEvent{Nickname: "carol"}}, <-m.Events())
+
+	// a closed EventSink ends the forwarding of the Client's events
+	close(bob.EventSink)
+
+	c, ok = m.Remove("alice")
+	assert.True(ok)
+	assert.Equal(alice, c)
+	_, ok = m.Remove("alice")
+	assert.False(ok)
+	_, ok = m.Get("alice")
+	assert.False(ok)
+	assert.Equal([]string{"bob"}, m.Users())
+	m.forwarders.Wait()
+}
@@ -18,10 +18,15 @@
 
 package catshadow
 
+import "time"
+
 type SentMessageDescriptor struct {
 	// Nickname is the contact nickname to whom a message was sent.
 	Nickname string
 
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
+
+	// Timestamp is the time at which the message was sent.
+	Timestamp time.Time
 }
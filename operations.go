@@ -18,10 +18,113 @@
 
 package catshadow
 
+import (
+	"time"
+
+	memspoolclient "github.com/katzenpost/memspool/client"
+)
 
 type opAddContact struct {
 	name         string
 	sharedSecret []byte
+	options      []ContactOption
+	// responseChan is nil unless the caller
+	// waits for the creation of the contact
+	responseChan chan error
+}
+
+type opCancelPendingContact struct {
+	name string
+}
+
+type opReserveContact struct {
+	name         string
+	options      []ContactOption
+	responseChan chan error
+}
+
+type opBeginKeyExchange struct {
+	name         string
+	sharedSecret []byte
+	responseChan chan error
+}
+
+type opMuteContact struct {
+	name         string
+	muted        bool
+	responseChan chan error
+}
+
+type opResendMessage struct {
+	name         string
+	id           MessageID
+	responseChan chan error
+}
+
+type opBroadcast struct {
+	names        []string
+	payload      []byte
+	responseChan chan *broadcastResult
+}
+
+type opMarkConversationRead struct {
+	name         string
+	responseChan chan error
+}
+
+type opContactsWithPreview struct {
+	responseChan chan []ContactPreview
+}
+
+type opTotalUnread struct {
+	responseChan chan int
+}
+
+type opEditMessage struct {
+	id           MessageID
+	target       MessageID
+	name         string
+	payload      []byte
+	responseChan chan error
+}
+
+type opDeleteMessageForEveryone struct {
+	id           MessageID
+	target       MessageID
+	name         string
+	responseChan chan error
+}
+
+type opApproveContact struct {
+	name         string
+	approved     bool
+	responseChan chan error
+}
+
+type opPendingKeyExchanges struct {
+	responseChan chan map[string]error
+}
+
+type opKeyExchangePhase struct {
+	name         string
+	responseChan chan interface{}
+}
+
+type opLastKeyExchangeResult struct {
+	name         string
+	responseChan chan interface{}
+}
+
+type opRekeyContact struct {
+	name         string
+	sharedSecret []byte
+	responseChan chan error
+}
+
+type opRestartKeyExchange struct {
+	name         string
+	sharedSecret []byte
+	responseChan chan error
 }
 
 type opRemoveContact struct {
@@ -29,11 +132,158 @@ type opRemoveContact struct {
 }
 
 type opSendMessage struct {
+	id       MessageID
+	name     string
+	channel  uint8
+	payload  []byte
+	priority int
+}
+
+type opSaveNote struct {
 	id      MessageID
-	name    string
 	payload []byte
 }
 
+type opSendMessageDurable struct {
+	id           MessageID
+	name         string
+	payload      []byte
+	responseChan chan error
+}
+
+type opSendMessageByID struct {
+	id           MessageID
+	contactID    uint64
+	payload      []byte
+	responseChan chan error
+}
+
+type opImportConversation struct {
+	name         string
+	data         []byte
+	responseChan chan error
+}
+
+type opAppendHistoricalMessage struct {
+	id           MessageID
+	name         string
+	message      *Message
+	responseChan chan error
+}
+
+type opSetOffline struct {
+	offline bool
+}
+
+type opSetPaused struct {
+	paused bool
+}
+
+type opRatchetInfo struct {
+	name         string
+	responseChan chan interface{}
+}
+
+type opOutboundBacklog struct {
+	responseChan chan map[string]int
+}
+
+type opRetransmitAll struct {
+	responseChan chan interface{}
+}
+
+type opReadSpoolDescriptor struct {
+	responseChan chan *memspoolclient.SpoolReadDescriptor
+}
+
+type opSetReadSpoolDescriptor struct {
+	descriptor   *memspoolclient.SpoolReadDescriptor
+	responseChan chan error
+}
+
+type opReplaceReadSpoolDescriptor struct {
+	descriptor   *memspoolclient.SpoolReadDescriptor
+	responseChan chan error
+}
+
+type opContactWriteDescriptor struct {
+	name         string
+	responseChan chan interface{}
+}
+
+type opSpoolCheckCommand struct {
+	name         string
+	responseChan chan interface{}
+}
+
+type opExportState struct {
+	passphrase   []byte
+	responseChan chan interface{}
+}
+
+type opSetContactLabel struct {
+	name         string
+	label        string
+	add          bool
+	responseChan chan error
+}
+
+type opContactsByLabel struct {
+	label        string
+	responseChan chan []ContactInfo
+}
+
+type opSendFile struct {
+	name         string
+	filename     string
+	data         []byte
+	responseChan chan interface{}
+}
+
+type opCancelFileTransfer struct {
+	id           TransferID
+	responseChan chan error
+}
+
+type opSetDisappearingTimer struct {
+	name         string
+	ttl          time.Duration
+	responseChan chan error
+}
+
+type opPruneBefore struct {
+	before       time.Time
+	undelivered  bool
+	responseChan chan int
+}
+
+type opFlush struct {
+	responseChan chan error
+}
+
+type opCompact struct {
+	responseChan chan error
+}
+
+type opStorageBreakdown struct {
+	responseChan chan interface{}
+}
+
+type opSummary struct {
+	responseChan chan Summary
+}
+
+type opSetReadOffset struct {
+	offset       uint32
+	responseChan chan error
+}
+
+type opHasContact struct {
+	name         string
+	id           uint64
+	responseChan chan bool
+}
+
 type opGetContacts struct {
 	responseChan chan map[string]*Contact
 }
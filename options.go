@@ -0,0 +1,363 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// options.go - client options
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"io"
+	"time"
+
+	"github.com/katzenpost/client"
+	"github.com/katzenpost/client/config"
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+// Option configures optional behavior of a Client
+// and is passed to the Client constructors.
+type Option func(*Client)
+
+// WithDeliveryTimeout sets the duration after which an outbound message
+// which was sent but has not been delivered to the remote spool is marked
+// as failed, measured from its first transmission. Messages which are
+// queued, e.g. while offline or paused, don't time out.
+// A zero timeout, the default, disables the delivery timeout.
+func WithDeliveryTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.deliveryTimeout = timeout
+	}
+}
+
+// WithMaxMessagesPerConversation sets the number of messages kept per
+// conversation, the oldest messages beyond it are removed by the garbage
+// collection. Undelivered outbound messages are never removed. A zero
+// maximum, the default, keeps all messages until they expire.
+func WithMaxMessagesPerConversation(max int) Option {
+	return func(c *Client) {
+		c.maxMessagesPerConversation = max
+	}
+}
+
+// WithClock sets the Clock used by the Client instead of the system time.
+func WithClock(clock Clock) Option {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+// WithRandomSource sets the source of the random contact, message and
+// transfer IDs of the Client instead of the system randomness, such that
+// tests can produce deterministic IDs. It must be safe for concurrent use.
+// The key material of the Client is always generated with the system
+// randomness.
+func WithRandomSource(r io.Reader) Option {
+	return func(c *Client) {
+		c.randReader = r
+	}
+}
+
+// WithInboxStallTimeout sets the duration without a valid reply to the
+// reads of our remote spool after which an InboxStalledEvent is emitted,
+// the default is DefaultInboxStallTimeout. A zero timeout disables it.
+func WithInboxStallTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.inboxStallTimeout = timeout
+	}
+}
+
+// WithMutedUnread counts the unread messages
+// of muted contacts towards TotalUnread.
+func WithMutedUnread() Option {
+	return func(c *Client) {
+		c.countMutedAsUnread = true
+	}
+}
+
+// PayloadTransformer transforms the double ratchet ciphertexts written to
+// the remote spools of contacts, e.g. to experiment with padding. Inverse
+// must undo Transform. Both must be deterministic and all clients of a
+// deployment must use the same PayloadTransformer: the messages of peers
+// with a mismatched transformer can't be decrypted.
+type PayloadTransformer interface {
+	// Transform transforms a ciphertext before it is sent.
+	Transform(ciphertext []byte) ([]byte, error)
+
+	// Inverse restores a received ciphertext.
+	Inverse(payload []byte) ([]byte, error)
+}
+
+// WithSession makes the Client use the given Session and its events
+// instead of a session of the mixnet client, e.g. to test the sending and
+// receiving of messages with a fake Session. Creating remote spools and
+// key exchanges still require a session of the mixnet client.
+func WithSession(session Session, events chan client.Event) Option {
+	return func(c *Client) {
+		c.session = session
+		c.sessionEvents = events
+	}
+}
+
+// WithReadOnly creates a read-only Client which reads its remote spool and
+// decrypts the received messages but never writes to the remote spools of
+// its contacts and runs no key exchanges, e.g. to archive the messages of
+// a mailbox which is used by another client. Sending messages, adding
+// contacts and retransmissions fail with ErrReadOnly.
+//
+// A read-only Client keeps its own read offset: reading a spool doesn't
+// remove the messages from it, so both clients receive every message.
+// Only the contacts of the state the read-only Client was created from
+// are known to it and the double ratchets of both clients advance
+// independently, which is safe as long as the read-only Client never sends.
+func WithReadOnly() Option {
+	return func(c *Client) {
+		c.readOnly = true
+	}
+}
+
+// WithPayloadTransformer sets the PayloadTransformer applied to the
+// ciphertexts of messages, without it they are sent as they are.
+func WithPayloadTransformer(transformer PayloadTransformer) Option {
+	return func(c *Client) {
+		c.payloadTransformer = transformer
+	}
+}
+
+// WithInboundLimit sets the number of messages of a contact which are
+// received within a window of the given duration, further messages of the
+// contact, including acknowledgements, edits and file chunks, are dropped
+// until the window ends to protect the memory and the statefile against
+// a flooding contact. The window is measured by the time of reception,
+// the limit must leave room for the backlog read after being offline.
+// There is no limit by default, a zero limit removes it.
+func WithInboundLimit(limit int, window time.Duration) Option {
+	return func(c *Client) {
+		c.inboundLimit = limit
+		c.inboundWindow = window
+	}
+}
+
+// ContactApprovalFunc is called with the nickname of a contact upon the
+// first message of a new conversation, it returns false to hold the
+// messages of the contact until ApproveContact or RejectContact is
+// called. It is called by the worker of the Client and must not call
+// the Client.
+type ContactApprovalFunc func(nickname string) (approved bool)
+
+// WithContactApproval sets the function which approves new
+// conversations. Without it all conversations are approved.
+func WithContactApproval(approval ContactApprovalFunc) Option {
+	return func(c *Client) {
+		c.contactApproval = approval
+	}
+}
+
+// DecryptionCandidatesFunc is called with an inbound ciphertext and the
+// contacts whose key exchange has completed, it returns the contacts in
+// the order in which their ratchets are tried on the ciphertext. The
+// contacts it omits are tried afterwards. It is called by the worker of
+// the Client and must not call the Client.
+type DecryptionCandidatesFunc func(ciphertext []byte, contacts []*Contact) []*Contact
+
+// WithDecryptionCandidates sets the function which orders the trial
+// decryption of inbound messages, e.g. RecentlyActiveFirst, such that
+// fewer ratchets are tried on average. Without it the contacts are
+// tried in any order.
+func WithDecryptionCandidates(candidates DecryptionCandidatesFunc) Option {
+	return func(c *Client) {
+		c.decryptionCandidates = candidates
+	}
+}
+
+// DecryptionFailureHandler is called with the mixnet message ID and the
+// ciphertext of an inbound message which none of the ratchets decrypted,
+// along with the error of each contact tried by nickname, e.g. to tell a
+// message which is not for us from a ratchet out of sync with a specific
+// contact. The message is quarantined if it returns true and dropped
+// otherwise. It is called by the worker of the Client and must not call
+// the Client.
+type DecryptionFailureHandler func(messageID [cConstants.MessageIDLength]byte, ciphertext []byte, errs map[string]error) (quarantine bool)
+
+// WithDecryptionFailureHandler sets the function called when the trial
+// decryption of an inbound message fails. Without it the errors are
+// logged and the message is quarantined.
+func WithDecryptionFailureHandler(handler DecryptionFailureHandler) Option {
+	return func(c *Client) {
+		c.decryptionFailure = handler
+	}
+}
+
+// FatalErrorHandler is called with fatal errors of the Client, the Client
+// shuts down if it returns true.
+type FatalErrorHandler func(err error) (shutdown bool)
+
+// WithFatalErrorHandler sets the handler called upon fatal errors. Without
+// a handler the Client logs the error and shuts down.
+func WithFatalErrorHandler(handler FatalErrorHandler) Option {
+	return func(c *Client) {
+		c.fatalErrorHandler = handler
+	}
+}
+
+// WithWorkerRecovery recovers from panics of the worker goroutine of the
+// Client, which processes the operations and the mixnet events. A panic
+// is logged with its stack and reported with a WorkerPanicEvent, then the
+// worker is restarted if restart is true and the panic is a fatal error
+// otherwise. Without it a panic of the worker crashes the process. Note
+// that recovering from a panic may leave the state of the Client
+// inconsistent, e.g. with a message half way through being stored or
+// sent, and this state is saved to the statefile like any other.
+func WithWorkerRecovery(restart bool) Option {
+	return func(c *Client) {
+		c.workerRecovery = true
+		c.workerRestart = restart
+	}
+}
+
+// WithDeferredRemoteSpool makes NewClientAndRemoteSpool return without
+// creating the remote spool, which is then created by EnsureRemoteSpool.
+// Until then messages can neither be sent nor received.
+func WithDeferredRemoteSpool() Option {
+	return func(c *Client) {
+		c.deferRemoteSpool = true
+	}
+}
+
+// WithCompression enables the compression of the messages sent to contacts
+// which announced that they can decode them. Messages which would not
+// become smaller are sent uncompressed.
+func WithCompression() Option {
+	return func(c *Client) {
+		c.compression = true
+	}
+}
+
+// WithOrderedDelivery makes the Client append the messages to each contact
+// to its remote spool strictly in the order they were sent: the priority
+// of messages is ignored and each append awaits the acknowledgement of the
+// previous one. Contacts are still sent to concurrently.
+func WithOrderedDelivery() Option {
+	return func(c *Client) {
+		c.orderedDelivery = true
+	}
+}
+
+// WithMaintenance allows the recovery operations such as SetReadOffset
+// which may lose messages and are not meant for regular use.
+func WithMaintenance() Option {
+	return func(c *Client) {
+		c.maintenance = true
+	}
+}
+
+// WithRandomizedPolling makes the Client wait a duration drawn uniformly
+// between min and max between the reads of its remote spool, instead of
+// one drawn from the exponential distribution given by the LambdaP of the
+// PKI document, and delays each retransmission by up to max-min on top of
+// the expected reply time. A wider range makes the timing of the traffic
+// of the Client harder to fingerprint at the cost of a higher latency of
+// receiving and of recovering lost messages. It has no effect unless
+// 0 <= min <= max.
+func WithRandomizedPolling(min, max time.Duration) Option {
+	return func(c *Client) {
+		if min < 0 || max < min {
+			return
+		}
+		c.pollMinInterval = min
+		c.pollMaxInterval = max
+	}
+}
+
+// WithMaxInboxReads sets the number of reads of the remote spool which may
+// await their reply at a time, further reads are skipped until a reply
+// arrives or the read is given up. It defaults to DefaultMaxInboxReads,
+// zero removes the limit.
+func WithMaxInboxReads(max int) Option {
+	return func(c *Client) {
+		c.maxInboxReads = max
+	}
+}
+
+// WithInboxReadInterleave makes the Client read its remote spool after
+// every n messages transmitted to contacts, in addition to the periodic
+// reads, such that a large outbound backlog doesn't delay the messages
+// of the contacts. The reads remain subject to WithMaxInboxReads. It
+// defaults to DefaultInboxReadInterleave, zero disables the interleaving.
+func WithInboxReadInterleave(n int) Option {
+	return func(c *Client) {
+		c.inboxReadInterleave = n
+	}
+}
+
+// WithPANDAGracePeriod sets the duration for which a pending PANDA key
+// exchange may wait for a PANDA configuration to appear in the PKI
+// document before the Client fails. It defaults to DefaultPANDAGracePeriod,
+// zero makes the Client wait indefinitely.
+func WithPANDAGracePeriod(period time.Duration) Option {
+	return func(c *Client) {
+		c.pandaGracePeriod = period
+	}
+}
+
+// WithEventBuffer bounds the number of events buffered for the EventSink,
+// which is unbounded by default. Once size events are buffered the oldest
+// buffered event is dropped for a new one if dropOldest is true, the new
+// event is dropped otherwise. DroppedEvents counts the dropped events.
+func WithEventBuffer(size int, dropOldest bool) Option {
+	return func(c *Client) {
+		c.eventBufferSize = size
+		c.eventBufferDropOldest = dropOldest
+	}
+}
+
+// WithEventHistory keeps the last size events delivered to the EventSink
+// for ReplayEvents, those older than retention are not replayed unless
+// retention is zero. No events are kept by default.
+func WithEventHistory(size int, retention time.Duration) Option {
+	return func(c *Client) {
+		c.eventHistorySize = size
+		c.eventHistoryRetention = retention
+	}
+}
+
+// WithDeliveryLog passes a DeliveryRecord to fn for each outbound message
+// delivered to the remote spool of a contact, e.g. to keep an audit trail
+// of the deliveries. fn is called in order by a goroutine of the Client,
+// up to size records are buffered while fn is busy, further records are
+// dropped and counted by DroppedDeliveryRecords. A size of zero buffers
+// DefaultDeliveryLogBuffer records.
+func WithDeliveryLog(fn func(*DeliveryRecord), size int) Option {
+	return func(c *Client) {
+		c.deliveryLog = fn
+		c.deliveryLogBuffer = size
+	}
+}
+
+// ContactOption configures optional behavior of a Contact
+// and is passed to NewContact.
+type ContactOption func(*Contact)
+
+// WithMeetingPlace sets the PANDA meeting place used for the key
+// exchange with a contact instead of the one configured for the session.
+func WithMeetingPlace(receiver, provider string, blobSize int) ContactOption {
+	return func(c *Contact) {
+		c.pandaConfig = &config.Panda{
+			Receiver: receiver,
+			Provider: provider,
+			BlobSize: blobSize,
+		}
+	}
+}
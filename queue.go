@@ -42,14 +42,24 @@ type Queue struct {
 }
 
 // Push pushes the given message ref onto the queue and returns nil
-// on success, otherwise an error is returned.
+// on success, otherwise an error is returned. The message ref is placed
+// behind all message refs of the same or a higher priority, but never
+// ahead of the tip of the queue which may be in flight.
 func (q *Queue) Push(e *queuedSpoolCommand) error {
 	q.Lock()
 	defer q.Unlock()
 	if q.len >= MaxQueueSize {
 		return ErrQueueFull
 	}
-	q.content[q.writeHead] = e
+	i := q.len
+	for ; i > 1; i-- {
+		prev := q.content[(q.readHead+i-1)%MaxQueueSize]
+		if prev.Priority >= e.Priority {
+			break
+		}
+		q.content[(q.readHead+i)%MaxQueueSize] = prev
+	}
+	q.content[(q.readHead+i)%MaxQueueSize] = e
 	q.writeHead = (q.writeHead + 1) % MaxQueueSize
 	q.len++
 	return nil
@@ -82,6 +92,26 @@ func (q *Queue) Peek() (*queuedSpoolCommand, error) {
 	return result, nil
 }
 
+// Index returns the position of the message ref with the given
+// ID in the queue, zero being the tip, or -1 if it is not queued.
+func (q *Queue) Index(id MessageID) int {
+	q.Lock()
+	defer q.Unlock()
+	for i := 0; i < q.len; i++ {
+		if q.content[(q.readHead+i)%MaxQueueSize].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Len returns the number of message refs in the queue.
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.len
+}
+
 type serializedQ struct {
 	Content   [MaxQueueSize]*queuedSpoolCommand
 	ReadHead  int
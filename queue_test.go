@@ -58,3 +58,43 @@ func TestQueue(t *testing.T) {
 	s, err = newq2.Pop()
 	assert.Error(err)
 }
+
+func TestQueuePriority(t *testing.T) {
+	assert := assert.New(t)
+
+	q := new(Queue)
+	for _, e := range []*queuedSpoolCommand{
+		{Provider: "tip"},
+		{Provider: "a"},
+		{Provider: "urgent", Priority: 2},
+		{Provider: "b"},
+		{Provider: "c", Priority: 1},
+		{Provider: "d", Priority: 2},
+	} {
+		err := q.Push(e)
+		assert.NoError(err)
+	}
+	for _, provider := range []string{"tip", "urgent", "d", "c", "a", "b"} {
+		e, err := q.Pop()
+		assert.NoError(err)
+		assert.Equal(provider, e.Provider)
+	}
+}
+
+func TestQueueIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	q := new(Queue)
+	for i := 0; i < MaxQueueSize; i++ {
+		assert.NoError(q.Push(&queuedSpoolCommand{ID: MessageID{byte(i)}}))
+	}
+	for i := 0; i < 5; i++ {
+		_, err := q.Pop()
+		assert.NoError(err)
+	}
+	// wrap around the end of the ring buffer
+	assert.NoError(q.Push(&queuedSpoolCommand{ID: MessageID{0xff}}))
+	assert.Equal(0, q.Index(MessageID{5}))
+	assert.Equal(MaxQueueSize-5, q.Index(MessageID{0xff}))
+	assert.Equal(-1, q.Index(MessageID{1}))
+}
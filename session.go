@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// session.go - mixnet session interface
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"github.com/katzenpost/client"
+	"github.com/katzenpost/client/config"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/client/utils"
+	"github.com/katzenpost/core/pki"
+)
+
+// Session is the part of the mixnet client session used by the Client to
+// send messages and to look up services. The Client uses a *client.Session
+// unless another Session is injected WithSession, e.g. a fake which records
+// the messages sent and feeds replies to test the message lifecycle.
+type Session interface {
+	// SendUnreliableMessage sends a message to the given
+	// service and returns the ID of the mixnet message.
+	SendUnreliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error)
+
+	// BlockingSendUnreliableMessage sends a message to
+	// the given service and returns the reply.
+	BlockingSendUnreliableMessage(recipient, provider string, message []byte) ([]byte, error)
+
+	// GetService returns a service with the given name.
+	GetService(serviceName string) (*utils.ServiceDescriptor, error)
+
+	// GetPandaConfig returns the PANDA configuration, nil if unset.
+	GetPandaConfig() *config.Panda
+
+	// GetReunionConfig returns the Reunion configuration, nil if unset.
+	GetReunionConfig() *config.Reunion
+
+	// CurrentDocument returns the current PKI document.
+	CurrentDocument() *pki.Document
+}
+
+var _ Session = (*client.Session)(nil)
@@ -0,0 +1,317 @@
+// SPDX-FileCopyrightText: 2020, David Stainton <dawuud@riseup.net>
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// transfer.go - file transfers
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// fileChunkLength is the length of the data carried by a chunk, the
+// payload holds the sequence, timestamp and chunk header fields as well.
+const fileChunkLength = DoubleRatchetPayloadLength - framePrefixLength - 8 - 8 - frameChunkLength
+
+// maxFileChunks is the number of chunks of a file of MaxFileSize.
+const maxFileChunks = 1 + (MaxFileSize+fileChunkLength-1)/fileChunkLength
+
+// TransferID identifies a file transfer.
+type TransferID uint64
+
+// fileTransfer is a file transfer to a contact. Chunk zero carries the
+// filename and the following chunks the data of the file. At most
+// FileTransferWindow chunks are queued for the contact at a time.
+type fileTransfer struct {
+	Nickname string
+	Filename string
+	Data     []byte
+
+	// Next is the index of the next chunk to queue.
+	Next uint32
+
+	// Pending maps the message IDs of the queued chunks to their index.
+	Pending map[MessageID]uint32
+
+	// Delivered is the number of bytes of the data delivered.
+	Delivered int
+
+	// Canceled is set for canceled transfers whose
+	// queued chunks await their delivery.
+	Canceled bool
+}
+
+func (t *fileTransfer) chunkCount() uint32 {
+	return uint32(1 + (len(t.Data)+fileChunkLength-1)/fileChunkLength)
+}
+
+func (t *fileTransfer) chunk(index uint32) []byte {
+	if index == 0 {
+		return []byte(t.Filename)
+	}
+	start := int(index-1) * fileChunkLength
+	end := start + fileChunkLength
+	if end > len(t.Data) {
+		end = len(t.Data)
+	}
+	return t.Data[start:end]
+}
+
+// incomingFile is a file transfer from a contact
+// whose chunks have not all been received yet.
+type incomingFile struct {
+	Nickname string
+	Count    uint32
+	Chunks   map[uint32][]byte
+	Started  time.Time
+}
+
+// SendFile sends the given file to the contact in chunks and returns the
+// ID of the transfer. FileTransferProgressEvents report the delivery of
+// the chunks. The transfer is persisted in the statefile and resumes after
+// a restart. The contact must support file transfers and the file must not
+// be larger than MaxFileSize.
+func (c *Client) SendFile(nickname, filename string, data []byte) (TransferID, error) {
+	op := &opSendFile{
+		name:         nickname,
+		filename:     filename,
+		data:         data,
+		responseChan: make(chan interface{}),
+	}
+	c.opCh <- op
+	switch r := (<-op.responseChan).(type) {
+	case error:
+		return 0, r
+	case TransferID:
+		return r, nil
+	default:
+		panic("BUG, unexpected response type")
+	}
+}
+
+func (c *Client) doSendFile(nickname, filename string, data []byte) interface{} {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return fmt.Errorf("key exchange with %s is pending", nickname)
+	}
+	if !contact.fileTransfer {
+		return fmt.Errorf("%s does not support file transfers", nickname)
+	}
+	if len(data) > MaxFileSize {
+		return ErrMessageTooLarge
+	}
+	if len(filename) > fileChunkLength {
+		return errors.New("filename is too long")
+	}
+	var id TransferID
+	for {
+		var idBytes [8]byte
+		if _, err := io.ReadFull(c.randReader, idBytes[:]); err != nil {
+			return err
+		}
+		id = TransferID(binary.LittleEndian.Uint64(idBytes[:]))
+		if _, ok := c.transfers[id]; !ok && id != 0 {
+			break
+		}
+	}
+	t := &fileTransfer{
+		Nickname: nickname,
+		Filename: filename,
+		Data:     append([]byte{}, data...),
+		Pending:  make(map[MessageID]uint32),
+	}
+	c.transfers[id] = t
+	c.queueChunks(contact, id, t)
+	c.save()
+	return id
+}
+
+// CancelFileTransfer cancels the file transfer with the given ID,
+// the chunks which are already queued are still transmitted.
+func (c *Client) CancelFileTransfer(id TransferID) error {
+	op := &opCancelFileTransfer{
+		id:           id,
+		responseChan: make(chan error),
+	}
+	c.opCh <- op
+	return <-op.responseChan
+}
+
+func (c *Client) doCancelFileTransfer(id TransferID) error {
+	t, ok := c.transfers[id]
+	if !ok || t.Canceled {
+		return ErrTransferNotFound
+	}
+	t.Canceled = true
+	if len(t.Pending) == 0 {
+		delete(c.transfers, id)
+	}
+	c.save()
+	return nil
+}
+
+// queueChunks queues the next chunks of the given transfer
+// for the contact as long as the window allows.
+func (c *Client) queueChunks(contact *Contact, id TransferID, t *fileTransfer) {
+	count := t.chunkCount()
+	for !t.Canceled && t.Next < count && len(t.Pending) < FileTransferWindow {
+		mesgID, err := c.newMessageID()
+		if err != nil {
+			c.fatalErrCh <- err
+			return
+		}
+		f := &frame{
+			Timestamp:  c.clock.Now(),
+			TransferID: uint64(id),
+			ChunkIndex: t.Next,
+			ChunkCount: count,
+			Message:    t.chunk(t.Next),
+		}
+		if err := c.enqueueFrame(contact, mesgID, f, 0); err != nil {
+			if err != ErrQueueFull {
+				c.log.Errorf("failed to queue chunk %d of transfer %x: %s", t.Next, id, err)
+			}
+			return
+		}
+		t.Pending[mesgID] = t.Next
+		t.Next++
+	}
+}
+
+// queueTransfers queues the next chunks of the transfers to the contact.
+func (c *Client) queueTransfers(contact *Contact) {
+	for id, t := range c.transfers {
+		if t.Nickname == contact.Nickname {
+			c.queueChunks(contact, id, t)
+		}
+	}
+}
+
+// transferOf returns the transfer to the given contact which
+// queued the message with the given ID or nil if there is none.
+func (c *Client) transferOf(nickname string, mesgID MessageID) (TransferID, *fileTransfer) {
+	for id, t := range c.transfers {
+		if _, ok := t.Pending[mesgID]; ok && t.Nickname == nickname {
+			return id, t
+		}
+	}
+	return 0, nil
+}
+
+// chunkDelivered records the delivery of the message with the given ID
+// if it is a chunk and returns false otherwise.
+func (c *Client) chunkDelivered(nickname string, mesgID MessageID) bool {
+	id, t := c.transferOf(nickname, mesgID)
+	if t == nil {
+		return false
+	}
+	index := t.Pending[mesgID]
+	delete(t.Pending, mesgID)
+	if index > 0 {
+		t.Delivered += len(t.chunk(index))
+	}
+	if t.Next == t.chunkCount() && len(t.Pending) == 0 || t.Canceled && len(t.Pending) == 0 {
+		delete(c.transfers, id)
+	}
+	c.save()
+	if !t.Canceled {
+		c.eventCh.In() <- &FileTransferProgressEvent{
+			TransferID:     id,
+			Nickname:       nickname,
+			BytesDelivered: t.Delivered,
+			Total:          len(t.Data),
+		}
+	}
+	return true
+}
+
+// chunkFailed fails the transfer of the chunk with the given ID
+// and returns false if the message is not a chunk.
+func (c *Client) chunkFailed(nickname string, mesgID MessageID, err error) bool {
+	id, t := c.transferOf(nickname, mesgID)
+	if t == nil {
+		return false
+	}
+	delete(c.transfers, id)
+	c.save()
+	if !t.Canceled {
+		c.eventCh.In() <- &FileTransferFailedEvent{
+			TransferID: id,
+			Nickname:   nickname,
+			Err:        err,
+		}
+	}
+	return true
+}
+
+// receiveChunk stores a received chunk of a file transfer
+// and emits a FileReceivedEvent once all chunks arrived.
+func (c *Client) receiveChunk(contact *Contact, f *frame) {
+	id := TransferID(f.TransferID)
+	if f.ChunkCount > maxFileChunks {
+		c.log.Errorf("Ignoring file transfer %x from %s, it is too large", id, contact.Nickname)
+		return
+	}
+	in, ok := c.incomingFiles[id]
+	if !ok {
+		in = &incomingFile{
+			Nickname: contact.Nickname,
+			Count:    f.ChunkCount,
+			Chunks:   make(map[uint32][]byte),
+			Started:  c.clock.Now(),
+		}
+		c.incomingFiles[id] = in
+	}
+	if in.Nickname != contact.Nickname || in.Count != f.ChunkCount {
+		c.log.Errorf("Ignoring chunk of conflicting file transfer %x from %s", id, contact.Nickname)
+		return
+	}
+	in.Chunks[f.ChunkIndex] = append([]byte{}, f.Message...)
+	if uint32(len(in.Chunks)) < in.Count {
+		return
+	}
+	delete(c.incomingFiles, id)
+	data := []byte{}
+	for i := uint32(1); i < in.Count; i++ {
+		data = append(data, in.Chunks[i]...)
+	}
+	c.eventCh.In() <- &FileReceivedEvent{
+		Nickname:   contact.Nickname,
+		TransferID: id,
+		Filename:   string(in.Chunks[0]),
+		Data:       data,
+	}
+}
+
+// garbageCollectIncomingFiles removes the incomplete file
+// transfers from contacts which started too long ago.
+func (c *Client) garbageCollectIncomingFiles() {
+	for id, in := range c.incomingFiles {
+		if c.clock.Now().After(in.Started.Add(MessageExpirationDuration)) {
+			delete(c.incomingFiles, id)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"runtime/debug"
 	"time"
 
 	"github.com/katzenpost/client"
@@ -42,6 +43,26 @@ func getReadInboxInterval(lambdaP float64, lambdaPMaxDelay uint64) time.Duration
 	return time.Duration(readInboxMsec) * time.Millisecond
 }
 
+// readInboxInterval returns the duration to wait before the next read of
+// our remote spool, drawn uniformly between the bounds set with
+// WithRandomizedPolling or else from the distribution of the PKI document.
+func (c *Client) readInboxInterval(lambdaP float64, lambdaPMaxDelay uint64) time.Duration {
+	if c.pollMaxInterval == 0 {
+		return getReadInboxInterval(lambdaP, lambdaPMaxDelay)
+	}
+	return c.pollMinInterval + c.pollJitter()
+}
+
+// pollJitter returns a duration drawn uniformly between zero and the
+// width of the range set with WithRandomizedPolling, zero without it.
+func (c *Client) pollJitter() time.Duration {
+	width := c.pollMaxInterval - c.pollMinInterval
+	if width <= 0 {
+		return 0
+	}
+	return time.Duration(rand.NewMath().Int63n(int64(width) + 1))
+}
+
 func (c *Client) worker() {
 	const maxDuration = time.Duration(math.MaxInt64)
 
@@ -52,66 +73,82 @@ func (c *Client) worker() {
 		return
 	}
 
-	readInboxInterval := getReadInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
+	readInboxInterval := c.readInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
 	readInboxTimer := time.NewTimer(readInboxInterval)
 	defer readInboxTimer.Stop()
 
 	gcMessagestimer := time.NewTimer(GarbageCollectionInterval)
 	defer gcMessagestimer.Stop()
 
+	deliveryTimeoutTimer := time.NewTimer(DeliveryTimeoutCheckInterval)
+	defer deliveryTimeoutTimer.Stop()
+
+	expireMessagesTimer := time.NewTimer(ExpireMessagesInterval)
+	defer expireMessagesTimer.Stop()
+
+	pandaRetryTimer := time.NewTimer(PANDARetryInterval)
+	defer pandaRetryTimer.Stop()
+
+	inboxStallTimer := time.NewTimer(InboxStallCheckInterval)
+	defer inboxStallTimer.Stop()
+
+	sendMapSweepTimer := time.NewTimer(SendMapSweepInterval)
+	defer sendMapSweepTimer.Stop()
+
 	isConnected := true
 	for {
 		var qo interface{}
 		select {
 		case <-c.HaltCh():
 			c.log.Debug("Terminating gracefully.")
+			c.drainOps()
 			c.stopContactTimers()
 			c.haltKeyExchanges()
 			return
 		case <-gcMessagestimer.C:
 			c.garbageCollectConversations()
 			gcMessagestimer.Reset(GarbageCollectionInterval)
+		case <-deliveryTimeoutTimer.C:
+			c.checkDeliveryTimeouts()
+			deliveryTimeoutTimer.Reset(DeliveryTimeoutCheckInterval)
+		case <-expireMessagesTimer.C:
+			c.expireMessages()
+			expireMessagesTimer.Reset(ExpireMessagesInterval)
+		case <-pandaRetryTimer.C:
+			c.retryDeferredPANDAExchanges()
+			pandaRetryTimer.Reset(PANDARetryInterval)
+		case <-sendMapSweepTimer.C:
+			c.sweepSendMap()
+			sendMapSweepTimer.Reset(SendMapSweepInterval)
+		case <-inboxStallTimer.C:
+			if c.checkInboxStall(isConnected) {
+				c.sendReadInbox()
+			}
+			inboxStallTimer.Reset(InboxStallCheckInterval)
 		case <-readInboxTimer.C:
 			if isConnected {
 				c.log.Debug("READING INBOX")
 				c.sendReadInbox()
-				readInboxInterval := getReadInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
+				readInboxInterval := c.readInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
 				c.log.Debug("<-readInboxTimer.C: Setting readInboxTimer to %s", readInboxInterval)
 				readInboxTimer.Reset(readInboxInterval)
 			}
 		case qo = <-c.opCh:
-			switch op := qo.(type) {
-			case *opAddContact:
-				err := c.createContact(op.name, op.sharedSecret)
-				if err != nil {
-					c.log.Errorf("create contact failure: %s", err.Error())
-				}
-			case *opRemoveContact:
-				c.doContactRemoval(op.name)
-			case *opSendMessage:
-				c.doSendMessage(op.id, op.name, op.payload)
-			case *opGetContacts:
-				op.responseChan <- c.contactNicknames
-			case *opRetransmit:
-				c.log.Debugf("RETRANSMISSION for %s", op.contact.Nickname)
-				c.sendMessage(op.contact)
-			default:
-				c.fatalErrCh <- errors.New("BUG, unknown operation type.")
-			}
+			c.handleOp(qo)
 		case update := <-c.pandaChan:
 			c.processPANDAUpdate(&update)
 			continue
 		case update := <-c.reunionChan:
 			c.processReunionUpdate(&update)
 			continue
-		case rawClientEvent := <-c.session.EventSink:
+		case rawClientEvent := <-c.sessionEvents:
 			switch event := rawClientEvent.(type) {
 			case *client.MessageIDGarbageCollected:
 				c.garbageCollectSendMap(event)
 			case *client.ConnectionStatusEvent:
 				c.log.Infof("Connection status change: isConnected %v", event.IsConnected)
 				if isConnected != event.IsConnected && event.IsConnected {
-					readInboxInterval := getReadInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
+					readInboxInterval := c.readInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
 					c.log.Debug("ConnectionStatusEvent: Connected: Setting readInboxTimer to %s", readInboxInterval)
 					readInboxTimer.Reset(readInboxInterval)
 					isConnected = event.IsConnected
@@ -132,7 +169,7 @@ func (c *Client) worker() {
 				continue
 			case *client.NewDocumentEvent:
 				doc = event.Document
-				readInboxInterval := getReadInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
+				readInboxInterval := c.readInboxInterval(doc.LambdaP, doc.LambdaPMaxDelay)
 				c.log.Debug("NewDocumentEvent: Setting readInboxTimer to %s", readInboxInterval)
 				readInboxTimer.Reset(readInboxInterval)
 				continue
@@ -143,3 +180,175 @@ func (c *Client) worker() {
 		}
 	} // end of for loop
 }
+
+// recoveringWorker runs the worker and recovers from its panics, see
+// WithWorkerRecovery. The worker is run again after a panic if it is
+// to be restarted.
+func (c *Client) recoveringWorker() {
+	for c.runWorker(c.worker) {
+		c.log.Warning("Restarting the worker.")
+	}
+}
+
+// runWorker runs the given worker until it returns or panics, it
+// returns true if the worker panicked and is to be restarted.
+func (c *Client) runWorker(worker func()) (restart bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		stack := debug.Stack()
+		c.log.Errorf("Worker panic: %v\n%s", r, stack)
+		c.eventCh.In() <- &WorkerPanicEvent{
+			Value:     r,
+			Stack:     stack,
+			Restarted: c.workerRestart,
+		}
+		if !c.workerRestart {
+			c.fatalErrCh <- fmt.Errorf("worker panic: %v", r)
+			return
+		}
+		restart = true
+	}()
+	worker()
+	return false
+}
+
+// drainOps performs the operations which were sent to the worker before
+// it halted, such that no caller is left waiting for its response and no
+// message passed to SendMessage is lost silently. The messages are stored
+// and queued for their contacts as usual, the outbound queues persist.
+func (c *Client) drainOps() {
+	for {
+		select {
+		case qo := <-c.opCh:
+			c.handleOp(qo)
+		default:
+			return
+		}
+	}
+}
+
+// handleOp performs an operation sent to the worker on opCh. The operations
+// are the op structs of operations.go, a synchronous operation carries a
+// responseChan which receives exactly one response. Each op type must be
+// handled here: an unknown op is a programming error which is logged and
+// reported with an InternalErrorEvent, its sender is not answered.
+func (c *Client) handleOp(qo interface{}) {
+	switch op := qo.(type) {
+	case *opAddContact:
+		err := c.createContact(op.name, op.sharedSecret, op.options...)
+		if err != nil {
+			c.log.Errorf("create contact failure: %s", err.Error())
+		}
+		if op.responseChan != nil {
+			op.responseChan <- err
+		}
+	case *opCancelPendingContact:
+		c.doCancelPendingContact(op.name)
+	case *opReserveContact:
+		op.responseChan <- c.doReserveContact(op.name, op.options...)
+	case *opBeginKeyExchange:
+		op.responseChan <- c.doBeginKeyExchange(op.name, op.sharedSecret)
+	case *opMuteContact:
+		op.responseChan <- c.doMuteContact(op.name, op.muted)
+	case *opResendMessage:
+		op.responseChan <- c.doResendMessage(op.name, op.id)
+	case *opBroadcast:
+		op.responseChan <- c.doBroadcast(op.names, op.payload)
+	case *opMarkConversationRead:
+		op.responseChan <- c.doMarkConversationRead(op.name)
+	case *opContactsWithPreview:
+		op.responseChan <- c.doContactsWithPreview()
+	case *opTotalUnread:
+		op.responseChan <- c.doTotalUnread()
+	case *opEditMessage:
+		op.responseChan <- c.doEditMessage(op.id, op.target, op.name, op.payload)
+	case *opDeleteMessageForEveryone:
+		op.responseChan <- c.doDeleteMessageForEveryone(op.id, op.target, op.name)
+	case *opApproveContact:
+		op.responseChan <- c.doApproveContact(op.name, op.approved)
+	case *opPendingKeyExchanges:
+		op.responseChan <- c.doPendingKeyExchanges()
+	case *opKeyExchangePhase:
+		op.responseChan <- c.doKeyExchangePhase(op.name)
+	case *opLastKeyExchangeResult:
+		op.responseChan <- c.doLastKeyExchangeResult(op.name)
+	case *opRekeyContact:
+		op.responseChan <- c.doRekeyContact(op.name, op.sharedSecret)
+	case *opRestartKeyExchange:
+		op.responseChan <- c.doRestartKeyExchange(op.name, op.sharedSecret)
+	case *opRemoveContact:
+		c.doContactRemoval(op.name)
+	case *opSendMessage:
+		c.doSendMessage(op.id, op.name, op.channel, op.payload, op.priority)
+	case *opSaveNote:
+		c.doSaveNote(op.id, op.payload)
+	case *opSendMessageDurable:
+		op.responseChan <- c.doSendMessageDurable(op.id, op.name, op.payload)
+	case *opSendMessageByID:
+		op.responseChan <- c.doSendMessageByID(op.id, op.contactID, op.payload)
+	case *opImportConversation:
+		op.responseChan <- c.doImportConversation(op.name, op.data)
+	case *opAppendHistoricalMessage:
+		op.responseChan <- c.doAppendHistoricalMessage(op.id, op.name, op.message)
+	case *opSetOffline:
+		c.doSetOffline(op.offline)
+	case *opSetPaused:
+		c.doSetPaused(op.paused)
+	case *opRatchetInfo:
+		op.responseChan <- c.doRatchetInfo(op.name)
+	case *opOutboundBacklog:
+		op.responseChan <- c.doOutboundBacklog()
+	case *opRetransmitAll:
+		op.responseChan <- c.doRetransmitAll()
+	case *opReadSpoolDescriptor:
+		op.responseChan <- c.doReadSpoolDescriptor()
+	case *opSetReadSpoolDescriptor:
+		op.responseChan <- c.doSetReadSpoolDescriptor(op.descriptor)
+	case *opReplaceReadSpoolDescriptor:
+		op.responseChan <- c.doReplaceReadSpoolDescriptor(op.descriptor)
+	case *opContactWriteDescriptor:
+		op.responseChan <- c.doContactWriteDescriptor(op.name)
+	case *opSpoolCheckCommand:
+		op.responseChan <- c.doSpoolCheckCommand(op.name)
+	case *opExportState:
+		op.responseChan <- c.doExportState(op.passphrase)
+	case *opSetContactLabel:
+		op.responseChan <- c.doSetContactLabel(op.name, op.label, op.add)
+	case *opContactsByLabel:
+		op.responseChan <- c.doContactsByLabel(op.label)
+	case *opSendFile:
+		op.responseChan <- c.doSendFile(op.name, op.filename, op.data)
+	case *opCancelFileTransfer:
+		op.responseChan <- c.doCancelFileTransfer(op.id)
+	case *opSetDisappearingTimer:
+		op.responseChan <- c.doSetDisappearingTimer(op.name, op.ttl)
+	case *opPruneBefore:
+		op.responseChan <- c.doPruneBefore(op.before, op.undelivered)
+	case *opFlush:
+		op.responseChan <- c.writeState()
+	case *opCompact:
+		op.responseChan <- c.doCompact()
+	case *opStorageBreakdown:
+		op.responseChan <- c.doStorageBreakdown()
+	case *opSummary:
+		op.responseChan <- c.doSummary()
+	case *opSetReadOffset:
+		op.responseChan <- c.doSetReadOffset(op.offset)
+	case *opHasContact:
+		op.responseChan <- c.doHasContact(op.name, op.id)
+	case *opGetContacts:
+		op.responseChan <- c.contactNicknames
+	case *opRetransmit:
+		c.log.Debugf("RETRANSMISSION for %s", op.contact.Nickname)
+		c.sendMessage(op.contact)
+	default:
+		err := fmt.Errorf("BUG, unknown operation type %T", op)
+		c.log.Error(err.Error())
+		c.eventCh.In() <- &InternalErrorEvent{
+			Err: err,
+		}
+	}
+}